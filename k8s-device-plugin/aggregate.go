@@ -0,0 +1,154 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// AggregateResource is a resource backed by the devices of every specific
+// resource matching it, e.g. amd.com/alveo-u250 for the U250 cards of any
+// shell. The aggregates are read from AggregateResourceFile:
+//
+//	{
+//	    "aggregates": [
+//	        {"name": "alveo-u250", "match": {"type": "u250"}},
+//	        {"name": "fpga"}
+//	    ]
+//	}
+//
+// The match attributes and patterns are the ones of the name customization
+// rules, an aggregate without match takes every device. A device is in every
+// aggregate it matches, the allocation ledger keeps it from being allocated
+// through more than one resource at a time.
+type AggregateResource struct {
+	Name  string            `json:"name"`
+	Match map[string]string `json:"match"`
+
+	matchers map[string]*nameMatcher
+}
+
+// compile checks the aggregate and prepares its matchers
+func (a *AggregateResource) compile() error {
+	if err := validateResourceName(a.Name); err != nil {
+		return err
+	}
+	a.matchers = make(map[string]*nameMatcher)
+	for attr, pattern := range a.Match {
+		if _, ok := nameMatchAttributes[attr]; !ok {
+			return fmt.Errorf("unknown match attribute %q", attr)
+		}
+		matcher, err := newNameMatcher(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q of %s: %v", pattern, attr, err)
+		}
+		a.matchers[attr] = matcher
+	}
+	return nil
+}
+
+func (a *AggregateResource) matches(device Device) bool {
+	for attr, matcher := range a.matchers {
+		if !matcher.match(nameMatchAttributes[attr](device)) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadAggregateResources reads and validates the aggregate resources
+func loadAggregateResources(fname string) ([]*AggregateResource, error) {
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Aggregates []*AggregateResource `json:"aggregates"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("Can't parse %s: %v", fname, err)
+	}
+	names := make(map[string]bool)
+	for i, aggregate := range config.Aggregates {
+		if aggregate == nil {
+			return nil, fmt.Errorf("aggregate %d in %s is empty", i, fname)
+		}
+		if err := aggregate.compile(); err != nil {
+			return nil, fmt.Errorf("invalid aggregate %d in %s: %v", i, fname, err)
+		}
+		if names[aggregate.Name] {
+			return nil, fmt.Errorf("duplicate aggregate %s in %s", aggregate.Name, fname)
+		}
+		names[aggregate.Name] = true
+	}
+	return config.Aggregates, nil
+}
+
+// isAggregate tells whether the device type is an aggregate resource
+func isAggregate(devType string) bool {
+	for _, aggregate := range cfg().AggregateResources {
+		if aggregate.Name == devType {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregateCollisions are the aggregates skipped for a name collision, they
+// are logged once rather than on every scan
+var aggregateCollisions = make(map[string]bool)
+
+// addAggregateDevices adds every aggregate resource with the devices of the
+// specific resources matching it. The devices keep their IDs, so a device
+// is the same physical device in every resource it is in. An aggregate named
+// like a specific resource is skipped.
+func addAggregateDevices(devMap map[string]map[string]Device) {
+	aggregateMap := make(map[string]map[string]Device)
+	for _, aggregate := range cfg().AggregateResources {
+		if _, ok := devMap[aggregate.Name]; ok {
+			if !aggregateCollisions[aggregate.Name] {
+				namingLog.WithField("resource", cfg().ResourceDomain+"/"+aggregate.Name).Warnf("Aggregate resource is named like a device type, it is skipped")
+				aggregateCollisions[aggregate.Name] = true
+			}
+			continue
+		}
+		delete(aggregateCollisions, aggregate.Name)
+		for _, devices := range devMap {
+			if isMgmtDevices(devices) {
+				continue
+			}
+			for id, device := range devices {
+				if !aggregate.matches(device) {
+					continue
+				}
+				if _, ok := aggregateMap[aggregate.Name]; !ok {
+					aggregateMap[aggregate.Name] = make(map[string]Device)
+				}
+				aggregateMap[aggregate.Name][id] = device
+			}
+		}
+	}
+	for name, devices := range aggregateMap {
+		devMap[name] = devices
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLoadAggregateResources(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		// err is a substring of the expected error
+		err  string
+		want []string
+	}{
+		{
+			name:    "empty",
+			content: `{}`,
+		},
+		{
+			name:    "match and catch all",
+			content: `{"aggregates": [{"name": "alveo-u250", "match": {"type": "u250"}}, {"name": "fpga"}]}`,
+			want:    []string{"alveo-u250", "fpga"},
+		},
+		{
+			name:    "regexp pattern",
+			content: `{"aggregates": [{"name": "gen3x16", "match": {"shell": "re:.*_gen3x16_.*"}}]}`,
+			want:    []string{"gen3x16"},
+		},
+		{
+			name:    "unknown field",
+			content: `{"aggregates": [{"name": "fpga", "matches": {"type": "u250"}}]}`,
+			err:     "unknown field",
+		},
+		{
+			name:    "not json",
+			content: `aggregates: [fpga]`,
+			err:     "Can't parse",
+		},
+		{
+			name:    "null aggregate",
+			content: `{"aggregates": [{"name": "fpga"}, null]}`,
+			err:     "aggregate 1",
+		},
+		{
+			name:    "invalid name",
+			content: `{"aggregates": [{"name": "alveo u250"}]}`,
+			err:     "alphanumeric",
+		},
+		{
+			name:    "no name",
+			content: `{"aggregates": [{"match": {"type": "u250"}}]}`,
+			err:     "invalid aggregate 0",
+		},
+		{
+			name:    "reserved mgmt suffix",
+			content: `{"aggregates": [{"name": "alveo-mgmt"}]}`,
+			err:     MgmtResourceSuffix,
+		},
+		{
+			name:    "unknown attribute",
+			content: `{"aggregates": [{"name": "fpga", "match": {"serial": "XFL*"}}]}`,
+			err:     `unknown match attribute "serial"`,
+		},
+		{
+			name:    "invalid glob",
+			content: `{"aggregates": [{"name": "fpga", "match": {"type": "u2[50"}}]}`,
+			err:     "invalid pattern",
+		},
+		{
+			name:    "invalid regexp",
+			content: `{"aggregates": [{"name": "fpga", "match": {"type": "re:u2(50"}}]}`,
+			err:     "invalid pattern",
+		},
+		{
+			name:    "duplicate",
+			content: `{"aggregates": [{"name": "fpga"}, {"name": "fpga", "match": {"type": "u250"}}]}`,
+			err:     "duplicate aggregate fpga",
+		},
+	}
+	dir := t.TempDir()
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fname := path.Join(dir, strings.Repeat("a", i+1)+".json")
+			if err := ioutil.WriteFile(fname, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			aggregates, err := loadAggregateResources(fname)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, aggregate := range aggregates {
+				names = append(names, aggregate.Name)
+			}
+			if len(names) != len(test.want) || (len(names) != 0 && !reflect.DeepEqual(names, test.want)) {
+				t.Errorf("aggregates %v, want %v", names, test.want)
+			}
+		})
+	}
+
+	if _, err := loadAggregateResources(path.Join(dir, "missing.json")); err == nil {
+		t.Errorf("loaded a missing file")
+	}
+}
+
+func TestAddAggregateDevices(t *testing.T) {
+	aggregates := []*AggregateResource{
+		{Name: "alveo-u250", Match: map[string]string{"type": "U250"}},
+		{Name: "gen3x16", Match: map[string]string{"shell": "re:.*_gen3x16_.*", "type": "u2*"}},
+		{Name: "fpga"},
+		// named like a device type, it is skipped
+		{Name: "u280"},
+		// matches nothing, it isn't registered
+		{Name: "versal", Match: map[string]string{"type": "vck*"}},
+	}
+	for _, aggregate := range aggregates {
+		if err := aggregate.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	useConfig(t, defaultConfig(), aggregates...)
+
+	u250 := Device{DBDF: "0000:3b:00.1", deviceType: "u250", shellVer: "xilinx_u250_gen3x16_xdma_shell_4_1"}
+	u250old := Device{DBDF: "0000:3c:00.1", deviceType: "u250", shellVer: "xilinx_u250_xdma_201830_2"}
+	u280 := Device{DBDF: "0000:af:00.1", deviceType: "u280", shellVer: "xilinx_u280_gen3x16_xdma_base_1"}
+	devMap := map[string]map[string]Device{
+		"xilinx_u250_gen3x16_xdma_shell_4_1": {u250.DBDF: u250},
+		"xilinx_u250_xdma_201830_2":          {u250old.DBDF: u250old},
+		"u280":                               {u280.DBDF: u280},
+		// the mgmt devices are never aggregated
+		"u280" + MgmtResourceSuffix: {u280.DBDF: u280},
+	}
+	addAggregateDevices(devMap)
+
+	want := map[string][]string{
+		"alveo-u250": {u250.DBDF, u250old.DBDF},
+		"gen3x16":    {u250.DBDF, u280.DBDF},
+		"fpga":       {u250.DBDF, u250old.DBDF, u280.DBDF},
+		"u280":       {u280.DBDF},
+	}
+	for name, ids := range want {
+		got := []string{}
+		for id, device := range devMap[name] {
+			if id != device.DBDF {
+				t.Errorf("%s: device %s is keyed %s", name, device.DBDF, id)
+			}
+			got = append(got, id)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, ids) {
+			t.Errorf("%s: devices %v, want %v", name, got, ids)
+		}
+	}
+	if _, ok := devMap["versal"]; ok {
+		t.Errorf("empty aggregate registered")
+	}
+	if len(devMap) != 7 {
+		t.Errorf("%d resources, want 7", len(devMap))
+	}
+	if !aggregateCollisions["u280"] || len(aggregateCollisions) != 1 {
+		t.Errorf("collisions %v, want u280", aggregateCollisions)
+	}
+
+	// the collision is forgotten once the device type is gone, and the
+	// aggregate is registered then
+	devMap = map[string]map[string]Device{
+		"xilinx_u250_gen3x16_xdma_shell_4_1": {u250.DBDF: u250},
+	}
+	addAggregateDevices(devMap)
+	if aggregateCollisions["u280"] || len(devMap["u280"]) != 1 {
+		t.Errorf("u280 is still a collision, %v", devMap["u280"])
+	}
+}
+
+func TestIsAggregate(t *testing.T) {
+	useConfig(t, defaultConfig(), &AggregateResource{Name: "fpga"})
+	if !isAggregate("fpga") || isAggregate("u250") || isAggregate("fpga"+MgmtResourceSuffix) {
+		t.Errorf("isAggregate doesn't match the aggregate names")
+	}
+}
+
+func TestLoadConfigFilesAggregates(t *testing.T) {
+	dir := t.TempDir()
+	c := defaultConfig()
+	c.ShellFamilyFile = path.Join(dir, "ShellFamilies.json")
+	c.XclbinPreloadFile = path.Join(dir, "XclbinPreloads.json")
+	c.AggregateResourceFile = path.Join(dir, "AggregateResources.json")
+	if err := ioutil.WriteFile(c.AggregateResourceFile, []byte(`{"aggregates": [{"name": "fpga"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// without the pod resources an allocated device would never be released
+	c.PodResources = false
+	rc, errs := loadConfigFiles(c)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "require podResources") || len(rc.AggregateResources) != 0 {
+		t.Errorf("got %v and aggregates %v, want them ignored", errs, rc.AggregateResources)
+	}
+
+	c.PodResources = true
+	if rc, errs := loadConfigFiles(c); len(errs) != 0 || len(rc.AggregateResources) != 1 || rc.AggregateResources[0].Name != "fpga" {
+		t.Errorf("got %v and aggregates %v", errs, rc.AggregateResources)
+	}
+
+	// an empty aggregate file needs no pod resources
+	if err := ioutil.WriteFile(c.AggregateResourceFile, []byte(`{"aggregates": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.PodResources = false
+	if rc, errs := loadConfigFiles(c); len(errs) != 0 || len(rc.AggregateResources) != 0 {
+		t.Errorf("got %v and aggregates %v", errs, rc.AggregateResources)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditDeviceNode is a device node handed to a container
+type AuditDeviceNode struct {
+	HostPath      string `json:"hostPath"`
+	ContainerPath string `json:"containerPath"`
+	Permissions   string `json:"permissions"`
+}
+
+// AuditMount is a mount handed to a container
+type AuditMount struct {
+	HostPath      string `json:"hostPath"`
+	ContainerPath string `json:"containerPath"`
+	ReadOnly      bool   `json:"readOnly"`
+}
+
+// AuditRecord is the allocation of devices to a container, one line of the
+// audit log
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Node     string    `json:"node,omitempty"`
+	Resource string    `json:"resource"`
+	// Requested are the device IDs kubelet asked for, Siblings the devices of
+	// the same cards added in Card allocation mode
+	Requested     []string          `json:"requested"`
+	Siblings      []string          `json:"siblings,omitempty"`
+	SerialNumbers []string          `json:"serialNumbers,omitempty"`
+	DeviceNodes   []AuditDeviceNode `json:"deviceNodes,omitempty"`
+	Mounts        []AuditMount      `json:"mounts,omitempty"`
+	CDIDevices    []string          `json:"cdiDevices,omitempty"`
+	// Error is set if the allocation failed
+	Error string `json:"error,omitempty"`
+}
+
+// auditLog is the append-only JSON lines file the allocations are recorded
+// in. It is rotated once larger than AuditLogMaxSize MiB, keeping the
+// AuditLogMaxFiles previous files as <file>.1 to <file>.<n>.
+type auditLog struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+var allocAudit auditLog
+
+// open opens the audit log file in append mode, closing the previous one if
+// the file changed with the config
+func (a *auditLog) open() error {
+	if a.file != nil && a.path == cfg().AuditLogFile {
+		return nil
+	}
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	file, err := os.OpenFile(cfg().AuditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.path = cfg().AuditLogFile
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// rotate moves the audit log file to <file>.1, after moving the previous
+// files up by one and dropping the oldest
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+	// the config rejects an auditLogMaxFiles below 1, the file is always
+	// moved to <file>.1
+	maxFiles := cfg().AuditLogMaxFiles
+	os.Remove(a.path + "." + strconv.Itoa(maxFiles))
+	for i := maxFiles - 1; i >= 1; i-- {
+		os.Rename(a.path+"."+strconv.Itoa(i), a.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// write appends the record and syncs it to disk
+func (a *auditLog) write(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err := a.open(); err != nil {
+		return err
+	}
+	if a.size > 0 && a.size+int64(len(line)) > int64(cfg().AuditLogMaxSize)<<20 {
+		if err := a.rotate(); err != nil {
+			return fmt.Errorf("Can't rotate %s: %v", a.path, err)
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// auditAllocation records the allocation of every container of an Allocate
+// call, or its failure. The records of the containers without response carry
+// the error.
+func (m *FPGADevicePluginServer) auditAllocation(req *pluginapi.AllocateRequest, response *pluginapi.AllocateResponse, allocErr error) {
+	if cfg().AuditLogFile == "" {
+		return
+	}
+	now := time.Now()
+	devices := m.currentDevices()
+	for i, creq := range req.ContainerRequests {
+		record := AuditRecord{
+			Time:      now,
+			Node:      os.Getenv(NodeNameEnv),
+			Resource:  m.resourceName,
+			Requested: creq.DevicesIDs,
+		}
+		ids := m.addCardSiblings(creq.DevicesIDs)
+		serials := make(map[string]bool)
+		for _, id := range ids {
+			if !IsContain(creq.DevicesIDs, id) {
+				record.Siblings = append(record.Siblings, id)
+			}
+			if dev, ok := devices[id]; ok && dev.SN != "" {
+				serials[dev.SN] = true
+			}
+		}
+		for sn := range serials {
+			record.SerialNumbers = append(record.SerialNumbers, sn)
+		}
+		sort.Strings(record.SerialNumbers)
+		if allocErr != nil || response == nil || i >= len(response.ContainerResponses) {
+			record.Error = "no allocation"
+			if allocErr != nil {
+				record.Error = allocErr.Error()
+			}
+		} else {
+			cres := response.ContainerResponses[i]
+			for _, spec := range cres.Devices {
+				record.DeviceNodes = append(record.DeviceNodes, AuditDeviceNode{
+					HostPath:      spec.HostPath,
+					ContainerPath: spec.ContainerPath,
+					Permissions:   spec.Permissions,
+				})
+			}
+			for _, mount := range cres.Mounts {
+				record.Mounts = append(record.Mounts, AuditMount{
+					HostPath:      mount.HostPath,
+					ContainerPath: mount.ContainerPath,
+					ReadOnly:      mount.ReadOnly,
+				})
+			}
+			for _, cdiDevice := range cres.CDIDevices {
+				record.CDIDevices = append(record.CDIDevices, cdiDevice.Name)
+			}
+		}
+		if err := allocAudit.write(record); err != nil {
+			m.logger().Errorf("Can't write the audit log %s: %v", cfg().AuditLogFile, err)
+		}
+	}
+}
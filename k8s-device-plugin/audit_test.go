@@ -0,0 +1,310 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAuditResources returns the resources of the records of an audit log,
+// nil if the file doesn't exist
+func readAuditResources(t *testing.T, fname string) []string {
+	t.Helper()
+	file, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	resources := []string{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("%s: %v", fname, err)
+		}
+		resources = append(resources, record.Resource)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return resources
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	// a record takes 400 KiB, two of them fit in the 1 MiB limit
+	padding := strings.Repeat("x", 400<<10)
+	tests := []struct {
+		name     string
+		maxFiles int
+		// existing are the records in the audit log before the plugin
+		// starts, the records are numbered from 0 across both
+		existing int
+		records  int
+		// want are the records of the audit log and of the rotated files, by
+		// suffix
+		want map[string][]string
+	}{
+		{
+			name:     "no rotation below the limit",
+			maxFiles: 2,
+			records:  2,
+			want:     map[string][]string{"": {"0", "1"}},
+		},
+		{
+			name:     "rotation at the limit",
+			maxFiles: 2,
+			records:  3,
+			want:     map[string][]string{"": {"2"}, ".1": {"0", "1"}},
+		},
+		{
+			name:     "the oldest file is dropped",
+			maxFiles: 2,
+			records:  7,
+			want:     map[string][]string{"": {"6"}, ".1": {"4", "5"}, ".2": {"2", "3"}},
+		},
+		{
+			name:     "one rotated file",
+			maxFiles: 1,
+			records:  7,
+			want:     map[string][]string{"": {"6"}, ".1": {"4", "5"}},
+		},
+		{
+			name:     "the existing records count",
+			maxFiles: 2,
+			existing: 1,
+			records:  2,
+			want:     map[string][]string{"": {"2"}, ".1": {"0", "1"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := defaultConfig()
+			config.AuditLogFile = path.Join(t.TempDir(), "audit.log")
+			config.AuditLogMaxSize = 1
+			config.AuditLogMaxFiles = test.maxFiles
+			useConfig(t, config)
+			write := func(audit *auditLog, i int) {
+				if err := audit.write(AuditRecord{Resource: strconv.Itoa(i), Requested: []string{padding}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			audit := &auditLog{}
+			for i := 0; i < test.existing; i++ {
+				write(audit, i)
+			}
+			if audit.file != nil {
+				audit.file.Close()
+			}
+			audit = &auditLog{}
+			defer func() {
+				if audit.file != nil {
+					audit.file.Close()
+				}
+			}()
+			for i := test.existing; i < test.existing+test.records; i++ {
+				write(audit, i)
+			}
+			got := make(map[string][]string)
+			for _, suffix := range []string{"", ".1", ".2", ".3"} {
+				if resources := readAuditResources(t, config.AuditLogFile+suffix); resources != nil {
+					got[suffix] = resources
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAuditLogFileChange(t *testing.T) {
+	dir := t.TempDir()
+	config := defaultConfig()
+	config.AuditLogFile = path.Join(dir, "audit.log")
+	useConfig(t, config)
+	audit := &auditLog{}
+	defer func() {
+		if audit.file != nil {
+			audit.file.Close()
+		}
+	}()
+	if err := audit.write(AuditRecord{Resource: "0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records go to the new file once the config changes
+	config = defaultConfig()
+	config.AuditLogFile = path.Join(dir, "new.log")
+	useConfig(t, config)
+	if err := audit.write(AuditRecord{Resource: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAuditResources(t, path.Join(dir, "audit.log")); !reflect.DeepEqual(got, []string{"0"}) {
+		t.Errorf("previous file has %v", got)
+	}
+	if got := readAuditResources(t, path.Join(dir, "new.log")); !reflect.DeepEqual(got, []string{"1"}) {
+		t.Errorf("new file has %v", got)
+	}
+
+	// a file which can't be created is an error, not a panic
+	config.AuditLogFile = path.Join(dir, "missing", "audit.log")
+	useConfig(t, config)
+	if err := audit.write(AuditRecord{Resource: "2"}); err == nil {
+		t.Errorf("no error writing to %s", config.AuditLogFile)
+	}
+}
+
+// readAuditRecords returns the records of an audit log
+func readAuditRecords(t *testing.T, fname string) []AuditRecord {
+	t.Helper()
+	content, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []AuditRecord{}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var record AuditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("%s: %v", fname, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAuditAllocation(t *testing.T) {
+	config := defaultConfig()
+	config.AuditLogFile = path.Join(t.TempDir(), "audit.log")
+	useConfig(t, config)
+	t.Setenv(NodeNameEnv, "fpga-1")
+	defer func() {
+		allocAudit.lock.Lock()
+		if allocAudit.file != nil {
+			allocAudit.file.Close()
+			allocAudit.file = nil
+		}
+		allocAudit.lock.Unlock()
+	}()
+	m := &FPGADevicePluginServer{resourceName: "amd.com/u250", devices: map[string]Device{
+		"0000:3b:00.1": {DBDF: "0000:3b:00.1", SN: "XFL1B"},
+		"0000:3c:00.1": {DBDF: "0000:3c:00.1", SN: "XFL1A"},
+		"0000:3d:00.1": {DBDF: "0000:3d:00.1"},
+	}}
+	req := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+		{DevicesIDs: []string{"0000:3b:00.1", "0000:3c:00.1"}},
+		{DevicesIDs: []string{"0000:3d:00.1"}},
+	}}
+	// the second container has no response
+	response := &pluginapi.AllocateResponse{ContainerResponses: []*pluginapi.ContainerAllocateResponse{{
+		Devices:    []*pluginapi.DeviceSpec{{HostPath: "/dev/dri/renderD128", ContainerPath: "/dev/dri/renderD128", Permissions: "rwm"}},
+		Mounts:     []*pluginapi.Mount{{HostPath: "/opt/xilinx/dsa", ContainerPath: "/opt/xilinx/dsa", ReadOnly: true}},
+		CDIDevices: []*pluginapi.CDIDevice{{Name: "amd.com/u250=XFL1B"}},
+	}}}
+	before := time.Now()
+	m.auditAllocation(req, response, nil)
+	m.auditAllocation(&pluginapi.AllocateRequest{ContainerRequests: req.ContainerRequests[1:]}, nil, errors.New("device 0000:3d:00.1 unhealthy"))
+
+	records := readAuditRecords(t, config.AuditLogFile)
+	if len(records) != 3 {
+		t.Fatalf("%d records, expect 3: %+v", len(records), records)
+	}
+	for _, record := range records {
+		if record.Node != "fpga-1" || record.Resource != "amd.com/u250" || record.Time.Before(before.Truncate(time.Second)) {
+			t.Errorf("record %+v", record)
+		}
+	}
+	expect := AuditRecord{
+		Requested:     []string{"0000:3b:00.1", "0000:3c:00.1"},
+		SerialNumbers: []string{"XFL1A", "XFL1B"},
+		DeviceNodes:   []AuditDeviceNode{{HostPath: "/dev/dri/renderD128", ContainerPath: "/dev/dri/renderD128", Permissions: "rwm"}},
+		Mounts:        []AuditMount{{HostPath: "/opt/xilinx/dsa", ContainerPath: "/opt/xilinx/dsa", ReadOnly: true}},
+		CDIDevices:    []string{"amd.com/u250=XFL1B"},
+	}
+	got := records[0]
+	got.Time, got.Node, got.Resource = time.Time{}, "", ""
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("record\n%+v\nexpect\n%+v", got, expect)
+	}
+	if records[1].Error != "no allocation" || records[1].SerialNumbers != nil || records[1].DeviceNodes != nil {
+		t.Errorf("record without response %+v", records[1])
+	}
+	if records[2].Error != "device 0000:3d:00.1 unhealthy" {
+		t.Errorf("failed allocation record %+v", records[2])
+	}
+
+	// no record when the audit log is off
+	fname := config.AuditLogFile
+	useConfig(t, defaultConfig())
+	m.auditAllocation(req, response, nil)
+	if records := readAuditRecords(t, fname); len(records) != 3 {
+		t.Errorf("%d records with the audit log off", len(records))
+	}
+}
+
+// TestAuditAllocationDeviceUpdate runs the audit of allocations while the
+// device list is replaced, go test -race reports an unlocked read
+func TestAuditAllocationDeviceUpdate(t *testing.T) {
+	config := defaultConfig()
+	config.AuditLogFile = path.Join(t.TempDir(), "audit.log")
+	useConfig(t, config)
+	defer func() {
+		allocAudit.lock.Lock()
+		if allocAudit.file != nil {
+			allocAudit.file.Close()
+			allocAudit.file = nil
+		}
+		allocAudit.lock.Unlock()
+	}()
+	devices := map[string]Device{"0000:3b:00.1": {DBDF: "0000:3b:00.1", SN: "XFL1B"}}
+	m := &FPGADevicePluginServer{resourceName: "amd.com/u250", devices: devices}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			m.lock.Lock()
+			m.devices = map[string]Device{"0000:3b:00.1": {DBDF: "0000:3b:00.1", SN: "XFL1B"}}
+			m.lock.Unlock()
+		}
+	}()
+	req := &pluginapi.AllocateRequest{ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"0000:3b:00.1"}}}}
+	for i := 0; i < 50; i++ {
+		m.auditAllocation(req, nil, nil)
+	}
+	<-done
+	records := readAuditRecords(t, config.AuditLogFile)
+	if len(records) != 50 {
+		t.Fatalf("%d records, expect 50", len(records))
+	}
+	if sn := records[49].SerialNumbers; !reflect.DeepEqual(sn, []string{"XFL1B"}) {
+		t.Errorf("serial numbers %v, expect [XFL1B]", sn)
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Container Device Interface(CDI) support. The plugin describes every device
+// and card of the node in a CDI spec file, so container runtimes (containerd,
+// CRI-O) and other tools like podman can inject the FPGAs by CDI name.
+// See https://github.com/cncf-tags/container-device-interface/blob/main/SPEC.md
+const (
+	// CDI is not used, Allocate returns the device nodes and mounts
+	CDIModeOff = "Off"
+	// CDI spec files are generated, Allocate still returns the device nodes and mounts
+	CDIModeSpec = "Spec"
+	// CDI spec files are generated, Allocate references the devices by CDI name
+	CDIModeInject = "Inject"
+
+	CDIVersion          = "0.5.0"
+	CDIClass            = "fpga"
+	CDIAnnotationPrefix = "cdi.k8s.io/"
+	CDICardPrefix       = "card-"
+)
+
+type cdiDeviceNode struct {
+	Path        string `json:"path"`
+	HostPath    string `json:"hostPath,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+type cdiMount struct {
+	HostPath      string   `json:"hostPath"`
+	ContainerPath string   `json:"containerPath"`
+	Options       []string `json:"options,omitempty"`
+}
+
+type cdiContainerEdits struct {
+	Env         []string         `json:"env,omitempty"`
+	DeviceNodes []*cdiDeviceNode `json:"deviceNodes,omitempty"`
+	Mounts      []*cdiMount      `json:"mounts,omitempty"`
+}
+
+type cdiDevice struct {
+	Name           string            `json:"name"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits"`
+}
+
+type cdiSpec struct {
+	Version string      `json:"cdiVersion"`
+	Kind    string      `json:"kind"`
+	Devices []cdiDevice `json:"devices"`
+}
+
+func parseCDIMode(value string) (string, error) {
+	for _, mode := range []string{CDIModeOff, CDIModeSpec, CDIModeInject} {
+		if strings.EqualFold(strings.TrimSpace(value), mode) {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("invalid CDI mode %q, expect one of %s, %s, %s", value, CDIModeOff, CDIModeSpec, CDIModeInject)
+}
+
+// cdiVendor returns the vendor part of the CDI kind, e.g. amd.com
+func cdiVendor() string {
+	return cfg().ResourceDomain
+}
+
+// cdiKind returns the CDI kind of the devices, e.g. amd.com/fpga
+func cdiKind() string {
+	return cdiVendor() + "/" + CDIClass
+}
+
+// cdiDeviceName returns the CDI device name of a device, mgmt is set for the
+// devices of a dedicated mgmt resource
+func cdiDeviceName(id string, mgmt bool) string {
+	if mgmt {
+		return id + MgmtResourceSuffix
+	}
+	return id
+}
+
+// cdiQualifiedName returns the fully qualified CDI device name, e.g.
+// amd.com/fpga=0000:3b:00.1
+func cdiQualifiedName(name string) string {
+	return cdiKind() + "=" + name
+}
+
+// cdiSpecFile returns the path of the CDI spec file of the plugin
+func cdiSpecFile() string {
+	return path.Join(cfg().CDISpecDir, cdiVendor()+"-"+CDIClass+".json")
+}
+
+// cdiEnvName turns an id into the environment variable name
+func cdiEnvName(id string, key string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, id)
+	return strings.ToUpper("AMD_FPGA_" + name + "_" + key)
+}
+
+// cdiEdits converts the device nodes and mounts of an allocate response to
+// CDI container edits
+func cdiEdits(cres *pluginapi.ContainerAllocateResponse) cdiContainerEdits {
+	edits := cdiContainerEdits{}
+	for _, spec := range cres.Devices {
+		edits.DeviceNodes = append(edits.DeviceNodes, &cdiDeviceNode{
+			Path:        spec.ContainerPath,
+			HostPath:    spec.HostPath,
+			Permissions: spec.Permissions,
+		})
+	}
+	for _, mount := range cres.Mounts {
+		options := []string{"bind"}
+		if mount.ReadOnly {
+			options = append(options, "ro")
+		}
+		edits.Mounts = append(edits.Mounts, &cdiMount{
+			HostPath:      mount.HostPath,
+			ContainerPath: mount.ContainerPath,
+			Options:       options,
+		})
+	}
+	return edits
+}
+
+// buildCDISpec describes every device of every resource in a CDI spec. Each
+// device is named after its device ID, and every card with a serial number
+// gets an additional "card-<SN>" device with the nodes of all its devices.
+func buildCDISpec(devMap map[string]map[string]Device) *cdiSpec {
+	spec := &cdiSpec{
+		Version: CDIVersion,
+		Kind:    cdiKind(),
+	}
+	cards := make(map[string]*pluginapi.ContainerAllocateResponse)
+	cardEnv := make(map[string][]string)
+	cardNodes := make(map[string]bool)
+	// walk the devices in a fixed order, so the same devices give the same spec
+	devTypes := []string{}
+	for devType := range devMap {
+		// the devices of aggregate resources are described by their
+		// specific resources already
+		if isAggregate(devType) || isAggregate(strings.TrimSuffix(devType, MgmtResourceSuffix)) {
+			continue
+		}
+		devTypes = append(devTypes, devType)
+	}
+	sort.Strings(devTypes)
+	for _, devType := range devTypes {
+		ids := []string{}
+		for id := range devMap[devType] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			dev := devMap[devType][id]
+			cres := new(pluginapi.ContainerAllocateResponse)
+			if dev.mgmtOnly {
+				appendDeviceNode(cres, dev.Nodes.Mgmt, cfg().MgmtPermissions)
+			} else {
+				appendDeviceNodes(cres, devType, dev)
+			}
+			name := cdiDeviceName(id, dev.mgmtOnly)
+			edits := cdiEdits(cres)
+			edits.Env = []string{
+				cdiEnvName(name, "BDF") + "=" + dev.DBDF,
+				cdiEnvName(name, "SHELL") + "=" + dev.shellVer,
+				cdiEnvName(name, "SN") + "=" + dev.SN,
+			}
+			spec.Devices = append(spec.Devices, cdiDevice{Name: name, ContainerEdits: edits})
+
+			if dev.SN == "" || dev.SN == AWS_SN || dev.mgmtOnly {
+				continue
+			}
+			card, ok := cards[dev.SN]
+			if !ok {
+				card = new(pluginapi.ContainerAllocateResponse)
+				cards[dev.SN] = card
+			}
+			// virtual devices of a device share the same nodes
+			for i, spec := range cres.Devices {
+				if !cardNodes[spec.HostPath] {
+					cardNodes[spec.HostPath] = true
+					card.Devices = append(card.Devices, spec)
+					card.Mounts = append(card.Mounts, cres.Mounts[i])
+				}
+			}
+			cardEnv[dev.SN] = append(cardEnv[dev.SN], cdiEnvName(CDICardPrefix+dev.SN, "BDF_"+strconv.Itoa(len(cardEnv[dev.SN])))+"="+dev.DBDF)
+		}
+	}
+	for sn, card := range cards {
+		edits := cdiEdits(card)
+		edits.Env = cardEnv[sn]
+		spec.Devices = append(spec.Devices, cdiDevice{Name: CDICardPrefix + sn, ContainerEdits: edits})
+	}
+	sort.Slice(spec.Devices, func(i, j int) bool {
+		return spec.Devices[i].Name < spec.Devices[j].Name
+	})
+	return spec
+}
+
+// writeFileAtomic writes the file through a temporary file which is then
+// renamed, so the readers never see a partially written file
+func writeFileAtomic(fname string, content []byte, perm os.FileMode) error {
+	dir, base := path.Split(fname)
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-"+base+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fname)
+}
+
+// writeCDISpec writes the CDI spec of all devices if it changed. The spec is
+// written atomically, so the runtime never sees a partially written spec.
+func (m *FPGADevicePlugin) writeCDISpec() error {
+	if cfg().CDIMode == CDIModeOff {
+		// CDI was turned off by a config reload
+		if m.cdiSpecPath != "" {
+			os.Remove(m.cdiSpecPath)
+			m.cdiSpec = nil
+			m.cdiSpecPath = ""
+		}
+		return nil
+	}
+	content, err := json.MarshalIndent(buildCDISpec(m.devices), "", "  ")
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(content, m.cdiSpec) && cdiSpecFile() == m.cdiSpecPath {
+		return nil
+	}
+	// the spec file is named after the resource domain, remove the one of
+	// the previous domain
+	if m.cdiSpecPath != "" && m.cdiSpecPath != cdiSpecFile() {
+		os.Remove(m.cdiSpecPath)
+	}
+	if err := writeFileAtomic(cdiSpecFile(), content, 0644); err != nil {
+		return err
+	}
+	m.cdiSpec = content
+	m.cdiSpecPath = cdiSpecFile()
+	return nil
+}
+
+// setCDIDevices references the allocated devices by their CDI names, both
+// through the annotation understood by containerd and CRI-O, and through the
+// CDIDevices field of newer kubelets
+func setCDIDevices(cres *pluginapi.ContainerAllocateResponse, resourceName string, mgmt bool, ids []string) {
+	names := []string{}
+	for _, id := range ids {
+		name := cdiQualifiedName(cdiDeviceName(id, mgmt))
+		names = append(names, name)
+		cres.CDIDevices = append(cres.CDIDevices, &pluginapi.CDIDevice{Name: name})
+	}
+	// the annotation key has to be unique among the resources of a container
+	hash := fnv.New32a()
+	hash.Write([]byte(resourceName))
+	cres.Annotations = map[string]string{
+		fmt.Sprintf("%s%s-%s_%08x", CDIAnnotationPrefix, cdiVendor(), CDIClass, hash.Sum32()): strings.Join(names, ","),
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildCDISpec(t *testing.T) {
+	u250 := func(bdf string, sn string) Device {
+		return Device{
+			DBDF:     bdf,
+			SN:       sn,
+			shellVer: "xilinx_u250_gen3x16_xdma_shell_4_1",
+			Nodes: &Pairs{
+				Mgmt: "/dev/xclmgmt" + bdf[5:7],
+				User: "/dev/dri/renderD" + bdf[5:7],
+			},
+		}
+	}
+	u30 := Device{
+		SN:       "XFL1U30A",
+		shellVer: "ama_u30",
+		Nodes: &Pairs{
+			User: "/dev/dri/renderD82",
+			Qdma: "/dev/xfpga/xdma82.0",
+		},
+	}
+	mgmtOnly := func(dev Device) Device {
+		dev.mgmtOnly = true
+		return dev
+	}
+	virtual := func(i string) Device {
+		device := u30
+		device.DBDF = "0000:82:00.1-" + i
+		return device
+	}
+
+	// the device nodes and env of each CDI device, the env is not checked
+	// if nil
+	type cdiDeviceEdits struct {
+		nodes []string
+		env   []string
+	}
+	tests := []struct {
+		name   string
+		devMap map[string]map[string]Device
+		want   map[string]cdiDeviceEdits
+	}{
+		{
+			name:   "no devices",
+			devMap: map[string]map[string]Device{},
+			want:   map[string]cdiDeviceEdits{},
+		},
+		{
+			name: "device without serial number",
+			devMap: map[string]map[string]Device{
+				"u250": {"0000:3b:00.1": u250("0000:3b:00.1", "")},
+			},
+			want: map[string]cdiDeviceEdits{
+				"0000:3b:00.1": {
+					nodes: []string{"/dev/xclmgmt3b", "/dev/dri/renderD3b"},
+					env: []string{
+						"AMD_FPGA_0000_3B_00_1_BDF=0000:3b:00.1",
+						"AMD_FPGA_0000_3B_00_1_SHELL=xilinx_u250_gen3x16_xdma_shell_4_1",
+						"AMD_FPGA_0000_3B_00_1_SN=",
+					},
+				},
+			},
+		},
+		{
+			name: "devices of a card",
+			devMap: map[string]map[string]Device{
+				"u250": {
+					"0000:3b:00.1": u250("0000:3b:00.1", "XFL1A"),
+					"0000:3c:00.1": u250("0000:3c:00.1", "XFL1A"),
+				},
+			},
+			want: map[string]cdiDeviceEdits{
+				"0000:3b:00.1": {nodes: []string{"/dev/xclmgmt3b", "/dev/dri/renderD3b"}},
+				"0000:3c:00.1": {nodes: []string{"/dev/xclmgmt3c", "/dev/dri/renderD3c"}},
+				"card-XFL1A": {
+					nodes: []string{"/dev/xclmgmt3b", "/dev/dri/renderD3b", "/dev/xclmgmt3c", "/dev/dri/renderD3c"},
+					env:   []string{"AMD_FPGA_CARD_XFL1A_BDF_0=0000:3b:00.1", "AMD_FPGA_CARD_XFL1A_BDF_1=0000:3c:00.1"},
+				},
+			},
+		},
+		{
+			name: "virtual devices share the nodes of the card",
+			devMap: map[string]map[string]Device{
+				"ama_u30": {"0000:82:00.1-0": virtual("0"), "0000:82:00.1-1": virtual("1")},
+			},
+			want: map[string]cdiDeviceEdits{
+				"0000:82:00.1-0": {nodes: []string{"/dev/dri/renderD82", "/dev/xfpga/xdma82.0"}},
+				"0000:82:00.1-1": {nodes: []string{"/dev/dri/renderD82", "/dev/xfpga/xdma82.0"}},
+				"card-XFL1U30A": {
+					nodes: []string{"/dev/dri/renderD82", "/dev/xfpga/xdma82.0"},
+					env:   []string{"AMD_FPGA_CARD_XFL1U30A_BDF_0=0000:82:00.1-0", "AMD_FPGA_CARD_XFL1U30A_BDF_1=0000:82:00.1-1"},
+				},
+			},
+		},
+		{
+			name: "no card for the AWS serial number",
+			devMap: map[string]map[string]Device{
+				"u250": {"0000:3b:00.1": u250("0000:3b:00.1", AWS_SN)},
+			},
+			want: map[string]cdiDeviceEdits{
+				"0000:3b:00.1": {nodes: []string{"/dev/xclmgmt3b", "/dev/dri/renderD3b"}},
+			},
+		},
+		{
+			name: "mgmt resource",
+			devMap: map[string]map[string]Device{
+				"u250-mgmt": {"0000:3b:00.1": mgmtOnly(u250("0000:3b:00.1", "XFL1A"))},
+			},
+			want: map[string]cdiDeviceEdits{
+				"0000:3b:00.1-mgmt": {nodes: []string{"/dev/xclmgmt3b"}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := buildCDISpec(test.devMap)
+			if spec.Kind != "amd.com/fpga" || spec.Version != CDIVersion {
+				t.Errorf("kind %s version %s, want amd.com/fpga %s", spec.Kind, spec.Version, CDIVersion)
+			}
+			got := make(map[string]cdiDeviceEdits)
+			for _, device := range spec.Devices {
+				edits := cdiDeviceEdits{env: device.ContainerEdits.Env}
+				for _, node := range device.ContainerEdits.DeviceNodes {
+					edits.nodes = append(edits.nodes, node.HostPath)
+				}
+				got[device.Name] = edits
+			}
+			for name, want := range test.want {
+				if want.env == nil {
+					want.env = got[name].env
+				}
+				test.want[name] = want
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteCDISpec(t *testing.T) {
+	c := defaultConfig()
+	c.CDISpecDir = t.TempDir() + "/cdi"
+	useConfig(t, c)
+	m := &FPGADevicePlugin{
+		devices: map[string]map[string]Device{
+			"u250": {"0000:3b:00.1": {DBDF: "0000:3b:00.1", Nodes: &Pairs{User: "/dev/dri/renderD128"}}},
+		},
+	}
+
+	c.CDIMode = CDIModeOff
+	if err := m.writeCDISpec(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(c.CDISpecDir); !os.IsNotExist(err) {
+		t.Fatalf("spec dir created with CDI off: %v", err)
+	}
+
+	c.CDIMode = CDIModeSpec
+	if err := m.writeCDISpec(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(cdiSpecFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `"kind": "amd.com/fpga"`) {
+		t.Errorf("unexpected spec %s", content)
+	}
+	files, _ := ioutil.ReadDir(c.CDISpecDir)
+	if len(files) != 1 {
+		t.Errorf("%d files in the spec dir, temporary files left behind", len(files))
+	}
+
+	// an unchanged spec isn't written again
+	os.Remove(cdiSpecFile())
+	if err := m.writeCDISpec(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cdiSpecFile()); !os.IsNotExist(err) {
+		t.Errorf("unchanged spec written again: %v", err)
+	}
+	m.devices["u250"]["0000:3c:00.1"] = Device{DBDF: "0000:3c:00.1", Nodes: &Pairs{User: "/dev/dri/renderD129"}}
+	if err := m.writeCDISpec(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cdiSpecFile()); err != nil {
+		t.Errorf("changed spec not written: %v", err)
+	}
+}
+
+func TestWriteCDISpecReload(t *testing.T) {
+	c := defaultConfig()
+	c.CDIMode, c.CDISpecDir = CDIModeSpec, t.TempDir()
+	useConfig(t, c)
+	m := &FPGADevicePlugin{
+		devices: map[string]map[string]Device{
+			"u280": {"0000:af:00.1": {DBDF: "0000:af:00.1", Nodes: &Pairs{Mgmt: "/dev/xclmgmt44800", User: "/dev/dri/renderD130"}}},
+		},
+	}
+	if err := m.writeCDISpec(); err != nil {
+		t.Fatal(err)
+	}
+	amd := cdiSpecFile()
+
+	// the spec of the previous domain is replaced, even though the devices
+	// didn't change
+	c.ResourceDomain = "fpga.example.com"
+	if err := m.writeCDISpec(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(amd); !os.IsNotExist(err) {
+		t.Errorf("spec %s of the previous domain left behind: %v", amd, err)
+	}
+	content, err := ioutil.ReadFile(cdiSpecFile())
+	if err != nil || !strings.Contains(string(content), `"kind": "fpga.example.com/fpga"`) {
+		t.Errorf("spec of the new domain %s, %v", content, err)
+	}
+
+	// turning CDI off removes the spec
+	c.CDIMode = CDIModeOff
+	if err := m.writeCDISpec(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(c.CDISpecDir); len(files) != 0 || m.cdiSpecPath != "" {
+		t.Errorf("%d spec files left with CDI off", len(files))
+	}
+}
+
+func TestSetCDIDevices(t *testing.T) {
+	user := new(pluginapi.ContainerAllocateResponse)
+	setCDIDevices(user, "amd.com/u250", false, []string{"0000:3b:00.1", "0000:3c:00.1"})
+	mgmt := new(pluginapi.ContainerAllocateResponse)
+	setCDIDevices(mgmt, "amd.com/u250"+MgmtResourceSuffix, true, []string{"0000:3b:00.1"})
+	legacy := new(pluginapi.ContainerAllocateResponse)
+	setCDIDevices(legacy, "xilinx.com/u250", false, []string{"0000:3d:00.1"})
+
+	names := []string{}
+	for _, device := range user.CDIDevices {
+		names = append(names, device.Name)
+	}
+	want := []string{"amd.com/fpga=0000:3b:00.1", "amd.com/fpga=0000:3c:00.1"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("CDI devices %v, want %v", names, want)
+	}
+	if len(mgmt.CDIDevices) != 1 || mgmt.CDIDevices[0].Name != "amd.com/fpga=0000:3b:00.1-mgmt" {
+		t.Errorf("mgmt CDI devices %v", mgmt.CDIDevices)
+	}
+	// a container may request both resources, their annotations must not clash
+	for key, value := range user.Annotations {
+		if !strings.HasPrefix(key, CDIAnnotationPrefix) || value != strings.Join(want, ",") {
+			t.Errorf("annotation %s=%s", key, value)
+		}
+		if _, ok := mgmt.Annotations[key]; ok {
+			t.Errorf("annotation %s used by both resources", key)
+		}
+		if _, ok := legacy.Annotations[key]; ok {
+			t.Errorf("annotation %s used by both domains", key)
+		}
+	}
+}
+
+func TestAllocateVirtualDevCDI(t *testing.T) {
+	useSynthetic(t, "cards:\n- shell: xilinx_u250_gen3x16_xdma_shell_4_1\n  count: 2\n", "", true)
+	devices, err := GetDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	devMap := map[string]map[string]Device{"u250": {}}
+	for _, device := range devices {
+		devMap["u250"][device.DBDF] = device
+	}
+	plugin := &FPGADevicePlugin{ctx: context.Background()}
+	server := plugin.NewFPGADevicePluginServer("u250", devMap["u250"], cfg().ResourceDomain)
+	allocate := func() *pluginapi.ContainerAllocateResponse {
+		t.Helper()
+		resp, err := server.Allocate(context.Background(), &pluginapi.AllocateRequest{
+			ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"0000:81:00.1-2"}}},
+		})
+		if err != nil || len(resp.ContainerResponses) != 1 {
+			t.Fatalf("got %v, %v", resp, err)
+		}
+		return resp.ContainerResponses[0]
+	}
+
+	// every device of the node is handed out, through its nodes
+	if cres := allocate(); len(cres.Devices) == 0 || len(cres.CDIDevices) != 0 {
+		t.Errorf("nodes %v and CDI devices %v out of the inject mode", cres.Devices, cres.CDIDevices)
+	}
+
+	// or through the CDI spec, once per device whatever its virtual devices
+	cfg().CDIMode = CDIModeInject
+	cres := allocate()
+	names := []string{}
+	for _, device := range cres.CDIDevices {
+		names = append(names, device.Name)
+	}
+	want := []string{"amd.com/fpga=0000:80:00.1-0", "amd.com/fpga=0000:81:00.1-0"}
+	if !reflect.DeepEqual(names, want) || len(cres.Devices) != 0 || len(cres.Mounts) != 0 {
+		t.Errorf("CDI devices %v, nodes %v and mounts %v, want %v only", names, cres.Devices, cres.Mounts, want)
+	}
+	described := make(map[string]bool)
+	for _, device := range buildCDISpec(devMap).Devices {
+		described[cdiQualifiedName(device.Name)] = true
+	}
+	for _, name := range names {
+		if !described[name] {
+			t.Errorf("%s is not described in the CDI spec", name)
+		}
+	}
+}
+
+func TestCDIKindFollowsResourceDomain(t *testing.T) {
+	c := defaultConfig()
+	c.ResourceDomain = "fpga.example.com"
+	useConfig(t, c)
+	if kind := cdiKind(); kind != "fpga.example.com/fpga" {
+		t.Errorf("kind %s", kind)
+	}
+	if name := cdiQualifiedName("0000:3b:00.1"); name != "fpga.example.com/fpga=0000:3b:00.1" {
+		t.Errorf("name %s", name)
+	}
+	if fname := path.Base(cdiSpecFile()); fname != "fpga.example.com-fpga.json" {
+		t.Errorf("spec file %s", fname)
+	}
+}
+
+func TestParseCDIMode(t *testing.T) {
+	for value, want := range map[string]string{
+		"off":      CDIModeOff,
+		" Spec ":   CDIModeSpec,
+		"INJECT":   CDIModeInject,
+		"":         "",
+		"injected": "",
+	} {
+		mode, err := parseCDIMode(value)
+		if mode != want || (err != nil) != (want == "") {
+			t.Errorf("parseCDIMode(%q) = %q, %v, want %q", value, mode, err, want)
+		}
+	}
+}
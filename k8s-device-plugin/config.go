@@ -0,0 +1,554 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// ConfigVersion is the version of the config file format
+const ConfigVersion = "v1"
+
+// ConfigEnvPrefix is the prefix of the environment variables overriding the
+// config, e.g. AMD_FPGA_VIRTUAL_NUM for virtualNum
+const ConfigEnvPrefix = "AMD_FPGA_"
+
+// Config is the configuration of the plugin. It is built from, in increasing
+// order of precedence:
+//
+//  1. the defaults
+//  2. the config file given by --config, YAML or JSON, with the overrides
+//     of the node, see NodeOverride
+//  3. the deprecated environment variables, e.g. VirtualNum, whose invalid
+//     values are ignored
+//  4. the AMD_FPGA_* environment variables, e.g. AMD_FPGA_VIRTUAL_NUM
+//  5. the command line flags, e.g. --virtual-num
+//
+// Otherwise unknown keys and invalid values are errors.
+type Config struct {
+	Version               string            `json:"version"`
+	LogLevel              string            `json:"logLevel"`
+	LogFormat             string            `json:"logFormat"`
+	ResourceDomain        string            `json:"resourceDomain"`
+	LegacyResourceDomain  string            `json:"legacyResourceDomain"`
+	U30NameConvention     string            `json:"u30NameConvention"`
+	U30AllocUnit          string            `json:"u30AllocUnit"`
+	DeviceNameCustomize   bool              `json:"deviceNameCustomize"`
+	NameCustomizeFile     string            `json:"nameCustomizeFile"`
+	VirtualDev            bool              `json:"virtualDev"`
+	VirtualNum            int               `json:"virtualNum"`
+	MgmtPolicy            string            `json:"mgmtPolicy"`
+	MgmtResourcePolicy    map[string]string `json:"mgmtResourcePolicy"`
+	MgmtPermissions       string            `json:"mgmtPermissions"`
+	UserPermissions       string            `json:"userPermissions"`
+	QdmaPermissions       string            `json:"qdmaPermissions"`
+	CDIMode               string            `json:"cdiMode"`
+	CDISpecDir            string            `json:"cdiSpecDir"`
+	ResetMode             string            `json:"resetMode"`
+	ResetCommand          string            `json:"resetCommand"`
+	ResetTimeout          int               `json:"resetTimeout"`
+	XclbinPreloadFile     string            `json:"xclbinPreloadFile"`
+	XclbinCacheDir        string            `json:"xclbinCacheDir"`
+	XclbinLoadCommand     string            `json:"xclbinLoadCommand"`
+	XclbinLoadTimeout     int               `json:"xclbinLoadTimeout"`
+	AggregateResourceFile string            `json:"aggregateResourceFile"`
+	ShellFamilyFile       string            `json:"shellFamilyFile"`
+	SyntheticSpecFile     string            `json:"syntheticSpecFile"`
+	SyntheticDevDir       string            `json:"syntheticDevDir"`
+	SyntheticControlFile  string            `json:"syntheticControlFile"`
+	MetricsAddress        string            `json:"metricsAddress"`
+	Telemetry             bool              `json:"telemetry"`
+	TelemetryInterval     int               `json:"telemetryInterval"`
+	AuditLogFile          string            `json:"auditLogFile"`
+	AuditLogMaxSize       int               `json:"auditLogMaxSize"`
+	AuditLogMaxFiles      int               `json:"auditLogMaxFiles"`
+	PodResources          bool              `json:"podResources"`
+	PodResourcesInterval  int               `json:"podResourcesInterval"`
+	UsageStateFile        string            `json:"usageStateFile"`
+	UsageReportFile       string            `json:"usageReportFile"`
+	UsageReportInterval   int               `json:"usageReportInterval"`
+	// Nodes are the per node overrides, they are merged into the config of
+	// the node and are not part of the effective config
+	Nodes []*NodeOverride `json:"nodes,omitempty"`
+}
+
+// configOption describes a config key, the deprecated environment variable
+// it replaces, if any, and its usage
+type configOption struct {
+	key    string
+	legacy string
+	usage  string
+}
+
+var configOptions = []configOption{
+	{"logLevel", "", "Define the logging level: panic, fatal, error, warning, info, debug or trace."},
+	{"logFormat", "", "Define the logging format: text or json."},
+	{"resourceDomain", "ResourceDomain", "Domain of the resource names."},
+	{"legacyResourceDomain", "LegacyResourceDomain", "Domain the resources are registered under as well, e.g. xilinx.com."},
+	{"u30NameConvention", "U30NameConvention", "Name of the U30 resources: CommonName or ExactName."},
+	{"u30AllocUnit", "U30AllocUnit", "Allocation unit of the shell families allocated by card: Card or Device."},
+	{"deviceNameCustomize", "DeviceNameCustomize", "Name the resources by the rules of the name customization file."},
+	{"nameCustomizeFile", "", "Name customization file."},
+	{"virtualDev", "VirtualDev", "Share every device of the node with VirtualNum containers."},
+	{"virtualNum", "VirtualNum", "Number of containers sharing a device in virtual device mode."},
+	{"mgmtPolicy", "MgmtPolicy", "Mgmt PF policy: ReadWrite, ReadOnly, Omit or Dedicated."},
+	{"mgmtResourcePolicy", "MgmtResourcePolicy", "Mgmt PF policy per resource, resource=policy pairs separated by commas."},
+	{"mgmtPermissions", "MgmtPermissions", "Device cgroup permissions of the mgmt PF node."},
+	{"userPermissions", "UserPermissions", "Device cgroup permissions of the user PF node."},
+	{"qdmaPermissions", "QdmaPermissions", "Device cgroup permissions of the qdma node."},
+	{"cdiMode", "CDIMode", "CDI mode: Off, Spec or Inject."},
+	{"cdiSpecDir", "CDISpecDir", "Directory of the CDI spec file."},
+	{"resetMode", "ResetMode", "Reset of the allocated cards: Off, Mgmt or Command."},
+	{"resetCommand", "ResetCommand", "Reset command of the Command reset mode."},
+	{"resetTimeout", "ResetTimeout", "Seconds to wait for a card reset."},
+	{"xclbinPreloadFile", "XclbinPreloadFile", "Resource to xclbin bindings."},
+	{"xclbinCacheDir", "XclbinCacheDir", "Node-local xclbin cache."},
+	{"xclbinLoadCommand", "XclbinLoadCommand", "Xclbin loader command."},
+	{"xclbinLoadTimeout", "XclbinLoadTimeout", "Seconds to wait for the xclbin loader command."},
+	{"aggregateResourceFile", "AggregateResourceFile", "Aggregate resource file."},
+	{"shellFamilyFile", "ShellFamilyFile", "Shell family file."},
+	{"syntheticSpecFile", "", "Synthetic card file, the devices are fabricated from it rather than discovered."},
+	{"syntheticDevDir", "", "Directory of the stand-in device nodes of the synthetic devices."},
+	{"syntheticControlFile", "", "Fault script of the synthetic devices."},
+	{"metricsAddress", "", "Address the Prometheus metrics are served on, e.g. :9400, off if empty."},
+	{"telemetry", "", "Export the sensor readings of the cards with the metrics."},
+	{"auditLogFile", "", "Allocation audit log, JSON lines, off if empty."},
+	{"auditLogMaxSize", "", "Size in MiB the audit log is rotated at."},
+	{"auditLogMaxFiles", "", "Number of rotated audit logs kept."},
+	{"telemetryInterval", "", "Seconds the sensor readings are cached for."},
+	{"podResources", "", "Track the pods holding each device through the kubelet PodResources API."},
+	{"podResourcesInterval", "", "Seconds between two listings of the kubelet pod resources."},
+	{"usageStateFile", "", "File the usage totals of the pods are kept in across restarts, in memory only if empty."},
+	{"usageReportFile", "", "Periodic usage report of the pods, JSON, off if empty."},
+	{"usageReportInterval", "", "Seconds between two usage reports."},
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Version:               ConfigVersion,
+		LogLevel:              "info",
+		LogFormat:             LogFormatText,
+		ResourceDomain:        "amd.com",
+		U30NameConvention:     "CommonName",
+		U30AllocUnit:          "Card",
+		NameCustomizeFile:     "/opt/xilinx/device-plugin-configmap/NameCustomize.json",
+		VirtualNum:            1,
+		MgmtPolicy:            MgmtPolicyReadWrite,
+		MgmtResourcePolicy:    make(map[string]string),
+		MgmtPermissions:       "rwm",
+		UserPermissions:       "rwm",
+		QdmaPermissions:       "rwm",
+		CDIMode:               CDIModeOff,
+		CDISpecDir:            "/var/run/cdi",
+		ResetMode:             ResetModeOff,
+		ResetTimeout:          120,
+		XclbinPreloadFile:     "/opt/xilinx/device-plugin-configmap/XclbinPreload.json",
+		XclbinCacheDir:        "/opt/xilinx/xclbin-cache",
+		XclbinLoadCommand:     "xbutil program -d {BDF} -u {XCLBIN}",
+		XclbinLoadTimeout:     300,
+		AggregateResourceFile: "/opt/xilinx/device-plugin-configmap/AggregateResources.json",
+		ShellFamilyFile:       "/opt/xilinx/device-plugin-configmap/ShellFamilies.json",
+		SyntheticDevDir:       "/var/run/amd-fpga-synthetic",
+		Telemetry:             true,
+		TelemetryInterval:     10,
+		AuditLogMaxSize:       10,
+		AuditLogMaxFiles:      5,
+		PodResources:          true,
+		PodResourcesInterval:  10,
+		UsageReportInterval:   3600,
+	}
+}
+
+// flagName turns a config key into its flag name, e.g. virtualNum into
+// virtual-num
+func flagName(key string) string {
+	name := ""
+	for i, r := range key {
+		if unicode.IsUpper(r) {
+			if i > 0 && !unicode.IsUpper(rune(key[i-1])) {
+				name += "-"
+			}
+			r = unicode.ToLower(r)
+		}
+		name += string(r)
+	}
+	return name
+}
+
+// envName turns a config key into its environment variable, e.g. virtualNum
+// into AMD_FPGA_VIRTUAL_NUM
+func envName(key string) string {
+	return ConfigEnvPrefix + strings.ToUpper(strings.Replace(flagName(key), "-", "_", -1))
+}
+
+// configField returns the field of the config with the given json key
+func (c *Config) configField(key string) reflect.Value {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0] == key {
+			return v.Field(i)
+		}
+	}
+	panic("unknown config key " + key)
+}
+
+// set parses the value of a config key given as a string, by an environment
+// variable or a flag
+func (c *Config) set(key string, value string) error {
+	field := c.configField(key)
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid %s %q, expect true or false", key, value)
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid %s %q, expect an integer", key, value)
+		}
+		field.SetInt(int64(n))
+	case reflect.Map:
+		pairs, err := parsePairs(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+		field.Set(reflect.ValueOf(pairs))
+	}
+	return nil
+}
+
+// setLegacy sets a config key from its deprecated environment variable. An
+// invalid value is ignored with a warning, as the plugin always did, so the
+// existing manifests keep working.
+func (c *Config) setLegacy(option configOption, value string) {
+	candidate := *c
+	err := candidate.set(option.key, value)
+	if base := *c; err == nil && base.validate() == nil {
+		err = candidate.validate()
+	}
+	if err != nil {
+		configLog.Warnf("Ignored environment variable %s, %s stays %v: %v", option.legacy, option.key, c.configField(option.key).Interface(), err)
+		return
+	}
+	c.set(option.key, value)
+}
+
+// parsePairs parses a comma separated list of key=value pairs
+func parsePairs(value string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid pair %q, expect key=value", item)
+		}
+		pairs[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return pairs, nil
+}
+
+// parseConfig decodes a YAML or JSON config over the given config, the keys
+// missing in the content keep their values
+func parseConfig(content []byte, config *Config) error {
+	content, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return err
+	}
+	var version struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(content, &version); err != nil {
+		return err
+	}
+	if version.Version != ConfigVersion {
+		return fmt.Errorf("unsupported version %q, expect %s", version.Version, ConfigVersion)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(config)
+}
+
+// registerConfigFlags adds a flag for every config key
+func registerConfigFlags(flags *flag.FlagSet) {
+	for _, option := range configOptions {
+		usage := option.usage + " Environment variable " + envName(option.key) + "."
+		flags.String(flagName(option.key), "", usage)
+	}
+}
+
+// loadConfig builds the config of the node from the config file, the
+// environment and the flags set on the command line, then validates it
+func loadConfig(fname string, flags *flag.FlagSet) (*Config, error) {
+	config := defaultConfig()
+	if fname != "" {
+		content, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		if err := parseConfig(content, config); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", fname, err)
+		}
+		node, err := getNodeInfo()
+		if err != nil {
+			return nil, fmt.Errorf("can't get the node labels: %v", err)
+		}
+		applied, err := config.applyNodeOverrides(node)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", fname, err)
+		}
+		for _, override := range applied {
+			configLog.WithField("node", node.Name).Printf("Applied config override %s", override)
+		}
+	}
+	for _, option := range configOptions {
+		if option.legacy == "" {
+			continue
+		}
+		if value, ok := os.LookupEnv(option.legacy); ok && value != "" {
+			configLog.Warnf("Environment variable %s is deprecated, please use %s or %s in the config file", option.legacy, envName(option.key), option.key)
+			config.setLegacy(option, value)
+		}
+	}
+	for _, option := range configOptions {
+		if value, ok := os.LookupEnv(envName(option.key)); ok {
+			if err := config.set(option.key, value); err != nil {
+				return nil, fmt.Errorf("environment variable %s: %v", envName(option.key), err)
+			}
+		}
+	}
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		for _, option := range configOptions {
+			if err == nil && f.Name == flagName(option.key) {
+				if e := config.set(option.key, f.Value.String()); e != nil {
+					err = fmt.Errorf("flag --%s: %v", f.Name, e)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// parseChoice returns the choice equal to the value ignoring case
+func parseChoice(key string, value string, choices ...string) (string, error) {
+	for _, choice := range choices {
+		if strings.EqualFold(strings.TrimSpace(value), choice) {
+			return choice, nil
+		}
+	}
+	return "", fmt.Errorf("invalid %s %q, expect one of %s", key, value, strings.Join(choices, ", "))
+}
+
+// validate checks the values of the config, the enumerations are normalized
+// to their canonical case
+func (c *Config) validate() error {
+	var err error
+	if c.LogLevel, err = parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.LogFormat, err = parseChoice("logFormat", c.LogFormat, LogFormatText, LogFormatJSON); err != nil {
+		return err
+	}
+	if err := validateResourceDomain(c.ResourceDomain); err != nil {
+		return fmt.Errorf("invalid resourceDomain: %v", err)
+	}
+	if c.LegacyResourceDomain != "" {
+		if err := validateResourceDomain(c.LegacyResourceDomain); err != nil {
+			return fmt.Errorf("invalid legacyResourceDomain: %v", err)
+		}
+		if c.LegacyResourceDomain == c.ResourceDomain {
+			return fmt.Errorf("legacyResourceDomain is the same as resourceDomain")
+		}
+		// the devices taken through one domain are only released when the
+		// pod resources report them free
+		if !c.PodResources {
+			return fmt.Errorf("legacyResourceDomain requires podResources")
+		}
+	}
+	if c.U30NameConvention, err = parseChoice("u30NameConvention", c.U30NameConvention, "CommonName", "ExactName"); err != nil {
+		return err
+	}
+	if c.U30AllocUnit, err = parseChoice("u30AllocUnit", c.U30AllocUnit, "Card", "Device"); err != nil {
+		return err
+	}
+	if c.DeviceNameCustomize && c.NameCustomizeFile == "" {
+		return fmt.Errorf("deviceNameCustomize is set but nameCustomizeFile is empty")
+	}
+	if c.VirtualNum < 1 {
+		return fmt.Errorf("invalid virtualNum %d, expect at least 1", c.VirtualNum)
+	}
+	if c.MgmtPolicy, err = parseMgmtPolicy(c.MgmtPolicy); err != nil {
+		return err
+	}
+	policies := make(map[string]string)
+	for resource, value := range c.MgmtResourcePolicy {
+		policy, err := parseMgmtPolicy(value)
+		if err != nil {
+			return fmt.Errorf("invalid mgmtResourcePolicy of %s: %v", resource, err)
+		}
+		policies[trimResourceDomain(resource)] = policy
+	}
+	c.MgmtResourcePolicy = policies
+	for key, perm := range map[string]string{
+		"mgmtPermissions": c.MgmtPermissions,
+		"userPermissions": c.UserPermissions,
+		"qdmaPermissions": c.QdmaPermissions,
+	} {
+		if !isValidPermissions(perm) {
+			return fmt.Errorf("invalid %s %q, expect a combination of r, w and m", key, perm)
+		}
+	}
+	if c.CDIMode, err = parseCDIMode(c.CDIMode); err != nil {
+		return err
+	}
+	if c.CDIMode != CDIModeOff && c.CDISpecDir == "" {
+		return fmt.Errorf("cdiMode is %s but cdiSpecDir is empty", c.CDIMode)
+	}
+	if c.ResetMode, err = parseResetMode(c.ResetMode); err != nil {
+		return err
+	}
+	if c.ResetMode == ResetModeCommand && strings.TrimSpace(c.ResetCommand) == "" {
+		return fmt.Errorf("resetMode is %s but resetCommand is empty", ResetModeCommand)
+	}
+	if c.ResetTimeout < 1 {
+		return fmt.Errorf("invalid resetTimeout %d, expect at least 1", c.ResetTimeout)
+	}
+	if strings.TrimSpace(c.XclbinLoadCommand) == "" {
+		return fmt.Errorf("xclbinLoadCommand is empty")
+	}
+	if c.XclbinLoadTimeout < 1 {
+		return fmt.Errorf("invalid xclbinLoadTimeout %d, expect at least 1", c.XclbinLoadTimeout)
+	}
+	if c.TelemetryInterval < 1 {
+		return fmt.Errorf("invalid telemetryInterval %d, expect at least 1", c.TelemetryInterval)
+	}
+	if c.AuditLogMaxSize < 1 {
+		return fmt.Errorf("invalid auditLogMaxSize %d, expect at least 1", c.AuditLogMaxSize)
+	}
+	if c.AuditLogMaxFiles < 1 {
+		return fmt.Errorf("invalid auditLogMaxFiles %d, expect at least 1", c.AuditLogMaxFiles)
+	}
+	if c.PodResourcesInterval < 1 {
+		return fmt.Errorf("invalid podResourcesInterval %d, expect at least 1", c.PodResourcesInterval)
+	}
+	if c.UsageReportInterval < 1 {
+		return fmt.Errorf("invalid usageReportInterval %d, expect at least 1", c.UsageReportInterval)
+	}
+	if c.SyntheticSpecFile != "" {
+		if c.SyntheticDevDir == "" {
+			return fmt.Errorf("syntheticSpecFile is set but syntheticDevDir is empty")
+		}
+		if c.ResetMode != ResetModeOff {
+			return fmt.Errorf("synthetic devices can't be reset, resetMode must be %s", ResetModeOff)
+		}
+	}
+	return nil
+}
+
+// RuntimeConfig is the config in force with the content of the files it
+// names. A reload builds a new one and swaps it as a whole, so the device
+// scan, the kubelet calls and the metrics read a consistent config while the
+// main loop reloads it on SIGHUP.
+type RuntimeConfig struct {
+	*Config
+	ShellFamilies      []*ShellFamily
+	XclbinPreloads     map[string]*XclbinPreload
+	AggregateResources []*AggregateResource
+}
+
+var runtimeConfig atomic.Value
+
+func init() {
+	c := defaultConfig()
+	runtimeConfig.Store(&RuntimeConfig{
+		Config:         c,
+		ShellFamilies:  builtinShellFamilies(c),
+		XclbinPreloads: make(map[string]*XclbinPreload),
+	})
+}
+
+// cfg returns the config in force, it must not be modified
+func cfg() *RuntimeConfig {
+	return runtimeConfig.Load().(*RuntimeConfig)
+}
+
+// applyConfig sets the log level and format of the config, then loads the
+// files it names and puts it in force. It returns the errors of the ignored
+// config files.
+func applyConfig(c *Config) []error {
+	level, _ := log.ParseLevel(c.LogLevel)
+	log.SetLevel(level)
+	setLogFormat(c.LogFormat)
+	rc, errs := loadConfigFiles(c)
+	runtimeConfig.Store(rc)
+	return errs
+}
+
+// printConfig prints the effective config in YAML
+func printConfig(c *Config) error {
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(content)
+	return err
+}
+
+// logConfig logs the effective config, one key per line in sorted order
+func logConfig(c *Config) {
+	content, err := json.Marshal(c)
+	if err != nil {
+		return
+	}
+	var values map[string]interface{}
+	json.Unmarshal(content, &values)
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		configLog.Printf("Set %s: %v", key, values[key])
+	}
+}
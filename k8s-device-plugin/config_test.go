@@ -0,0 +1,244 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// useConfig puts the config in force for the test, with the builtin shell
+// families and the aggregate resources, and restores the previous one after
+func useConfig(t *testing.T, c *Config, aggregates ...*AggregateResource) {
+	t.Helper()
+	previous := cfg()
+	runtimeConfig.Store(&RuntimeConfig{
+		Config:             c,
+		ShellFamilies:      builtinShellFamilies(c),
+		XclbinPreloads:     make(map[string]*XclbinPreload),
+		AggregateResources: aggregates,
+	})
+	t.Cleanup(func() {
+		runtimeConfig.Store(previous)
+	})
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		// file is the content of the config file, none if empty
+		file string
+		env  map[string]string
+		args []string
+		// want are the expected values by config key
+		want map[string]string
+		err  string
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{"virtualNum": "1", "resourceDomain": "amd.com", "u30AllocUnit": "Card", "mgmtPolicy": "ReadWrite"},
+		},
+		{
+			name: "file over defaults",
+			file: "version: v1\nvirtualNum: 4\nmgmtPolicy: readonly\n",
+			want: map[string]string{"virtualNum": "4", "resourceDomain": "amd.com", "mgmtPolicy": "ReadOnly"},
+		},
+		{
+			name: "json file",
+			file: `{"version": "v1", "virtualDev": true, "mgmtResourcePolicy": {"u250": "Omit"}}`,
+			want: map[string]string{"virtualDev": "true", "mgmtResourcePolicy": "map[u250:Omit]"},
+		},
+		{
+			name: "legacy environment over file",
+			file: "version: v1\nvirtualNum: 4\n",
+			env:  map[string]string{"VirtualNum": "6"},
+			want: map[string]string{"virtualNum": "6"},
+		},
+		{
+			name: "environment over legacy environment",
+			file: "version: v1\nvirtualNum: 4\n",
+			env:  map[string]string{"VirtualNum": "6", "AMD_FPGA_VIRTUAL_NUM": "7"},
+			want: map[string]string{"virtualNum": "7"},
+		},
+		{
+			name: "flags over environment",
+			file: "version: v1\nvirtualNum: 4\n",
+			env:  map[string]string{"VirtualNum": "6", "AMD_FPGA_VIRTUAL_NUM": "7"},
+			args: []string{"--virtual-num", "8"},
+			want: map[string]string{"virtualNum": "8"},
+		},
+		{
+			name: "every source sets its own key",
+			file: "version: v1\nresourceDomain: example.com\n",
+			env:  map[string]string{"U30AllocUnit": "device", "AMD_FPGA_MGMT_POLICY": "Omit"},
+			args: []string{"--cdi-mode", "spec"},
+			want: map[string]string{"resourceDomain": "example.com", "u30AllocUnit": "Device", "mgmtPolicy": "Omit", "cdiMode": "Spec"},
+		},
+		{
+			name: "empty environment variables are ignored",
+			file: "version: v1\nvirtualNum: 4\n",
+			env:  map[string]string{"VirtualNum": ""},
+			want: map[string]string{"virtualNum": "4"},
+		},
+		{
+			name: "empty map from the environment",
+			file: "version: v1\nmgmtResourcePolicy: {u250: Omit}\n",
+			env:  map[string]string{"AMD_FPGA_MGMT_RESOURCE_POLICY": " , "},
+			want: map[string]string{"mgmtResourcePolicy": "map[]"},
+		},
+		{
+			name: "node override over file, below legacy environment",
+			file: "version: v1\nvirtualNum: 4\nvirtualDev: false\nnodes:\n- name: fpga-*\n  config: {virtualNum: 5, virtualDev: true}\n",
+			env:  map[string]string{"NODE_NAME": "fpga-1", "VirtualNum": "6"},
+			want: map[string]string{"virtualNum": "6", "virtualDev": "true"},
+		},
+		{
+			name: "invalid legacy environment is ignored",
+			file: "version: v1\nvirtualNum: 4\nmgmtPolicy: Omit\n",
+			env:  map[string]string{"VirtualNum": "x", "MgmtPolicy": "Never", "U30AllocUnit": "device"},
+			want: map[string]string{"virtualNum": "4", "mgmtPolicy": "Omit", "u30AllocUnit": "Device"},
+		},
+		{
+			name: "legacy environment failing validation is ignored",
+			env:  map[string]string{"VirtualNum": "0", "MgmtResourcePolicy": "u250=Omit,u280=Shared"},
+			want: map[string]string{"virtualNum": "1", "mgmtResourcePolicy": "map[]"},
+		},
+		{
+			name: "invalid environment",
+			env:  map[string]string{"AMD_FPGA_VIRTUAL_NUM": "x"},
+			err:  "environment variable AMD_FPGA_VIRTUAL_NUM",
+		},
+		{
+			name: "invalid flag",
+			args: []string{"--virtual-dev", "maybe"},
+			err:  "flag --virtual-dev",
+		},
+		{
+			name: "invalid value from a flag",
+			args: []string{"--mgmt-policy", "Never"},
+			err:  `invalid mgmt policy "Never"`,
+		},
+		{
+			name: "unknown key in the file",
+			file: "version: v1\nvirtualNumber: 4\n",
+			err:  "unknown field",
+		},
+		{
+			name: "unsupported version",
+			file: "version: v2\n",
+			err:  "unsupported version",
+		},
+		{
+			name: "no version",
+			file: "virtualNum: 4\n",
+			err:  "unsupported version",
+		},
+		{
+			name: "invalid pair",
+			args: []string{"--mgmt-resource-policy", "u250=Omit,u280"},
+			err:  `invalid pair "u280"`,
+		},
+		{
+			name: "resource policies without the resource domain",
+			env:  map[string]string{"MgmtResourcePolicy": "amd.com/u250=omit, ama_u30 = ReadOnly"},
+			want: map[string]string{"mgmtResourcePolicy": "map[ama_u30:ReadOnly u250:Omit]"},
+		},
+		{
+			name: "invalid resource policy",
+			file: "version: v1\nmgmtResourcePolicy: {u250: Omit, u280: Shared}\n",
+			err:  "invalid mgmtResourcePolicy of u280",
+		},
+		{
+			name: "no rotated audit log",
+			file: "version: v1\nauditLogFile: /var/log/audit.log\nauditLogMaxFiles: 0\n",
+			err:  "invalid auditLogMaxFiles 0",
+		},
+		{
+			name: "value of the wrong type in the file",
+			file: "version: v1\nvirtualNum: four\n",
+			err:  "invalid config file",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// unset the config variables of the environment the test
+			// runs in, they are restored after the test
+			for _, option := range configOptions {
+				for _, name := range []string{option.legacy, envName(option.key)} {
+					if _, ok := os.LookupEnv(name); ok && name != "" {
+						t.Setenv(name, "")
+						os.Unsetenv(name)
+					}
+				}
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			fname := ""
+			if test.file != "" {
+				fname = path.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(fname, []byte(test.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			registerConfigFlags(flags)
+			if err := flags.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+			config, err := loadConfig(fname, flags)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range test.want {
+				if got := fmt.Sprint(config.configField(key).Interface()); got != want {
+					t.Errorf("%s is %s, want %s", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigNames(t *testing.T) {
+	for key, want := range map[string][2]string{
+		"virtualNum":         {"virtual-num", "AMD_FPGA_VIRTUAL_NUM"},
+		"cdiSpecDir":         {"cdi-spec-dir", "AMD_FPGA_CDI_SPEC_DIR"},
+		"u30AllocUnit":       {"u30-alloc-unit", "AMD_FPGA_U30_ALLOC_UNIT"},
+		"mgmtResourcePolicy": {"mgmt-resource-policy", "AMD_FPGA_MGMT_RESOURCE_POLICY"},
+		"logLevel":           {"log-level", "AMD_FPGA_LOG_LEVEL"},
+	} {
+		if flag, env := flagName(key), envName(key); flag != want[0] || env != want[1] {
+			t.Errorf("%s: got %s %s, want %s %s", key, flag, env, want[0], want[1])
+		}
+	}
+	// every key has a field, configField panics otherwise
+	c := defaultConfig()
+	for _, option := range configOptions {
+		c.configField(option.key)
+	}
+}
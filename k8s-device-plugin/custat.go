@@ -0,0 +1,110 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The files the xocl driver publishes the compute unit statistics in, under
+// the user PF
+const (
+	CUStatFile   = "kds_custat_raw"
+	CUStatLegacy = "kds_custat"
+)
+
+// cuStat is the statistics of a compute unit
+type cuStat struct {
+	kernel string
+	name   string
+	// address is the base address of the compute unit
+	address string
+	status  uint64
+	usage   uint64
+}
+
+// cuStatLegacy matches a line of the legacy statistics, e.g.
+// CU[@0x1800000] : 12 status : 4
+var cuStatLegacy = regexp.MustCompile(`^CU\[@(0x[0-9a-fA-F]+)\]\s*:\s*([0-9]+)\s+status\s*:\s*([0-9]+)`)
+
+// parseCUStats parses the compute unit statistics, one compute unit per
+// line: "index,kernel:cu,address,status,usage", or the legacy
+// "CU[@address] : usage status : status". Malformed lines are skipped.
+func parseCUStats(content string) []cuStat {
+	stats := []cuStat{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if match := cuStatLegacy.FindStringSubmatch(line); match != nil {
+			usage, _ := strconv.ParseUint(match[2], 10, 64)
+			status, _ := strconv.ParseUint(match[3], 10, 64)
+			stats = append(stats, cuStat{name: match[1], address: match[1], status: status, usage: usage})
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 5 {
+			continue
+		}
+		status, err := strconv.ParseUint(fields[3], 0, 64)
+		if err != nil {
+			continue
+		}
+		usage, err := strconv.ParseUint(fields[4], 0, 64)
+		if err != nil {
+			continue
+		}
+		stat := cuStat{name: fields[1], address: fields[2], status: status, usage: usage}
+		if parts := strings.SplitN(fields[1], ":", 2); len(parts) == 2 {
+			stat.kernel, stat.name = parts[0], parts[1]
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// readCUStats reads the compute unit statistics of a device and the UUID of
+// its xclbin. Devices without xclbin or statistics, e.g. AMA and synthetic
+// devices, have none.
+func readCUStats(device Device) []cardReading {
+	readings := []cardReading{}
+	if cfg().SyntheticSpecFile != "" {
+		return readings
+	}
+	dir := path.Join(SysfsDevices, GetPciBDF(device.DBDF))
+	uuid, err := GetFileContent(path.Join(dir, XclbinUUIDFile))
+	uuid = strings.TrimSpace(uuid)
+	if err != nil || uuid == "" {
+		return readings
+	}
+	readings = append(readings, cardReading{metric: metricXclbin, labels: []string{"xclbin", uuid}, value: 1})
+	content, err := GetFileContent(path.Join(dir, CUStatFile))
+	if err != nil {
+		if content, err = GetFileContent(path.Join(dir, CUStatLegacy)); err != nil {
+			return readings
+		}
+	}
+	for _, stat := range parseCUStats(content) {
+		labels := []string{"xclbin", uuid, "kernel", stat.kernel, "cu", stat.name, "address", stat.address}
+		readings = append(readings,
+			cardReading{metric: metricCUUsage, labels: labels, value: float64(stat.usage)},
+			cardReading{metric: metricCUStatus, labels: labels, value: float64(stat.status)})
+	}
+	return readings
+}
@@ -0,0 +1,183 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCUStats(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []cuStat
+	}{
+		{
+			name:    "raw format",
+			content: "0,vadd:vadd_1,0x1800000,0x4,1024\n1,vadd:vadd_2,0x1810000,0x1,0\n",
+			want: []cuStat{
+				{kernel: "vadd", name: "vadd_1", address: "0x1800000", status: 4, usage: 1024},
+				{kernel: "vadd", name: "vadd_2", address: "0x1810000", status: 1, usage: 0},
+			},
+		},
+		{
+			name:    "raw format with decimal values and without kernel",
+			content: "0,krnl_1,0x1800000,4,17",
+			want:    []cuStat{{name: "krnl_1", address: "0x1800000", status: 4, usage: 17}},
+		},
+		{
+			name:    "legacy format",
+			content: "CU[@0x1800000] : 12 status : 4\nCU[@0x1810000] : 0 status : 1\n",
+			want: []cuStat{
+				{name: "0x1800000", address: "0x1800000", status: 4, usage: 12},
+				{name: "0x1810000", address: "0x1810000", status: 1, usage: 0},
+			},
+		},
+		{
+			name:    "legacy format without spaces",
+			content: "  CU[@0xA0000]:7 status:2  ",
+			want:    []cuStat{{name: "0xA0000", address: "0xA0000", status: 2, usage: 7}},
+		},
+		{
+			name: "malformed lines are skipped",
+			content: "header line\n" +
+				"0,vadd:vadd_1,0x1800000,0x4\n" +
+				"0,vadd:vadd_1,0x1800000,busy,1\n" +
+				"0,vadd:vadd_1,0x1800000,0x4,-1\n" +
+				"CU[@0x1800000] : many status : 4\n" +
+				"\n" +
+				"2,mmult:mmult_1,0x1820000,0x4,99\n",
+			want: []cuStat{{kernel: "mmult", name: "mmult_1", address: "0x1820000", status: 4, usage: 99}},
+		},
+		{
+			name:    "kernel of several colons keeps the rest in the name",
+			content: "0,ns:krnl:cu_1,0x1800000,0x4,1",
+			want:    []cuStat{{kernel: "ns", name: "krnl:cu_1", address: "0x1800000", status: 4, usage: 1}},
+		},
+		{
+			name:    "windows line endings",
+			content: "0,vadd:vadd_1,0x1800000,0x4,5\r\nCU[@0x1810000] : 3 status : 1\r\n",
+			want: []cuStat{
+				{kernel: "vadd", name: "vadd_1", address: "0x1800000", status: 4, usage: 5},
+				{name: "0x1810000", address: "0x1810000", status: 1, usage: 3},
+			},
+		},
+		{
+			name:    "usage beyond 64 bits",
+			content: "0,vadd:vadd_1,0x1800000,0x4,18446744073709551616",
+			want:    []cuStat{},
+		},
+		{
+			name: "empty",
+			want: []cuStat{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseCUStats(test.content); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadCUStats(t *testing.T) {
+	useConfig(t, defaultConfig())
+	defer func(sysfs string) { SysfsDevices = sysfs }(SysfsDevices)
+	SysfsDevices = t.TempDir()
+	uuid := "5a4ee9bb-12ba-4d6a-8a47-b4d6e7c5a8f1"
+	writeFiles(t, SysfsDevices, map[string]string{
+		// raw statistics are preferred over the legacy ones
+		"0000:3b:00.1/" + XclbinUUIDFile: uuid + "\n",
+		"0000:3b:00.1/" + CUStatFile:     "0,vadd:vadd_1,0x1800000,0x4,10\n",
+		"0000:3b:00.1/" + CUStatLegacy:   "CU[@0x1800000] : 99 status : 1\n",
+		// older drivers have the legacy statistics only
+		"0000:3c:00.1/" + XclbinUUIDFile: uuid,
+		"0000:3c:00.1/" + CUStatLegacy:   "CU[@0x1800000] : 7 status : 1\n",
+		// xclbin without statistics
+		"0000:3d:00.1/" + XclbinUUIDFile: uuid,
+		// no xclbin loaded
+		"0000:3e:00.1/" + XclbinUUIDFile: "\n",
+		"0000:3e:00.1/" + CUStatFile:     "0,vadd:vadd_1,0x1800000,0x4,10\n",
+	})
+	xclbin := metricXclbin + "{xclbin=" + uuid + "}"
+	cu := "{xclbin=" + strings.Join([]string{uuid, "kernel", "vadd", "cu", "vadd_1", "address", "0x1800000"}, "=") + "}"
+	legacy := "{xclbin=" + strings.Join([]string{uuid, "kernel", "", "cu", "0x1800000", "address", "0x1800000"}, "=") + "}"
+	tests := []struct {
+		dbdf string
+		want map[string]float64
+	}{
+		{"0000:3b:00.1-0", map[string]float64{xclbin: 1, metricCUUsage + cu: 10, metricCUStatus + cu: 4}},
+		{"0000:3c:00.1", map[string]float64{xclbin: 1, metricCUUsage + legacy: 7, metricCUStatus + legacy: 1}},
+		{"0000:3d:00.1", map[string]float64{xclbin: 1}},
+		{"0000:3e:00.1", map[string]float64{}},
+		{"0000:3f:00.1", map[string]float64{}},
+	}
+	for _, test := range tests {
+		t.Run(test.dbdf, func(t *testing.T) {
+			checkReadings(t, readCUStats(Device{DBDF: test.dbdf}), test.want)
+		})
+	}
+
+	// synthetic devices have no xclbin, whatever the sysfs tree has
+	c := defaultConfig()
+	c.ResetMode = ResetModeOff
+	c.SyntheticSpecFile = "cards.yaml"
+	useConfig(t, c)
+	if readings := readCUStats(Device{DBDF: "0000:3b:00.1"}); len(readings) != 0 {
+		t.Errorf("synthetic device readings %v", readings)
+	}
+}
+
+func TestCollectCUStats(t *testing.T) {
+	r := useMetrics(t)
+	useConfig(t, defaultConfig())
+	defer func(sysfs string) { SysfsDevices = sysfs }(SysfsDevices)
+	SysfsDevices = t.TempDir()
+	writeFiles(t, SysfsDevices, map[string]string{
+		"0000:3b:00.1/" + XclbinUUIDFile: "5a4ee9bb",
+		"0000:3b:00.1/" + CUStatFile:     "0,vadd:vadd_1,0x1800000,0x4,10\n1,vadd:vadd_2,0x1810000,0x1,3\n",
+	})
+	telemetry.lock.Lock()
+	telemetry.updated = time.Time{}
+	telemetry.lock.Unlock()
+	defer func() {
+		telemetry.lock.Lock()
+		telemetry.updated = time.Time{}
+		telemetry.lock.Unlock()
+	}()
+
+	m := &FPGADevicePlugin{scanned: []Device{{DBDF: "0000:3b:00.1", SN: "XFL1", vbnv: "shell", shellVer: "shell", deviceType: "u250"}}}
+	m.collectTelemetry()
+	text := metricsText(t, r)
+	card := `bdf="0000:3b:00.1",sn="XFL1",shell="shell",resource="amd.com/` + getDSAtype(m.scanned[0], nil) + `"`
+	for _, line := range []string{
+		`amd_fpga_xclbin_info{` + card + `,xclbin="5a4ee9bb"} 1`,
+		`amd_fpga_cu_usage_total{` + card + `,xclbin="5a4ee9bb",kernel="vadd",cu="vadd_1",address="0x1800000"} 10`,
+		`amd_fpga_cu_usage_total{` + card + `,xclbin="5a4ee9bb",kernel="vadd",cu="vadd_2",address="0x1810000"} 3`,
+		`amd_fpga_cu_status{` + card + `,xclbin="5a4ee9bb",kernel="vadd",cu="vadd_2",address="0x1810000"} 1`,
+		"# TYPE amd_fpga_cu_usage_total counter",
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("no %s in\n%s", line, text)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// ShellFamily groups the shells(VBNV) of a card family, e.g. all the U30
+// shells. The families are read from ShellFamilyFile:
+//
+//	{
+//	    "families": [
+//	        {"name": "ama_u30", "match": "*xilinx_u30*", "rename": true, "timestamp": false, "card": true}
+//	    ]
+//	}
+//
+// The first family whose match pattern, a case insensitive glob or a regular
+// expression prefixed with "re:", matches the shell of a device applies to
+// it. The families of the file come before the builtin ones.
+type ShellFamily struct {
+	Name  string `json:"name"`
+	Match string `json:"match"`
+	// Rename replaces the shell of the devices by the family name, so all
+	// shells of the family are one resource
+	Rename bool `json:"rename"`
+	// Timestamp tells whether the shell timestamp is part of the resource
+	// name, default true
+	Timestamp *bool `json:"timestamp"`
+	// Card makes the devices of a card one allocation unit when
+	// U30AllocUnit is Card
+	Card bool `json:"card"`
+
+	matcher *nameMatcher
+}
+
+// builtinShellFamilies are the families known without ShellFamilyFile. The
+// U30 shells are named ama_u30 without timestamp, unless U30NameConvention is
+// ExactName.
+func builtinShellFamilies(c *Config) []*ShellFamily {
+	noTimestamp := false
+	u30 := &ShellFamily{
+		Name:  U30CommonShell,
+		Match: "*" + VtShell + "*",
+		Card:  true,
+	}
+	if c.U30NameConvention != "ExactName" {
+		u30.Rename = true
+		u30.Timestamp = &noTimestamp
+	}
+	families := []*ShellFamily{
+		u30,
+		{
+			Name:      "MA35",
+			Match:     "MA35",
+			Timestamp: &noTimestamp,
+		},
+	}
+	for _, family := range families {
+		if err := family.compile(); err != nil {
+			panic(err)
+		}
+	}
+	return families
+}
+
+func (f *ShellFamily) compile() error {
+	if err := validateResourceName(f.Name); err != nil {
+		return err
+	}
+	if f.Match == "" {
+		return fmt.Errorf("no match pattern")
+	}
+	matcher, err := newNameMatcher(f.Match)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", f.Match, err)
+	}
+	f.matcher = matcher
+	return nil
+}
+
+// withTimestamp tells whether the shell timestamp is part of the resource name
+func (f *ShellFamily) withTimestamp() bool {
+	return f == nil || f.Timestamp == nil || *f.Timestamp
+}
+
+// namesResource tells whether the family name is the resource name of the
+// devices of the family, before the name customization, as the U30
+// CommonName convention did
+func (f *ShellFamily) namesResource() bool {
+	return f != nil && f.Rename
+}
+
+// loadShellFamilies reads and validates the shell families of a json file
+func loadShellFamilies(fname string) ([]*ShellFamily, error) {
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Families []*ShellFamily `json:"families"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("Can't parse %s: %v", fname, err)
+	}
+	for i, family := range config.Families {
+		if family == nil {
+			return nil, fmt.Errorf("family %d in %s is empty", i, fname)
+		}
+		if err := family.compile(); err != nil {
+			return nil, fmt.Errorf("invalid family %d in %s: %v", i, fname, err)
+		}
+	}
+	return config.Families, nil
+}
+
+// getShellFamily returns the first family matching the shell, or nil
+func getShellFamily(shellVer string) *ShellFamily {
+	for _, family := range cfg().ShellFamilies {
+		if family.matcher.match(shellVer) {
+			return family
+		}
+	}
+	return nil
+}
+
+// isCardUnit tells whether the devices of the card are allocated together
+func isCardUnit(device Device) bool {
+	return device.family != nil && device.family.Card
+}
@@ -0,0 +1,192 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestLoadShellFamilies(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		// want are the names of the loaded families
+		want []string
+		err  string
+	}{
+		{name: "no families", content: `{"families": []}`, want: []string{}},
+		{name: "empty object", content: `{}`, want: []string{}},
+		{
+			name:    "families in order",
+			content: `{"families": [{"name": "v70", "match": "re:xilinx_v70_.*", "rename": true}, {"name": "u55c", "match": "*u55c*", "timestamp": false}]}`,
+			want:    []string{"v70", "u55c"},
+		},
+		{name: "unknown field", content: `{"families": [{"name": "v70", "match": "*", "cards": true}]}`, err: "Can't parse"},
+		{name: "not json", content: `families: []`, err: "Can't parse"},
+		{name: "empty family", content: `{"families": [null]}`, err: "family 0"},
+		{name: "invalid name", content: `{"families": [{"name": "v70/a", "match": "*"}]}`, err: "must consist of"},
+		{name: "no match", content: `{"families": [{"name": "v70"}]}`, err: "no match pattern"},
+		{name: "invalid glob", content: `{"families": [{"name": "v70", "match": "[v70"}]}`, err: "invalid pattern"},
+		{name: "invalid regexp", content: `{"families": [{"name": "v70", "match": "re:(v70"}]}`, err: "invalid pattern"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fname := path.Join(t.TempDir(), "ShellFamilies.json")
+			if err := ioutil.WriteFile(fname, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			families, err := loadShellFamilies(fname)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(families) != len(test.want) {
+				t.Fatalf("got %d families, want %v", len(families), test.want)
+			}
+			for i, family := range families {
+				if family.Name != test.want[i] || family.matcher == nil {
+					t.Errorf("family %d is %s, want %s", i, family.Name, test.want[i])
+				}
+			}
+		})
+	}
+	if _, err := loadShellFamilies(path.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("missing file loaded")
+	}
+}
+
+func TestGetShellFamily(t *testing.T) {
+	defer runtimeConfig.Store(cfg())
+
+	fname := path.Join(t.TempDir(), "ShellFamilies.json")
+	content := `{"families": [{"name": "u30-prod", "match": "xilinx_u30_gen3x4_prod*", "rename": true}]}`
+	if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		convention string
+		shell      string
+		family     string
+		rename     bool
+		timestamp  bool
+	}{
+		// the families of the file come before the builtin ones
+		{"CommonName", "xilinx_u30_gen3x4_prod_2", "u30-prod", true, true},
+		{"CommonName", "xilinx_u30_gen3x4_base_2", U30CommonShell, true, false},
+		{"CommonName", "XILINX_U30_GEN3X4_BASE_2", U30CommonShell, true, false},
+		{"ExactName", "xilinx_u30_gen3x4_base_2", U30CommonShell, false, true},
+		{"CommonName", "MA35", "MA35", false, false},
+		{"CommonName", "MA35D", "", false, true},
+		{"CommonName", "xilinx_u250_gen3x16_xdma_shell_4_1", "", false, true},
+	}
+	for _, test := range tests {
+		c := defaultConfig()
+		c.U30NameConvention, c.ShellFamilyFile = test.convention, fname
+		rc, errs := loadConfigFiles(c)
+		if len(errs) != 0 {
+			t.Fatal(errs)
+		}
+		runtimeConfig.Store(rc)
+		family := getShellFamily(test.shell)
+		name := ""
+		if family != nil {
+			name = family.Name
+		}
+		if name != test.family || (family != nil && family.Rename != test.rename) || family.withTimestamp() != test.timestamp {
+			t.Errorf("%s %s: got family %q %+v, want %q rename %v timestamp %v",
+				test.convention, test.shell, name, family, test.family, test.rename, test.timestamp)
+		}
+	}
+}
+
+func TestGetDSAtypeFamilyPrecedence(t *testing.T) {
+	c := defaultConfig()
+	c.DeviceNameCustomize = true
+	useConfig(t, c)
+	names, err := parseNameCustomize([]byte(`{"rules": [{"name": "all", "match": {}, "template": "{{.SN}}"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u30 := Device{DBDF: "0000:82:00.1", SN: "XFL1U30", shellVer: U30CommonShell, timestamp: "0x1",
+		family: getShellFamily("xilinx_u30_gen3x4_base_2")}
+	exact := &ShellFamily{Name: "u30", Timestamp: new(bool)}
+	for _, test := range []struct {
+		name   string
+		device Device
+		want   string
+	}{
+		{"renamed by the U30 family", u30, U30CommonShell},
+		{"family keeping the shell", Device{DBDF: "0000:83:00.1", SN: "XFL1U30B", shellVer: "xilinx_u30_gen3x4_base_2", family: exact}, "XFL1U30B"},
+		{"no family", Device{DBDF: "0000:3b:00.1", SN: "XFL1A", shellVer: "xilinx_u250", timestamp: "0x1"}, "XFL1A"},
+	} {
+		if got := getDSAtype(test.device, names); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+	// the rules aren't checked against the renamed devices
+	bad, err := parseNameCustomize([]byte(`{"rules": [{"name": "bad", "match": {}, "template": "{{.BDF}}"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := bad.validate([]Device{u30}); len(errs) != 0 {
+		t.Errorf("renamed device checked: %v", errs)
+	}
+	if errs := bad.validate([]Device{{DBDF: "0000:3b:00.1", shellVer: "xilinx_u250"}}); len(errs) != 1 {
+		t.Errorf("got %d errors, want 1", len(errs))
+	}
+}
+
+func TestIsCardUnit(t *testing.T) {
+	for _, convention := range []string{"CommonName", "ExactName"} {
+		c := defaultConfig()
+		c.U30NameConvention = convention
+		u30 := builtinShellFamilies(c)[0]
+		if !isCardUnit(Device{family: u30}) {
+			t.Errorf("%s: the U30 devices are no card unit", convention)
+		}
+	}
+	if isCardUnit(Device{}) || isCardUnit(Device{family: &ShellFamily{Name: "v70"}}) {
+		t.Errorf("devices without a card family are card units")
+	}
+}
+
+func TestGetDSAtypeTimestamp(t *testing.T) {
+	useConfig(t, defaultConfig())
+	noTimestamp := false
+	for _, test := range []struct {
+		device Device
+		want   string
+	}{
+		{Device{shellVer: "xilinx_u250", timestamp: "0x1"}, "xilinx_u250-0x1"},
+		{Device{shellVer: "xilinx_u250", timestamp: "0x1", family: &ShellFamily{Name: "u250"}}, "xilinx_u250-0x1"},
+		{Device{shellVer: "ama_u30", timestamp: "0x1", family: &ShellFamily{Name: "ama_u30", Timestamp: &noTimestamp}}, "ama_u30"},
+	} {
+		if got := getDSAtype(test.device, nil); got != test.want {
+			t.Errorf("got %s, want %s", got, test.want)
+		}
+	}
+}
@@ -29,8 +29,15 @@ import (
 	"time"
 )
 
+// The trees the devices are discovered in, they are moved under a fixture
+// tree by setDiscoveryRoot
+var (
+	SysfsDevices  = "/sys/bus/pci/devices"
+	DevicesPath   = "/dev"
+	MiscClassPath = "/sys/class/misc"
+)
+
 const (
-	SysfsDevices   = "/sys/bus/pci/devices"
 	MgmtPrefix     = "/dev/xclmgmt"
 	UserPrefix     = "/dev/dri"
 	QdmaPrefix     = "/dev/xfpga"
@@ -58,14 +65,20 @@ const (
 )
 
 const (
-	DevicesPath       = "/dev"
 	AmaDevicePrefix   = "ama_transcoder"
-	MiscClassPath     = "/sys/class/misc"
 	AmaBusId          = "bus_id"
 	AmaDeivceInfo     = "device_info"
 	AmaPlatformPrefix = "MA"
 )
 
+// setDiscoveryRoot discovers the devices in a copy of the sysfs and /dev
+// trees under root, e.g. a test fixture
+func setDiscoveryRoot(root string) {
+	SysfsDevices = path.Join(root, SysfsDevices)
+	DevicesPath = path.Join(root, DevicesPath)
+	MiscClassPath = path.Join(root, MiscClassPath)
+}
+
 type Pairs struct {
 	Mgmt string
 	User string
@@ -80,9 +93,18 @@ type Device struct {
 	timestamp  string
 	DBDF       string // this is for user pf
 	deviceID   string //devid of the user pf
+	vendorID   string //vendor id of the user pf
 	Healthy    string
 	SN         string
 	Nodes      *Pairs
+	// family is the shell family of the device, or nil
+	family *ShellFamily
+	// vbnv is the shell as reported by the device, before the family renames it
+	vbnv string
+	// mgmtOnly is set on the devices of a dedicated mgmt resource
+	mgmtOnly bool
+	// topology is the NUMA node of a synthetic card, nil if unknown
+	topology *pluginapi.TopologyInfo
 }
 
 func GetInstance(DBDF string) (string, error) {
@@ -108,6 +130,12 @@ func GetInstance(DBDF string) (string, error) {
 	return strconv.FormatUint(ret, 10), nil
 }
 
+// GetPciBDF returns the PCI BDF of a device ID, which has the index of
+// the virtual device appended in Virtual Device mode
+func GetPciBDF(DBDF string) string {
+	return strings.SplitN(DBDF, "-", 2)[0]
+}
+
 func GetFileNameFromPrefix(dir string, prefix string) (string, error) {
 	userFiles, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -213,7 +241,7 @@ func GetAlveoDevices() ([]Device, error) {
 					time.Sleep(20 * time.Second)
 					break
 				}
-				fmt.Println(count, pciID, romFolder, err)
+				discoveryLog.WithField("bdf", pciID).Debugf("Waiting for the rom(%d): %q %v", count, romFolder, err)
 				count += 1
 			}
 			// get dsa version
@@ -222,12 +250,14 @@ func GetAlveoDevices() ([]Device, error) {
 			if err != nil {
 				return nil, err
 			}
-			if strings.EqualFold(U30NameConvention, "CommonName") && strings.Contains(content, VtShell) {
-				content = U30CommonShell
-			}
+			VBNV := content
 			dsaVer := content
 			// get dsa type from dsa version
 			dsaType := strings.Split(dsaVer, "_")[1]
+			family := getShellFamily(dsaVer)
+			if family != nil && family.Rename {
+				dsaVer = family.Name
+			}
 			// get dsa timestamp
 			fname = path.Join(SysfsDevices, pciID, romFolder, DSAtsFile)
 			content, err = GetFileContent(fname)
@@ -272,11 +302,11 @@ func GetAlveoDevices() ([]Device, error) {
 			if err != nil {
 				if strings.EqualFold(vendorID, AWS_ID) == true {
 					content = "F1-Node"
-				} else if strings.EqualFold(dsaType, "u30") == true {
-					fmt.Println("No Serial Number detected, Serial Number is must required for u30 device")
+				} else if family != nil && family.Card {
+					discoveryLog.WithField("bdf", pciID).Errorf("No Serial Number detected, Serial Number is must required for %s device", family.Name)
 					return nil, err
 				} else {
-					fmt.Println("Device has no serial number detected")
+					discoveryLog.WithField("bdf", pciID).Warnf("Device has no serial number detected")
 				}
 			}
 			SN := content
@@ -306,8 +336,8 @@ func GetAlveoDevices() ([]Device, error) {
 			//TODO: check temp, power, fan speed etc, to give a healthy level
 			//so far, return Healthy
 			healthy := pluginapi.Healthy
-			if strings.EqualFold(VirtualDev, "True") {
-				for i := 0; i < VirtualNum; i++ {
+			if cfg().VirtualDev {
+				for i := 0; i < cfg().VirtualNum; i++ {
 					devices = append(devices, Device{
 						index:      strconv.Itoa(len(devices) + 1),
 						shellVer:   dsaVer,
@@ -316,9 +346,12 @@ func GetAlveoDevices() ([]Device, error) {
 						timestamp:  dsaTs,
 						DBDF:       userDBDF + "-" + strconv.Itoa(i),
 						deviceID:   devid,
+						vendorID:   vendorID,
 						Healthy:    healthy,
 						SN:         SN,
 						Nodes:      pairMap[DBD],
+						family:     family,
+						vbnv:       VBNV,
 					})
 				}
 			} else {
@@ -330,9 +363,12 @@ func GetAlveoDevices() ([]Device, error) {
 					timestamp:  dsaTs,
 					DBDF:       userDBDF,
 					deviceID:   devid,
+					vendorID:   vendorID,
 					Healthy:    healthy,
 					SN:         SN,
 					Nodes:      pairMap[DBD],
+					family:     family,
+					vbnv:       VBNV,
 				})
 			}
 		} else if IsMgmtPf(pciID) { //mgmt pf
@@ -358,7 +394,8 @@ func GetAMADevices() ([]Device, error) {
 	}
 	devFiles, err := ioutil.ReadDir(DevicesPath)
 	if err != nil {
-		fmt.Errorf("Cannot read folder %s", DevicesPath)
+		// no AMA device is found then, as before
+		discoveryLog.Debugf("Cannot read folder %s: %v", DevicesPath, err)
 	}
 
 	for _, devFile := range devFiles {
@@ -396,11 +433,11 @@ func GetAMADevices() ([]Device, error) {
 		productNameKey, productSNKey, deviceIdKey := "Product name", "Product serial number", "PCIe device ID"
 		// open additional AMA device info file
 		file, err := os.Open(path.Join(MiscClassPath, devId, AmaDeivceInfo))
-		defer file.Close()
 		if err != nil {
-			fmt.Errorf("Failed to open file path %s", path.Join(MiscClassPath, devId, AmaDeivceInfo))
+			discoveryLog.Errorf("Failed to open file path %s", path.Join(MiscClassPath, devId, AmaDeivceInfo))
 			return nil, err
 		}
+		defer file.Close()
 
 		// read file line by line
 		fscanner := bufio.NewScanner(file)
@@ -416,25 +453,29 @@ func GetAMADevices() ([]Device, error) {
 			}
 
 			if strings.EqualFold(productNameKey, strings.TrimSpace(strs[0])) {
-				//fmt.Printf("BoardName: %v \n", strings.TrimSpace(strs[1]))
 				boardName = "MA35"
 
 			}
 			if strings.EqualFold(productSNKey, strings.TrimSpace(strs[0])) {
-				//fmt.Printf("SerialNumber: %v \n", strings.TrimSpace(strs[1]))
 				SN = strings.TrimSpace(strs[1])
 			}
 			if strings.EqualFold(deviceIdKey, strings.TrimSpace(strs[0])) {
-				//fmt.Printf("DeviceID: %v \n", strings.TrimSpace(strs[1]))
 				devid = strings.TrimSpace(strs[1])
 			}
 		}
+		VBNV := boardName
+		family := getShellFamily(boardName)
+		if family != nil && family.Rename {
+			boardName = family.Name
+		}
+		// vendor id is informational for AMA devices, ignore the error
+		vendorID, _ := GetFileContent(path.Join(SysfsDevices, busId, VendorFile))
 		//TODO: check temp, power, fan speed etc, to give a healthy level
 		//so far, return Healthy
 		healthy := pluginapi.Healthy
 		//healthy := "temp-health"
-		if strings.EqualFold(VirtualDev, "True") {
-			for i := 0; i < VirtualNum; i++ {
+		if cfg().VirtualDev {
+			for i := 0; i < cfg().VirtualNum; i++ {
 				devices = append(devices, Device{
 					index:      strconv.Itoa(len(devices) + 1),
 					shellVer:   boardName,
@@ -443,9 +484,12 @@ func GetAMADevices() ([]Device, error) {
 					timestamp:  "0",
 					DBDF:       busId + "-" + strconv.Itoa(i),
 					deviceID:   devid,
+					vendorID:   vendorID,
 					Healthy:    healthy,
 					SN:         SN,
 					Nodes:      pairMap[DBD],
+					family:     family,
+					vbnv:       VBNV,
 				})
 			}
 		} else {
@@ -457,9 +501,12 @@ func GetAMADevices() ([]Device, error) {
 				timestamp:  "0",
 				DBDF:       busId,
 				deviceID:   devid,
+				vendorID:   vendorID,
 				Healthy:    healthy,
 				SN:         SN,
 				Nodes:      pairMap[DBD],
+				family:     family,
+				vbnv:       VBNV,
 			})
 		}
 	}
@@ -467,11 +514,14 @@ func GetAMADevices() ([]Device, error) {
 }
 
 func GetDevices() ([]Device, error) {
-	AMADevicesArry, err := GetAMADevices()
+	if cfg().SyntheticSpecFile != "" {
+		return countDiscovery("synthetic", GetSyntheticDevices)
+	}
+	AMADevicesArry, err := countDiscovery("ama", GetAMADevices)
 	if err != nil {
 		return nil, err
 	}
-	AlveoDevicesArry, err := GetAlveoDevices()
+	AlveoDevicesArry, err := countDiscovery("alveo", GetAlveoDevices)
 	if err != nil {
 		return nil, err
 	}
@@ -481,36 +531,3 @@ func GetDevices() ([]Device, error) {
 	}
 	return AMADevicesArry, err
 }
-
-/*
-func main() {
-
-	//ama_devices, err := GetAMADevices()
-	//if err != nil {
-	//	fmt.Printf("%s !!!\n", err)
-	//	return
-	//}
-		ama_devices, err := GetAMADevices()
-		if err != nil {
-			fmt.Printf("%s !!!\n", err)
-			return
-		}
-		for _, device := range ama_devices {
-			fmt.Printf("AMADevice: %v \n", device)
-			fmt.Printf("AMADriver: %v \n",device.Nodes)
-		}
-	all_devices, err := GetAMADevices()
-	if err != nil {
-		fmt.Printf("%s !!!\n", err)
-		return
-	}
-	for _, device := range all_devices {
-		fmt.Printf("AMA ShellVer: %v \n", device.shellVer)
-		fmt.Printf("AMA Timestamp: %v \n", device.timestamp)
-		fmt.Printf("AMA DBDF: %v \n", device.DBDF)
-		fmt.Printf("AMA deviceID: %v \n", device.deviceID)
-		fmt.Printf("AMA SN: %v \n", device.SN)
-		fmt.Printf("AMA Driver: %v \n", device.Nodes)
-	}
-}
-*/
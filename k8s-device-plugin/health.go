@@ -0,0 +1,162 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// discoveryStatus is the state of the device scan
+type discoveryStatus struct {
+	// Running is unset once the scan ended, a failed scan is retried until then
+	Running bool `json:"running"`
+	// Scans counts the successful scans
+	Scans     int        `json:"scans"`
+	LastScan  *time.Time `json:"lastScan,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// resourceStatus is the state of the server of a resource
+type resourceStatus struct {
+	Devices    int  `json:"devices"`
+	Serving    bool `json:"serving"`
+	Registered bool `json:"registered"`
+}
+
+// healthReport is the body of the health probes
+type healthReport struct {
+	Status    string                    `json:"status"`
+	Discovery discoveryStatus           `json:"discovery"`
+	Resources map[string]resourceStatus `json:"resources"`
+}
+
+// setDiscovered records a successful device scan
+func (m *FPGADevicePlugin) setDiscovered() {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	now := time.Now()
+	m.discovery.Scans++
+	m.discovery.LastScan = &now
+	m.discovery.LastError = ""
+}
+
+// setDiscoveryError records a failed device scan
+func (m *FPGADevicePlugin) setDiscoveryError(err error) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	m.discovery.LastError = err.Error()
+}
+
+// publishServers makes the servers as of now visible to the health probes,
+// the servers are only changed by the main loop
+func (m *FPGADevicePlugin) publishServers() {
+	servers := []*FPGADevicePluginServer{}
+	for _, server := range m.servers {
+		servers = append(servers, server)
+	}
+	m.statusLock.Lock()
+	m.published = servers
+	m.statusLock.Unlock()
+}
+
+// status reports the state of the device scan and of every server
+func (m *FPGADevicePlugin) status() healthReport {
+	m.statusLock.Lock()
+	report := healthReport{
+		Discovery: m.discovery,
+		Resources: make(map[string]resourceStatus),
+	}
+	servers := m.published
+	m.statusLock.Unlock()
+	for _, server := range servers {
+		server.lock.Lock()
+		report.Resources[server.resourceName] = resourceStatus{
+			Devices:    len(server.devices),
+			Serving:    server.server != nil && server.ctx.Err() == nil,
+			Registered: server.registered && !server.failed && server.ctx.Err() == nil,
+		}
+		server.lock.Unlock()
+	}
+	return report
+}
+
+// live tells whether the device scan is still running
+func (report *healthReport) live() bool {
+	return report.Discovery.Running
+}
+
+// ready tells whether the devices were scanned at least once and every
+// resource is serving and registered with kubelet
+func (report *healthReport) ready() bool {
+	if !report.live() || report.Discovery.Scans == 0 {
+		return false
+	}
+	for _, resource := range report.Resources {
+		if !resource.Serving || !resource.Registered {
+			return false
+		}
+	}
+	return true
+}
+
+// probeHandler serves a health probe, it answers 200 if check passes and 503
+// otherwise, with the report in JSON
+func (m *FPGADevicePlugin) probeHandler(check func(report *healthReport) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := m.status()
+		code := http.StatusOK
+		report.Status = "ok"
+		if !check(&report) {
+			code = http.StatusServiceUnavailable
+			report.Status = "failed"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			httpLog.Debugf("Can't write the health report: %v", err)
+		}
+	}
+}
+
+// startHTTPServer serves the metrics, the health probes, the pod map and the
+// usage of the plugin on addr until ctx is done. The plugin keeps running without them if the
+// address can't be listened on.
+func startHTTPServer(ctx context.Context, addr string, plugin *FPGADevicePlugin) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc("/healthz", plugin.probeHandler((*healthReport).live))
+	mux.HandleFunc("/readyz", plugin.probeHandler((*healthReport).ready))
+	mux.HandleFunc("/pods", plugin.podsHandler)
+	mux.HandleFunc("/usage", podUsage.usageHandler)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		httpLog.Printf("Serving metrics and health probes on %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			httpLog.Errorf("Can't serve metrics and health probes on %s: %v", addr, err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+}
@@ -0,0 +1,196 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// healthServer returns a server of resourceName with devices devices,
+// serving if its gRPC server runs and registered with kubelet if registered
+func healthServer(resourceName string, devices int, serving bool, registered bool) *FPGADevicePluginServer {
+	server := &FPGADevicePluginServer{resourceName: resourceName, devices: make(map[string]Device), registered: registered}
+	server.ctx, server.cancel = context.WithCancel(context.Background())
+	for i := 0; i < devices; i++ {
+		server.devices[string(rune('a'+i))] = Device{}
+	}
+	if serving {
+		server.server = grpc.NewServer()
+	}
+	return server
+}
+
+// probe requests path from the probes of the plugin and decodes the report
+func probe(t *testing.T, m *FPGADevicePlugin, path string) (int, healthReport) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", m.probeHandler((*healthReport).live))
+	mux.HandleFunc("/readyz", m.probeHandler((*healthReport).ready))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("%s: content type %q", path, w.Header().Get("Content-Type"))
+	}
+	var report healthReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%s: invalid report %q: %v", path, w.Body.String(), err)
+	}
+	return w.Code, report
+}
+
+func TestHealthProbes(t *testing.T) {
+	stopped := healthServer("amd.com/u200", 1, true, true)
+	stopped.cancel()
+	tests := []struct {
+		name    string
+		running bool
+		scans   int
+		servers []*FPGADevicePluginServer
+		live    bool
+		ready   bool
+	}{
+		{"starting", true, 0, nil, true, false},
+		{"no devices", true, 1, nil, true, true},
+		{"registered", true, 3, []*FPGADevicePluginServer{healthServer("amd.com/u250", 2, true, true)}, true, true},
+		{"not registered yet", true, 1, []*FPGADevicePluginServer{
+			healthServer("amd.com/u250", 2, true, true), healthServer("amd.com/u30", 1, true, false)}, true, false},
+		{"not serving", true, 1, []*FPGADevicePluginServer{healthServer("amd.com/u250", 2, false, true)}, true, false},
+		{"stopped server", true, 1, []*FPGADevicePluginServer{stopped}, true, false},
+		{"scan gave up", false, 5, []*FPGADevicePluginServer{healthServer("amd.com/u250", 2, true, true)}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &FPGADevicePlugin{servers: make(map[string]*FPGADevicePluginServer)}
+			m.discovery.Running = tt.running
+			m.discovery.Scans = tt.scans
+			for _, server := range tt.servers {
+				m.servers[server.resourceName] = server
+			}
+			m.publishServers()
+
+			for path, ok := range map[string]bool{"/healthz": tt.live, "/readyz": tt.ready} {
+				code, report := probe(t, m, path)
+				status, expectCode := "ok", http.StatusOK
+				if !ok {
+					status, expectCode = "failed", http.StatusServiceUnavailable
+				}
+				if code != expectCode || report.Status != status {
+					t.Errorf("%s: %d %s, expect %d %s", path, code, report.Status, expectCode, status)
+				}
+				if len(report.Resources) != len(tt.servers) {
+					t.Errorf("%s: resources %v", path, report.Resources)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthReportResources(t *testing.T) {
+	m := &FPGADevicePlugin{servers: make(map[string]*FPGADevicePluginServer)}
+	m.discovery.Running = true
+	failed := healthServer("amd.com/u30", 1, true, true)
+	failed.failed = true
+	for _, server := range []*FPGADevicePluginServer{healthServer("amd.com/u250", 2, true, true), failed} {
+		m.servers[server.resourceName] = server
+	}
+	m.setDiscoveryError(errors.New("Can't read folder /sys/bus/pci/devices"))
+
+	// the servers are visible once published
+	if _, report := probe(t, m, "/readyz"); len(report.Resources) != 0 {
+		t.Errorf("unpublished servers reported: %v", report.Resources)
+	}
+	m.publishServers()
+	code, report := probe(t, m, "/readyz")
+	expect := map[string]resourceStatus{
+		"amd.com/u250": {Devices: 2, Serving: true, Registered: true},
+		"amd.com/u30":  {Devices: 1, Serving: true, Registered: false},
+	}
+	if code != http.StatusServiceUnavailable || !reflect.DeepEqual(report.Resources, expect) {
+		t.Errorf("%d %v, expect 503 %v", code, report.Resources, expect)
+	}
+	if report.Discovery.LastError == "" || report.Discovery.LastScan != nil || report.Discovery.Scans != 0 {
+		t.Errorf("discovery %+v before a successful scan", report.Discovery)
+	}
+
+	// a successful scan clears the error
+	before := time.Now()
+	m.setDiscovered()
+	_, report = probe(t, m, "/healthz")
+	if report.Discovery.LastError != "" || report.Discovery.Scans != 1 ||
+		report.Discovery.LastScan == nil || report.Discovery.LastScan.Before(before.Truncate(time.Second)) {
+		t.Errorf("discovery %+v after a scan", report.Discovery)
+	}
+}
+
+func TestStartHTTPServer(t *testing.T) {
+	useMetrics(t).add(metricRegistrations, 1, "resource", "amd.com/u250")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	m := &FPGADevicePlugin{servers: make(map[string]*FPGADevicePluginServer)}
+	m.discovery.Running = true
+	ctx, cancel := context.WithCancel(context.Background())
+	startHTTPServer(ctx, addr, m)
+	get := func(path string) (int, string, error) {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), err
+	}
+	for i := 0; i < 50; i++ {
+		if _, _, err = get("/healthz"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	for path, expect := range map[string]int{"/healthz": 200, "/readyz": 503, "/metrics": 200, "/": 404} {
+		if code, body, err := get(path); err != nil || code != expect {
+			t.Errorf("%s: %d %q %v, expect %d", path, code, body, err, expect)
+		}
+	}
+
+	cancel()
+	for i := 0; i < 50; i++ {
+		if _, _, err = get("/healthz"); err != nil {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("probes still served after the context is done")
+}
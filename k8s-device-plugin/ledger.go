@@ -0,0 +1,163 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ledgerGracePeriod is how long a new allocation is kept before kubelet
+// reports it
+const ledgerGracePeriod = time.Minute
+
+// AllocationLedger records which resource holds each device, when the same
+// devices are registered under more than one resource, through a legacy
+// domain or an aggregate resource. A device held through
+// one resource is reported unhealthy by the others, so kubelet doesn't hand
+// it out twice. Kubelet doesn't tell the plugin when a device is freed, so
+// the ledger is synced with the devices in use of the pod map.
+type AllocationLedger struct {
+	lock sync.Mutex
+	// holders maps a device, keyed by physicalDeviceID, to the resource
+	// holding it
+	holders map[string]string
+	// allocated is when a device was allocated through the plugin
+	allocated map[string]time.Time
+	// listeners are notified when the holders change
+	listeners map[chan struct{}]bool
+}
+
+var allocLedger = newAllocationLedger()
+
+func newAllocationLedger() *AllocationLedger {
+	return &AllocationLedger{
+		holders:   make(map[string]string),
+		allocated: make(map[string]time.Time),
+		listeners: make(map[chan struct{}]bool),
+	}
+}
+
+// ledgerEnabled tells whether devices are shared by more than one resource
+func ledgerEnabled() bool {
+	return cfg().LegacyResourceDomain != "" || len(cfg().AggregateResources) != 0
+}
+
+// physicalDeviceID identifies the device of a resource regardless of the
+// domain it is allocated through
+func physicalDeviceID(id string, mgmt bool) string {
+	return cdiDeviceName(id, mgmt)
+}
+
+// subscribe returns a channel notified when the holders change
+func (l *AllocationLedger) subscribe() chan struct{} {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ch := make(chan struct{}, 1)
+	l.listeners[ch] = true
+	return ch
+}
+
+func (l *AllocationLedger) unsubscribe(ch chan struct{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.listeners, ch)
+}
+
+func (l *AllocationLedger) notify() {
+	for ch := range l.listeners {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// heldByOther tells whether the device is held through another resource
+func (l *AllocationLedger) heldByOther(resourceName string, key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	holder, ok := l.holders[key]
+	return ok && holder != resourceName
+}
+
+// acquire records the devices as held through the resource, it fails if any
+// of them is held through another resource. It returns the devices which
+// were not held through the resource yet.
+func (l *AllocationLedger) acquire(resourceName string, keys []string) ([]string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, key := range keys {
+		if holder, ok := l.holders[key]; ok && holder != resourceName {
+			return nil, fmt.Errorf("device %s is allocated through %s already", key, holder)
+		}
+	}
+	now := time.Now()
+	acquired := []string{}
+	for _, key := range keys {
+		if _, ok := l.holders[key]; !ok {
+			acquired = append(acquired, key)
+		}
+		l.holders[key] = resourceName
+		l.allocated[key] = now
+	}
+	l.notify()
+	return acquired, nil
+}
+
+// release drops the devices acquired by an allocation which failed
+func (l *AllocationLedger) release(keys []string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, key := range keys {
+		delete(l.holders, key)
+		delete(l.allocated, key)
+	}
+	l.notify()
+}
+
+// sync replaces the holders with the devices in use according to kubelet.
+// Devices allocated within the grace period are kept, kubelet may not report
+// them yet.
+func (l *AllocationLedger) sync(inUse map[string]string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	holders := make(map[string]string)
+	for key, resourceName := range inUse {
+		holders[key] = resourceName
+	}
+	for key, allocated := range l.allocated {
+		if _, ok := holders[key]; ok || time.Since(allocated) > ledgerGracePeriod {
+			delete(l.allocated, key)
+			continue
+		}
+		holders[key] = l.holders[key]
+	}
+	if reflect.DeepEqual(holders, l.holders) {
+		return
+	}
+	for key, resourceName := range l.holders {
+		if _, ok := holders[key]; !ok {
+			ledgerLog.WithField("resource", resourceName).Debugf("Device %s is released", key)
+		}
+	}
+	l.holders = holders
+	l.notify()
+}
@@ -0,0 +1,231 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ledgerStep is an operation on the ledger and the holders expected after
+type ledgerStep struct {
+	// op is acquire, release of the devices of the last acquire, sync or
+	// expire, which ages the allocations past the grace period
+	op       string
+	resource string
+	keys     []string
+	inUse    map[string]string
+
+	err string
+	// acquired are the devices the acquire took, none if nil
+	acquired []string
+	holders  map[string]string
+}
+
+func TestAllocationLedger(t *testing.T) {
+	const (
+		amd    = "amd.com/u250"
+		xilinx = "xilinx.com/u250"
+	)
+	tests := []struct {
+		name  string
+		steps []ledgerStep
+	}{
+		{
+			name: "acquire through one resource",
+			steps: []ledgerStep{
+				{op: "acquire", resource: amd, keys: []string{"a", "b"}, acquired: []string{"a", "b"},
+					holders: map[string]string{"a": amd, "b": amd}},
+				{op: "acquire", resource: amd, keys: []string{"b", "c"}, acquired: []string{"c"},
+					holders: map[string]string{"a": amd, "b": amd, "c": amd}},
+				{op: "acquire", resource: amd, keys: []string{},
+					holders: map[string]string{"a": amd, "b": amd, "c": amd}},
+			},
+		},
+		{
+			name: "a failed allocation releases only the devices it took",
+			steps: []ledgerStep{
+				{op: "acquire", resource: amd, keys: []string{"a"}, acquired: []string{"a"},
+					holders: map[string]string{"a": amd}},
+				// the same device twice in a request is taken once
+				{op: "acquire", resource: amd, keys: []string{"a", "b", "b"}, acquired: []string{"b"},
+					holders: map[string]string{"a": amd, "b": amd}},
+				{op: "release",
+					holders: map[string]string{"a": amd}},
+				{op: "acquire", resource: xilinx, keys: []string{"b"}, acquired: []string{"b"},
+					holders: map[string]string{"a": amd, "b": xilinx}},
+			},
+		},
+		{
+			name: "a released device isn't kept for the grace period",
+			steps: []ledgerStep{
+				{op: "acquire", resource: amd, keys: []string{"a"}, acquired: []string{"a"},
+					holders: map[string]string{"a": amd}},
+				{op: "release",
+					holders: map[string]string{}},
+				{op: "sync", inUse: map[string]string{},
+					holders: map[string]string{}},
+			},
+		},
+		{
+			name: "a failed acquire takes none of the devices",
+			steps: []ledgerStep{
+				{op: "acquire", resource: amd, keys: []string{"a"}, acquired: []string{"a"},
+					holders: map[string]string{"a": amd}},
+				{op: "acquire", resource: xilinx, keys: []string{"b", "a"}, err: "device a is allocated through amd.com/u250 already",
+					holders: map[string]string{"a": amd}},
+				{op: "acquire", resource: xilinx, keys: []string{"b"}, acquired: []string{"b"},
+					holders: map[string]string{"a": amd, "b": xilinx}},
+			},
+		},
+		{
+			name: "sync keeps new allocations for the grace period",
+			steps: []ledgerStep{
+				{op: "acquire", resource: amd, keys: []string{"a"}, acquired: []string{"a"},
+					holders: map[string]string{"a": amd}},
+				{op: "sync", inUse: map[string]string{"b": xilinx},
+					holders: map[string]string{"a": amd, "b": xilinx}},
+				{op: "expire"},
+				{op: "sync", inUse: map[string]string{"b": xilinx},
+					holders: map[string]string{"b": xilinx}},
+			},
+		},
+		{
+			name: "sync drops the grace period once kubelet reports the device",
+			steps: []ledgerStep{
+				{op: "acquire", resource: amd, keys: []string{"a"}, acquired: []string{"a"},
+					holders: map[string]string{"a": amd}},
+				{op: "sync", inUse: map[string]string{"a": amd},
+					holders: map[string]string{"a": amd}},
+				{op: "sync", inUse: map[string]string{},
+					holders: map[string]string{}},
+			},
+		},
+		{
+			name: "kubelet wins over the ledger",
+			steps: []ledgerStep{
+				{op: "sync", inUse: map[string]string{"a": xilinx},
+					holders: map[string]string{"a": xilinx}},
+				{op: "acquire", resource: amd, keys: []string{"a"}, err: "allocated through xilinx.com/u250",
+					holders: map[string]string{"a": xilinx}},
+				{op: "sync", inUse: map[string]string{"a": amd},
+					holders: map[string]string{"a": amd}},
+			},
+		},
+		{
+			name: "empty sync of an empty ledger",
+			steps: []ledgerStep{
+				{op: "sync", inUse: map[string]string{}, holders: map[string]string{}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := newAllocationLedger()
+			var acquired []string
+			for i, step := range test.steps {
+				switch step.op {
+				case "acquire":
+					var err error
+					acquired, err = ledger.acquire(step.resource, step.keys)
+					if step.err != "" {
+						if err == nil || !strings.Contains(err.Error(), step.err) {
+							t.Fatalf("step %d: got error %v, want %q", i, err, step.err)
+						}
+					} else if err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+					if len(acquired) != len(step.acquired) || (len(acquired) != 0 && !reflect.DeepEqual(acquired, step.acquired)) {
+						t.Errorf("step %d: acquired %v, want %v", i, acquired, step.acquired)
+					}
+				case "release":
+					ledger.release(acquired)
+				case "sync":
+					ledger.sync(step.inUse)
+				case "expire":
+					for key, allocated := range ledger.allocated {
+						ledger.allocated[key] = allocated.Add(-ledgerGracePeriod - time.Second)
+					}
+					continue
+				}
+				if !reflect.DeepEqual(ledger.holders, step.holders) {
+					t.Fatalf("step %d: holders %v, want %v", i, ledger.holders, step.holders)
+				}
+				for key, holder := range step.holders {
+					if !ledger.heldByOther("other.com/u250", key) || ledger.heldByOther(holder, key) {
+						t.Errorf("step %d: device %s is not held through %s only", i, key, holder)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLedgerNotify(t *testing.T) {
+	ledger := newAllocationLedger()
+	ch := ledger.subscribe()
+	notified := func() bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+	if _, err := ledger.acquire("amd.com/u250", []string{"a"}); err != nil || !notified() {
+		t.Errorf("acquire did not notify, %v", err)
+	}
+	if _, err := ledger.acquire("xilinx.com/u250", []string{"a"}); err == nil || notified() {
+		t.Errorf("failed acquire notified, %v", err)
+	}
+	ledger.sync(map[string]string{"a": "amd.com/u250"})
+	if notified() {
+		t.Errorf("sync without change notified")
+	}
+	// listeners are not blocked by a pending notification
+	ledger.sync(map[string]string{"b": "amd.com/u250"})
+	ledger.sync(map[string]string{})
+	if !notified() || notified() {
+		t.Errorf("changes did not notify once")
+	}
+	if _, err := ledger.acquire("amd.com/u250", []string{"d"}); err != nil || !notified() {
+		t.Errorf("acquire did not notify, %v", err)
+	}
+	ledger.release([]string{"d"})
+	if !notified() || ledger.heldByOther("xilinx.com/u250", "d") {
+		t.Errorf("release did not notify or free the device")
+	}
+	ledger.unsubscribe(ch)
+	ledger.sync(map[string]string{"c": "amd.com/u250"})
+	if notified() {
+		t.Errorf("unsubscribed channel notified")
+	}
+}
+
+func TestPhysicalDeviceID(t *testing.T) {
+	// a device has the same id in the resources of every domain, the mgmt
+	// resource holds the mgmt PF only
+	if id := physicalDeviceID("0000:3b:00.1", false); id != "0000:3b:00.1" {
+		t.Errorf("got %s", id)
+	}
+	if id := physicalDeviceID("0000:3b:00.1", true); id != "0000:3b:00.1"+MgmtResourceSuffix {
+		t.Errorf("mgmt got %s", id)
+	}
+}
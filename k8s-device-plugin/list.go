@@ -0,0 +1,257 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"os"
+	"path"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// DeviceInfo describes a discovered device in the inventory
+type DeviceInfo struct {
+	BDF       string   `json:"bdf"`
+	Family    string   `json:"family,omitempty"`
+	VBNV      string   `json:"vbnv"`
+	Shell     string   `json:"shell"`
+	Timestamp string   `json:"timestamp"`
+	UUID      string   `json:"uuid"`
+	SN        string   `json:"sn"`
+	Nodes     Pairs    `json:"nodes"`
+	Health    string   `json:"health"`
+	Reasons   []string `json:"reasons,omitempty"`
+	// Resource is the shell specific resource of the device, Resources
+	// all the resources it is registered under
+	Resource  string   `json:"resource"`
+	Resources []string `json:"resources"`
+	// Card is the serial number shared by the devices of a card, CardUnit
+	// tells whether they are allocated together
+	Card     string `json:"card,omitempty"`
+	CardUnit bool   `json:"cardUnit"`
+	// Pods are the containers holding the device, according to kubelet
+	Pods []DeviceHolder `json:"pods,omitempty"`
+}
+
+// checkDeviceHealth returns the health of the device and the reasons it is
+// unhealthy
+func checkDeviceHealth(dev Device) (string, []string) {
+	reasons := []string{}
+	if dev.Healthy != pluginapi.Healthy {
+		reasons = append(reasons, "reported "+dev.Healthy+" by discovery")
+	}
+	for _, node := range []string{dev.Nodes.User, dev.Nodes.Mgmt, dev.Nodes.Qdma} {
+		if node != "" && !FileExist(node) {
+			reasons = append(reasons, "device node "+node+" is missing")
+		}
+	}
+	if dev.Nodes.Mgmt != "" || dev.Nodes.Qdma != "" {
+		fname := path.Join(SysfsDevices, GetPciBDF(dev.DBDF), ReadyFile)
+		if content, err := GetFileContent(fname); err == nil {
+			if ready, err := strconv.ParseUint(strings.TrimSpace(content), 0, 64); err == nil && ready == 0 {
+				reasons = append(reasons, "driver reports the device not ready")
+			}
+		}
+	}
+	if len(reasons) != 0 {
+		return pluginapi.Unhealthy, reasons
+	}
+	return pluginapi.Healthy, nil
+}
+
+// getInventory describes the devices as the plugin would register them, with
+// the containers holding them if holders is set
+func getInventory(devices []Device, names *NameCustomize, holders map[string][]DeviceHolder) []DeviceInfo {
+	devMap := buildDeviceMap(devices, names)
+	// the resources of each device, the mgmt resources are keyed by the BDF
+	// of the card
+	specific := make(map[string]string)
+	resources := make(map[string][]string)
+	for devType, typeDevices := range devMap {
+		for id, device := range typeDevices {
+			for _, domain := range resourceDomains() {
+				resources[id] = append(resources[id], domain+"/"+devType)
+			}
+			if !isAggregate(devType) && !device.mgmtOnly {
+				specific[id] = cfg().ResourceDomain + "/" + devType
+			}
+		}
+	}
+	inventory := []DeviceInfo{}
+	for _, dev := range devices {
+		health, reasons := checkDeviceHealth(dev)
+		info := DeviceInfo{
+			BDF:       dev.DBDF,
+			VBNV:      dev.vbnv,
+			Shell:     dev.shellVer,
+			Timestamp: dev.timestamp,
+			UUID:      dev.uuid,
+			SN:        dev.SN,
+			Nodes:     *dev.Nodes,
+			Health:    health,
+			Reasons:   reasons,
+			Resource:  specific[dev.DBDF],
+			Resources: resources[dev.DBDF],
+			CardUnit:  isCardUnit(dev) && strings.EqualFold(cfg().U30AllocUnit, "Card") && dev.SN != "" && dev.SN != AWS_SN,
+		}
+		if dev.family != nil {
+			info.Family = dev.family.Name
+		}
+		if dev.SN != AWS_SN {
+			info.Card = dev.SN
+		}
+		// the mgmt resources of a virtual device are keyed by the card
+		if bdf := GetPciBDF(dev.DBDF); bdf != dev.DBDF {
+			info.Resources = append(info.Resources, resources[bdf]...)
+		}
+		sort.Strings(info.Resources)
+		if pods := holdersOf(holders, dev.DBDF); len(pods) != 0 {
+			info.Pods = pods
+		}
+		inventory = append(inventory, info)
+	}
+	sort.Slice(inventory, func(i, j int) bool {
+		return inventory[i].BDF < inventory[j].BDF
+	})
+	return inventory
+}
+
+// printInventory prints the inventory as a table, json or yaml
+func printInventory(w io.Writer, inventory []DeviceInfo, format string) error {
+	switch format {
+	case "json":
+		content, err := json.MarshalIndent(inventory, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(content))
+		return err
+	case "yaml":
+		content, err := yaml.Marshal(inventory)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(content)
+		return err
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "BDF\tFAMILY\tVBNV\tTIMESTAMP\tUUID\tSN\tCARD UNIT\tHEALTH\tRESOURCE\tNODES\tPODS")
+		for _, info := range inventory {
+			health := info.Health
+			if len(info.Reasons) != 0 {
+				health += " (" + strings.Join(info.Reasons, "; ") + ")"
+			}
+			nodes := []string{}
+			for _, node := range []string{info.Nodes.Mgmt, info.Nodes.User, info.Nodes.Qdma} {
+				if node != "" {
+					nodes = append(nodes, node)
+				}
+			}
+			pods := []string{}
+			for _, holder := range info.Pods {
+				pods = append(pods, holder.Namespace+"/"+holder.Pod)
+			}
+			unit := "Device"
+			if info.CardUnit {
+				unit = "Card"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", info.BDF, info.Family, info.VBNV, info.Timestamp,
+				info.UUID, info.SN, unit, health, info.Resource, strings.Join(nodes, ","), strings.Join(pods, ","))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("invalid output format %q, expect table, json or yaml", format)
+}
+
+// loadSubcommandConfig loads and applies the config for a subcommand, it
+// returns the errors of the ignored config files. The subcommands log only
+// warnings and errors at the default info level.
+func loadSubcommandConfig(flags *flag.FlagSet, fname string) ([]error, error) {
+	config, err := loadConfig(fname, flags)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid configuration: %v", err)
+	}
+	if level, _ := log.ParseLevel(config.LogLevel); level == log.InfoLevel {
+		config.LogLevel = log.WarnLevel.String()
+	}
+	return applyConfig(config), nil
+}
+
+// loadNames reads the name customization, if it is on, for the subcommands
+func loadNames() *NameCustomize {
+	if !cfg().DeviceNameCustomize {
+		return nil
+	}
+	content, err := ioutil.ReadFile(cfg().NameCustomizeFile)
+	if err != nil {
+		cliLog.Errorf("Can't read %s, device will be named in default name format: %v", cfg().NameCustomizeFile, err)
+		return nil
+	}
+	names, err := parseNameCustomize(content)
+	if err != nil {
+		cliLog.Errorf("Invalid %s, device will be named in default name format: %v", cfg().NameCustomizeFile, err)
+		return nil
+	}
+	return names
+}
+
+// listHolders lists the containers holding the devices for the inventory,
+// when the kubelet PodResources API is reachable
+func listHolders() map[string][]DeviceHolder {
+	if !cfg().PodResources || !FileExist(PodResourcesSocket) {
+		return nil
+	}
+	holders, err := getDeviceHolders()
+	if err != nil {
+		cliLog.Warnf("Can't list pod resources from %s, the pods are not listed: %v", PodResourcesSocket, err)
+		return nil
+	}
+	return holders
+}
+
+// runList runs device discovery once and prints the inventory, without
+// registering with kubelet
+func runList(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	flagConfig := flags.String("config", "", "Config file, YAML or JSON.")
+	flagOutput := flags.String("output", "table", "Output format: table, json or yaml.")
+	registerConfigFlags(flags)
+	flags.Parse(args)
+
+	if _, err := loadSubcommandConfig(flags, *flagConfig); err != nil {
+		return err
+	}
+	if err := printInventory(ioutil.Discard, nil, *flagOutput); err != nil {
+		return err
+	}
+	devices, err := GetDevices()
+	if err != nil {
+		return fmt.Errorf("Error to get FPGA devices: %v", err)
+	}
+	return printInventory(os.Stdout, getInventory(devices, loadNames(), listHolders()), *flagOutput)
+}
@@ -0,0 +1,204 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"testing"
+)
+
+// touch creates an empty device node in dir and returns its path
+func touch(t *testing.T, dir string, name string) string {
+	fname := path.Join(dir, name)
+	if err := ioutil.WriteFile(fname, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestCheckDeviceHealth(t *testing.T) {
+	root := t.TempDir()
+	defer func(sysfs string) { SysfsDevices = sysfs }(SysfsDevices)
+	SysfsDevices = path.Join(root, "sys")
+	user, mgmt := touch(t, root, "renderD128"), touch(t, root, "xclmgmt1")
+	writeReady := func(bdf string, ready string) {
+		os.MkdirAll(path.Join(SysfsDevices, bdf), 0755)
+		if err := ioutil.WriteFile(path.Join(SysfsDevices, bdf, ReadyFile), []byte(ready), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeReady("0000:3c:00.1", "0x0\n")
+	writeReady("0000:3d:00.1", "garbage")
+
+	tests := []struct {
+		name    string
+		dev     Device
+		reasons []string
+	}{
+		{"healthy", Device{DBDF: "0000:3b:00.1", Healthy: "Healthy", Nodes: &Pairs{User: user, Mgmt: mgmt}}, nil},
+		{"reported unhealthy", Device{DBDF: "0000:3b:00.1", Healthy: "Unhealthy", Nodes: &Pairs{User: user}},
+			[]string{"reported Unhealthy by discovery"}},
+		{"missing nodes", Device{DBDF: "0000:3b:00.1", Healthy: "Healthy", Nodes: &Pairs{User: user + "0", Qdma: mgmt + "0"}},
+			[]string{"device node " + user + "0 is missing", "device node " + mgmt + "0 is missing"}},
+		{"not ready", Device{DBDF: "0000:3c:00.1-1", Healthy: "Healthy", Nodes: &Pairs{User: user, Mgmt: mgmt}},
+			[]string{"driver reports the device not ready"}},
+		// only the devices of the xocl driver report readiness
+		{"ready file without mgmt PF", Device{DBDF: "0000:3c:00.1", Healthy: "Healthy", Nodes: &Pairs{User: user}}, nil},
+		{"unreadable ready file", Device{DBDF: "0000:3d:00.1", Healthy: "Healthy", Nodes: &Pairs{User: user, Mgmt: mgmt}}, nil},
+	}
+	for _, test := range tests {
+		health, reasons := checkDeviceHealth(test.dev)
+		want := "Healthy"
+		if test.reasons != nil {
+			want = "Unhealthy"
+		}
+		if health != want || !reflect.DeepEqual(reasons, test.reasons) {
+			t.Errorf("%s: got %s %q, want %s %q", test.name, health, reasons, want, test.reasons)
+		}
+	}
+}
+
+func TestGetInventory(t *testing.T) {
+	root := t.TempDir()
+	config := defaultConfig()
+	config.LegacyResourceDomain = "xilinx.com"
+	config.MgmtResourcePolicy = map[string]string{"ama_u30": MgmtPolicyDedicated}
+	fpga := &AggregateResource{Name: "fpga"}
+	if err := fpga.compile(); err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, config, fpga)
+
+	u250 := Device{DBDF: "0000:3b:00.1", vbnv: "xilinx_u250_gen3x16_xdma_shell_4_1", shellVer: "xilinx_u250_gen3x16_xdma_shell_4_1",
+		timestamp: "0x1", SN: AWS_SN, Healthy: "Healthy", Nodes: &Pairs{User: touch(t, root, "renderD128")}}
+	u30 := func(id string) Device {
+		return Device{DBDF: id, vbnv: "xilinx_u30_gen3x4_base_2", shellVer: U30CommonShell, timestamp: "0x2", SN: "XFL1U30A",
+			Healthy: "Healthy", family: getShellFamily("xilinx_u30_gen3x4_base_2"),
+			Nodes: &Pairs{User: touch(t, root, "renderD129"), Mgmt: touch(t, root, "xclmgmt2")}}
+	}
+	inventory := getInventory([]Device{u30("0000:82:00.1-1"), u250, u30("0000:82:00.1-0")}, nil, nil)
+
+	want := []DeviceInfo{
+		{
+			BDF: "0000:3b:00.1", VBNV: u250.vbnv, Shell: u250.shellVer, Timestamp: "0x1", SN: AWS_SN, Nodes: *u250.Nodes, Health: "Healthy",
+			Resource:  "amd.com/xilinx_u250_gen3x16_xdma_shell_4_1-0x1",
+			Resources: []string{"amd.com/fpga", "amd.com/xilinx_u250_gen3x16_xdma_shell_4_1-0x1", "xilinx.com/fpga", "xilinx.com/xilinx_u250_gen3x16_xdma_shell_4_1-0x1"},
+		},
+	}
+	for _, id := range []string{"0000:82:00.1-0", "0000:82:00.1-1"} {
+		dev := u30(id)
+		want = append(want, DeviceInfo{
+			BDF: id, Family: U30CommonShell, VBNV: dev.vbnv, Shell: U30CommonShell, Timestamp: "0x2", SN: dev.SN, Nodes: *dev.Nodes, Health: "Healthy",
+			Resource: "amd.com/ama_u30",
+			// the mgmt resource is keyed by the card
+			Resources: []string{"amd.com/ama_u30", "amd.com/ama_u30-mgmt", "amd.com/fpga", "xilinx.com/ama_u30", "xilinx.com/ama_u30-mgmt", "xilinx.com/fpga"},
+			Card:      dev.SN,
+			CardUnit:  true,
+		})
+	}
+	if !reflect.DeepEqual(inventory, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", inventory, want)
+	}
+
+	// the U30 devices are no allocation unit any more
+	config.U30AllocUnit = "Device"
+	for _, info := range getInventory([]Device{u30("0000:82:00.1-0")}, nil, nil) {
+		if info.CardUnit {
+			t.Errorf("device %s is a card unit", info.BDF)
+		}
+	}
+	if inventory := getInventory(nil, nil, nil); inventory == nil || len(inventory) != 0 {
+		t.Errorf("got %v without devices", inventory)
+	}
+}
+
+func TestGetInventoryPods(t *testing.T) {
+	useConfig(t, defaultConfig())
+	worker := DeviceHolder{Namespace: "default", Pod: "worker", Container: "main", Resource: "amd.com/ama_u30"}
+	monitor := DeviceHolder{Namespace: "ops", Pod: "monitor", Container: "main", Resource: "amd.com/ama_u30-mgmt"}
+	// the mgmt resource holds the card by its BDF, the other resources the
+	// devices by ID
+	holders := map[string][]DeviceHolder{
+		"0000:82:00.1-0": {worker},
+		"0000:82:00.1":   {monitor},
+		"0000:99:00.1":   {worker},
+	}
+	devices := []Device{{DBDF: "0000:82:00.1-0", Nodes: &Pairs{}}, {DBDF: "0000:82:00.1-1", Nodes: &Pairs{}}, {DBDF: "0000:3b:00.1", Nodes: &Pairs{}}}
+	pods := make(map[string][]DeviceHolder)
+	for _, info := range getInventory(devices, nil, holders) {
+		pods[info.BDF] = info.Pods
+	}
+	want := map[string][]DeviceHolder{
+		"0000:3b:00.1":   nil,
+		"0000:82:00.1-0": {worker, monitor},
+		"0000:82:00.1-1": {monitor},
+	}
+	if !reflect.DeepEqual(pods, want) {
+		t.Errorf("got %v, want %v", pods, want)
+	}
+}
+
+func TestPrintInventory(t *testing.T) {
+	inventory := []DeviceInfo{
+		{BDF: "0000:3b:00.1", Shell: "xilinx_u250", Nodes: Pairs{User: "/dev/dri/renderD128", Mgmt: "/dev/xclmgmt1"},
+			Health: "Unhealthy", Reasons: []string{"a", "b"}, Resource: "amd.com/u250", CardUnit: true,
+			Pods: []DeviceHolder{{Namespace: "default", Pod: "a", Container: "c"}, {Namespace: "ops", Pod: "b", Container: "c"}}},
+	}
+	for _, format := range []string{"json", "yaml"} {
+		var out bytes.Buffer
+		if err := printInventory(&out, inventory, format); err != nil {
+			t.Fatal(err)
+		}
+		var got []DeviceInfo
+		if err := yaml.Unmarshal(out.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %v\n%s", format, err, out.String())
+		}
+		if !reflect.DeepEqual(got, inventory) {
+			t.Errorf("%s: got %+v", format, got)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := printInventory(&out, inventory, "table"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "BDF ") {
+		t.Fatalf("table:\n%s", out.String())
+	}
+	for _, field := range []string{"Card", "Unhealthy (a; b)", "/dev/xclmgmt1,/dev/dri/renderD128", "default/a,ops/b"} {
+		if !strings.Contains(lines[1], field) {
+			t.Errorf("no %q in %q", field, lines[1])
+		}
+	}
+
+	// an empty inventory is an empty list, not null
+	out.Reset()
+	if err := printInventory(&out, []DeviceInfo{}, "json"); err != nil || strings.TrimSpace(out.String()) != "[]" {
+		t.Errorf("got %q, %v", out.String(), err)
+	}
+	if err := printInventory(&out, nil, "xml"); err == nil {
+		t.Errorf("xml format accepted")
+	}
+}
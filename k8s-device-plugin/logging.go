@@ -0,0 +1,103 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/grpclog"
+)
+
+// The log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// The loggers of the components, every message carries the component field
+// so the log pipeline can filter by component
+var (
+	mainLog      = log.WithField("component", "main")
+	configLog    = log.WithField("component", "config")
+	discoveryLog = log.WithField("component", "discovery")
+	serverLog    = log.WithField("component", "server")
+	namingLog    = log.WithField("component", "naming")
+	ledgerLog    = log.WithField("component", "ledger")
+	podsLog      = log.WithField("component", "pods")
+	cdiLog       = log.WithField("component", "cdi")
+	preloadLog   = log.WithField("component", "preload")
+	resetLog     = log.WithField("component", "reset")
+	commandLog   = log.WithField("component", "command")
+	grpcLog      = log.WithField("component", "grpc")
+	httpLog      = log.WithField("component", "http")
+	cliLog       = log.WithField("component", "cli")
+)
+
+// deviceFields are the fields of the messages about a device, its PCI BDF
+// and the serial number of its card
+func deviceFields(dev Device) log.Fields {
+	return log.Fields{"bdf": GetPciBDF(dev.DBDF), "sn": dev.SN}
+}
+
+// setLogFormat sets the format of every message, text or json
+func setLogFormat(format string) {
+	if format == LogFormatJSON {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{})
+	}
+}
+
+// parseLogLevel checks a log level and returns its canonical name, e.g.
+// warning for warn
+func parseLogLevel(value string) (string, error) {
+	level, err := log.ParseLevel(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid logLevel %q, expect panic, fatal, error, warning, info, debug or trace", value)
+	}
+	return level.String(), nil
+}
+
+// grpcLogger routes the messages of gRPC through the plugin logger, the
+// chatty informational messages of gRPC are logged at debug level
+type grpcLogger struct {
+	*log.Entry
+}
+
+func (l grpcLogger) Info(args ...interface{}) {
+	l.Debug(args...)
+}
+
+func (l grpcLogger) Infoln(args ...interface{}) {
+	l.Debugln(args...)
+}
+
+func (l grpcLogger) Infof(format string, args ...interface{}) {
+	l.Debugf(format, args...)
+}
+
+// V tells whether the verbose messages of the given level are logged
+func (l grpcLogger) V(level int) bool {
+	return level <= 0 || log.IsLevelEnabled(log.TraceLevel)
+}
+
+// setGRPCLogger makes gRPC log through the plugin logger rather than to
+// stderr
+func setGRPCLogger() {
+	grpclog.SetLoggerV2(grpcLogger{grpcLog})
+}
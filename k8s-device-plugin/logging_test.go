@@ -0,0 +1,166 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"testing"
+)
+
+// captureLog sends the messages to a buffer at the given level for the test
+func captureLog(t *testing.T, level log.Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger := log.StandardLogger()
+	out, formatter, saved := logger.Out, logger.Formatter, logger.GetLevel()
+	logger.SetOutput(&buf)
+	logger.SetLevel(level)
+	t.Cleanup(func() {
+		logger.SetOutput(out)
+		logger.SetFormatter(formatter)
+		logger.SetLevel(saved)
+	})
+	return &buf
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := map[string]string{
+		"info":    "info",
+		"DEBUG":   "debug",
+		"warn":    "warning",
+		"warning": "warning",
+		"trace":   "trace",
+		"verbose": "",
+		"":        "",
+	}
+	for value, expect := range tests {
+		level, err := parseLogLevel(value)
+		if expect == "" {
+			if err == nil || !strings.Contains(err.Error(), "invalid logLevel") {
+				t.Errorf("%q: level %q, error %v", value, level, err)
+			}
+			continue
+		}
+		if err != nil || level != expect {
+			t.Errorf("%q: level %q, error %v, expect %q", value, level, err, expect)
+		}
+	}
+}
+
+func TestLogFormatJSON(t *testing.T) {
+	buf := captureLog(t, log.InfoLevel)
+	setLogFormat(LogFormatJSON)
+	dev := Device{DBDF: "0000:3b:00.1-2", SN: "XFL1"}
+	serverLog.WithFields(deviceFields(dev)).WithField("resource", "amd.com/u250").Warnf("Device %s unhealthy", dev.DBDF)
+	discoveryLog.Debugf("not logged at info level")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("%d messages, expect 1:\n%s", len(lines), buf.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("message %q is not JSON: %v", lines[0], err)
+	}
+	expect := map[string]string{
+		"component": "server",
+		"bdf":       "0000:3b:00.1",
+		"sn":        "XFL1",
+		"resource":  "amd.com/u250",
+		"level":     "warning",
+		"msg":       "Device 0000:3b:00.1-2 unhealthy",
+	}
+	for key, value := range expect {
+		if entry[key] != value {
+			t.Errorf("%s is %v, expect %q", key, entry[key], value)
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Errorf("no time in %v", entry)
+	}
+}
+
+func TestLogFormatText(t *testing.T) {
+	buf := captureLog(t, log.InfoLevel)
+	setLogFormat(LogFormatJSON)
+	setLogFormat(LogFormatText)
+	ledgerLog.Printf("Released %s", "0000:3b:00.1")
+	line := buf.String()
+	if strings.HasPrefix(line, "{") || !strings.Contains(line, "component=ledger") || !strings.Contains(line, `msg="Released 0000:3b:00.1"`) {
+		t.Errorf("text message %q", line)
+	}
+}
+
+func TestGRPCLogger(t *testing.T) {
+	buf := captureLog(t, log.InfoLevel)
+	setLogFormat(LogFormatJSON)
+	logger := grpcLogger{grpcLog}
+	logger.Infof("Subchannel %d picks a new address", 1)
+	logger.Info("Channel Connectivity change")
+	logger.Infoln("ccResolverWrapper: sending update")
+	if buf.Len() != 0 {
+		t.Errorf("informational gRPC messages logged at info level:\n%s", buf.String())
+	}
+	logger.Warningf("grpc: addrConn.createTransport failed")
+	if !strings.Contains(buf.String(), `"component":"grpc"`) || !strings.Contains(buf.String(), `"level":"warning"`) {
+		t.Errorf("gRPC warning %q", buf.String())
+	}
+
+	buf.Reset()
+	log.SetLevel(log.DebugLevel)
+	logger.Infof("Subchannel %d picks a new address", 1)
+	if !strings.Contains(buf.String(), `"level":"debug"`) {
+		t.Errorf("informational gRPC message at debug level %q", buf.String())
+	}
+	if !logger.V(0) || logger.V(2) {
+		t.Errorf("verbosity 0 %v and 2 %v at debug level", logger.V(0), logger.V(2))
+	}
+	log.SetLevel(log.TraceLevel)
+	if !logger.V(2) {
+		t.Errorf("verbosity 2 not logged at trace level")
+	}
+}
+
+func TestConfigLogFormat(t *testing.T) {
+	captureLog(t, log.InfoLevel)
+	c := defaultConfig()
+	c.LogFormat = "JSON"
+	c.LogLevel = "Warn"
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.LogFormat != LogFormatJSON || c.LogLevel != "warning" {
+		t.Errorf("logFormat %q and logLevel %q, expect json and warning", c.LogFormat, c.LogLevel)
+	}
+	defer runtimeConfig.Store(cfg())
+	if errs := applyConfig(c); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if cfg().Config != c || log.GetLevel() != log.WarnLevel {
+		t.Errorf("config not in force, log level %s", log.GetLevel())
+	}
+	if _, ok := log.StandardLogger().Formatter.(*log.JSONFormatter); !ok {
+		t.Errorf("formatter %T after applying logFormat json", log.StandardLogger().Formatter)
+	}
+	c.LogFormat = "xml"
+	if err := c.validate(); err == nil || !strings.Contains(err.Error(), "logFormat") {
+		t.Errorf("logFormat xml: error %v", err)
+	}
+}
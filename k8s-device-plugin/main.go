@@ -17,129 +17,229 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"github.com/fsnotify/fsnotify"
-	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 	"os"
-	"strconv"
+	"path"
 	"strings"
 	"syscall"
 )
 
-var (
-	U30NameConvention   = "CommonName"
-	U30AllocUnit        = "Card"
-	DeviceNameCustomize = "False"
-	VirtualDev          = "False"
-	VirtualNum          = 1
-)
-
 func main() {
+	setGRPCLogger()
+	subcommands := map[string]func(args []string) error{
+		"list":     runList,
+		"validate": runValidate,
+	}
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				cliLog.Error(err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	// Parse command-line arguments
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
-	flagLogLevel := flag.String("log-level", "info", "Define the logging level: error, info, debug.")
+	flagConfig := flag.String("config", "", "Config file, YAML or JSON.")
+	flagPrintConfig := flag.Bool("print-config", false, "Print the effective config of the node and exit.")
+	registerConfigFlags(flag.CommandLine)
 	flag.Parse()
 
-	switch *flagLogLevel {
-	case "debug":
-		log.SetLevel(log.DebugLevel)
-	case "info":
-		log.SetLevel(log.InfoLevel)
+	config, err := loadConfig(*flagConfig, flag.CommandLine)
+	if err != nil {
+		mainLog.Errorf("Invalid configuration: %v", err)
+		os.Exit(1)
+	}
+	if *flagPrintConfig {
+		if err := printConfig(config); err != nil {
+			mainLog.Errorf("Can't print the config: %v", err)
+			os.Exit(1)
+		}
+		return
 	}
+	applyConfig(config)
 
 	version_path := "/opt/xilinx/k8s-device-plugin/version_num"
 	if version_file, err := ioutil.ReadFile(version_path); err != nil {
-		log.Println("Can't read version file %s", version_path)
+		mainLog.Printf("Can't read version file %s", version_path)
 	} else {
 		version := strings.Trim(string(version_file), "\n")
-		log.Println("Plugin Version:", version)
+		mainLog.Println("Plugin Version:", version)
 	}
+	logConfig(config)
 
-	ReadNameType := os.Getenv("U30NameConvention")
-	if strings.EqualFold(ReadNameType, "ExactName") {
-		log.Println("Set U30NameConvention: ExactName")
-		U30NameConvention = "ExactName"
-	} else {
-		log.Println("Set U30NameConvention: CommonName")
-		U30NameConvention = "CommonName"
-	}
-	ReadAllocUnitType := os.Getenv("U30AllocUnit")
-	if strings.EqualFold(ReadAllocUnitType, "Device") {
-		log.Println("Set U30AllocUnit: Device")
-		U30AllocUnit = "Device"
-	} else {
-		log.Println("Set U30AllocUnit: Card")
-		U30AllocUnit = "Card"
-	}
-	ReadDeviceNameCustomize := os.Getenv("DeviceNameCustomize")
-	if strings.EqualFold(ReadDeviceNameCustomize, "True") {
-		log.Println("Set DeviceNameCustomize: True")
-		DeviceNameCustomize = "True"
-	} else {
-		log.Println("Set DeviceNameCustomize: False")
-		DeviceNameCustomize = "False"
-	}
-
-	ReadVirtualDev := os.Getenv("VirtualDev")
-	if strings.EqualFold(ReadVirtualDev, "True") {
-		log.Println("Virtual Device Mode: On")
-		VirtualDev = "True"
-	} else {
-		log.Println("Virtual Device Mode: OFF")
-		VirtualDev = "False"
-	}
-	ReadVirtualNum := os.Getenv("VirtualNum")
-	VirtualNum, _ = strconv.Atoi(ReadVirtualNum)
-	if VirtualNum < 1 {
-		log.Warn("Invalid input for VirtualNum, will set VirtualNum as 1")
-		VirtualNum = 1
-	}
-	log.Println("VirtualNum:", VirtualNum)
-
-	log.Println("Starting FS watcher.")
+	mainLog.Println("Starting FS watcher.")
 	watcher, err := newFSWatcher(pluginapi.DevicePluginPath)
 	if err != nil {
-		log.Printf("Failed to created FS watcher: %s.", err)
+		mainLog.Printf("Failed to created FS watcher: %s.", err)
 		os.Exit(1)
 	}
 	defer watcher.Close()
 
-	log.Println("Starting OS watcher.")
+	configWatcher := watchNameCustomize()
+	defer func() {
+		if configWatcher != nil {
+			configWatcher.Close()
+		}
+	}()
+
+	mainLog.Println("Starting OS watcher.")
 	sigs := newOSWatcher(syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
-	restart := true
-	var devicePlugin *FPGADevicePlugin
-L:
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// keep track of the pods holding each device, and of the resource holding
+	// it when the devices are shared by the resources of both domains and by
+	// the aggregate resources
+	go podMap.run(ctx)
+
+	devicePlugin := NewFPGADevicePlugin(ctx)
+	metrics.collector(devicePlugin.collectTelemetry)
+	metrics.collector(devicePlugin.collectPods)
+	metrics.collector(podUsage.collectUsage)
+	if cfg().MetricsAddress != "" {
+		startHTTPServer(ctx, cfg().MetricsAddress, devicePlugin)
+	}
+	metricsAddress := cfg().MetricsAddress
+	updates := devicePlugin.updateChan
 	for {
-		if restart {
-			devicePlugin = NewFPGADevicePlugin()
-			restart = false
+		var configEvents chan fsnotify.Event
+		var configErrors chan error
+		if configWatcher != nil {
+			configEvents = configWatcher.Events
+			configErrors = configWatcher.Errors
 		}
 
 		select {
-		case update := <-devicePlugin.updateChan:
+		case update, ok := <-updates:
+			if !ok {
+				mainLog.Errorf("Device scan stopped, the devices are no longer updated")
+				updates = nil
+				continue
+			}
 			devicePlugin.checkDeviceUpdate(update)
 
 		case event := <-watcher.Events:
 			if event.Name == pluginapi.KubeletSocket && event.Op&fsnotify.Create == fsnotify.Create {
-				log.Printf("inotify: %s created, restarting.", pluginapi.KubeletSocket)
-				restart = true
+				mainLog.Printf("inotify: %s created, registering again.", pluginapi.KubeletSocket)
+				devicePlugin.restartServers()
 			}
 
 		case err := <-watcher.Errors:
-			log.Printf("inotify: %s", err)
+			mainLog.Printf("inotify: %s", err)
+
+		case event := <-configEvents:
+			mainLog.Debugf("inotify: %s %s", event.Name, event.Op)
+			devicePlugin.reloadNameCustomize()
+
+		case err := <-configErrors:
+			mainLog.Printf("inotify: %s", err)
 
 		case s := <-sigs:
 			switch s {
 			case syscall.SIGHUP:
-				log.Println("Received SIGHUP, restarting.")
-				restart = true
+				mainLog.Println("Received SIGHUP, reloading.")
+				newConfig, err := loadConfig(*flagConfig, flag.CommandLine)
+				if err != nil {
+					mainLog.Errorf("Invalid configuration, keep the previous one: %v", err)
+					continue
+				}
+				applyConfig(newConfig)
+				logConfig(newConfig)
+				if cfg().MetricsAddress != metricsAddress {
+					mainLog.Warnf("metricsAddress changed from %q to %q, restart the plugin to apply it", metricsAddress, cfg().MetricsAddress)
+				}
+				if configWatcher != nil {
+					configWatcher.Close()
+				}
+				configWatcher = watchNameCustomize()
+				devicePlugin.reload()
 			default:
-				log.Printf("Received signal \"%v\", shutting down.", s)
-				break L
+				mainLog.Printf("Received signal \"%v\", shutting down.", s)
+				devicePlugin.Stop()
+				return
 			}
 		}
 	}
 }
+
+// loadConfigFiles reads the shell families, xclbin preloads and aggregate
+// resources from the files of the config. An invalid file is ignored, its
+// error is logged and returned.
+func loadConfigFiles(c *Config) (*RuntimeConfig, []error) {
+	errs := []error{}
+	rc := &RuntimeConfig{
+		Config:             c,
+		ShellFamilies:      []*ShellFamily{},
+		XclbinPreloads:     make(map[string]*XclbinPreload),
+		AggregateResources: []*AggregateResource{},
+	}
+	if FileExist(c.ShellFamilyFile) {
+		if families, err := loadShellFamilies(c.ShellFamilyFile); err != nil {
+			configLog.Errorf("Invalid shell family file, only the builtin shell families are used: %v", err)
+			errs = append(errs, err)
+		} else {
+			rc.ShellFamilies = families
+		}
+	}
+	rc.ShellFamilies = append(rc.ShellFamilies, builtinShellFamilies(c)...)
+	for _, family := range rc.ShellFamilies {
+		configLog.Printf("Shell family %s: match %s, rename %v, timestamp %v, card %v", family.Name, family.Match, family.Rename, family.withTimestamp(), family.Card)
+	}
+
+	if FileExist(c.XclbinPreloadFile) {
+		if preloads, err := loadXclbinPreloads(c.XclbinPreloadFile); err != nil {
+			configLog.Errorf("Invalid xclbin preload file, no xclbin will be preloaded: %v", err)
+			errs = append(errs, err)
+		} else {
+			rc.XclbinPreloads = preloads
+		}
+	}
+	for resource, preload := range rc.XclbinPreloads {
+		configLog.WithField("resource", resource).Printf("Preload xclbin %s", path.Join(c.XclbinCacheDir, preload.Xclbin))
+	}
+
+	if FileExist(c.AggregateResourceFile) {
+		if aggregates, err := loadAggregateResources(c.AggregateResourceFile); err != nil {
+			configLog.Errorf("Invalid aggregate resource file, no aggregate resource will be registered: %v", err)
+			errs = append(errs, err)
+		} else if len(aggregates) != 0 && !c.PodResources {
+			// the devices taken through an aggregate are only released when
+			// the pod resources report them free
+			err := fmt.Errorf("%s: aggregate resources require podResources", c.AggregateResourceFile)
+			configLog.Errorf("No aggregate resource will be registered: %v", err)
+			errs = append(errs, err)
+		} else {
+			rc.AggregateResources = aggregates
+		}
+	}
+	for _, aggregate := range rc.AggregateResources {
+		configLog.WithField("resource", c.ResourceDomain+"/"+aggregate.Name).Printf("Aggregate resource matching %v", aggregate.Match)
+	}
+	return rc, errs
+}
+
+// watchNameCustomize watches the directory of the name customization file,
+// it returns nil if the name customization is off or can't be watched. The
+// configmap is mounted as a directory with a ..data symlink which is swapped
+// on update, so the directory is watched rather than the file.
+func watchNameCustomize() *fsnotify.Watcher {
+	if !cfg().DeviceNameCustomize {
+		return nil
+	}
+	mainLog.Println("Starting config watcher.")
+	configWatcher, err := newFSWatcher(path.Dir(cfg().NameCustomizeFile))
+	if err != nil {
+		mainLog.Warnf("Failed to created config watcher, changes of %s need a reload: %s.", cfg().NameCustomizeFile, err)
+		return nil
+	}
+	return configWatcher
+}
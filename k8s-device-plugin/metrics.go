@@ -0,0 +1,222 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics of the plugin
+const (
+	metricDevices              = "amd_fpga_plugin_devices"
+	metricAllocations          = "amd_fpga_plugin_allocations_total"
+	metricAllocateErrors       = "amd_fpga_plugin_allocate_errors_total"
+	metricStreams              = "amd_fpga_plugin_list_and_watch_streams"
+	metricSends                = "amd_fpga_plugin_list_and_watch_sends_total"
+	metricDiscoveryDuration    = "amd_fpga_plugin_discovery_duration_seconds"
+	metricDiscoveryScans       = "amd_fpga_plugin_discovery_scans_total"
+	metricDiscoveryErrors      = "amd_fpga_plugin_discovery_errors_total"
+	metricRegistrations        = "amd_fpga_plugin_registrations_total"
+	metricRegistrationFailures = "amd_fpga_plugin_registration_failures_total"
+	metricCardTemperature      = "amd_fpga_card_temperature_celsius"
+	metricCardPower            = "amd_fpga_card_power_watts"
+	metricCardVoltage          = "amd_fpga_card_voltage_volts"
+	metricCardCurrent          = "amd_fpga_card_current_amperes"
+	metricCardFan              = "amd_fpga_card_fan_rpm"
+	metricCUUsage              = "amd_fpga_cu_usage_total"
+	metricCUStatus             = "amd_fpga_cu_status"
+	metricXclbin               = "amd_fpga_xclbin_info"
+)
+
+// metricFamily is a metric with its values by label set
+type metricFamily struct {
+	kind string
+	help string
+	// values are keyed by the rendered label set, e.g. {resource="amd.com/u250"}
+	values map[string]float64
+}
+
+// metricRegistry keeps the metrics and writes them in the Prometheus text
+// exposition format
+type metricRegistry struct {
+	lock     sync.Mutex
+	families map[string]*metricFamily
+	// collectors set the metrics which are read on scrape
+	collectors []func()
+}
+
+var metrics = newMetricRegistry()
+
+func newMetricRegistry() *metricRegistry {
+	r := &metricRegistry{families: make(map[string]*metricFamily)}
+	r.describe(metricDevices, "gauge", "Devices per resource by health.")
+	r.describe(metricAllocations, "counter", "Successful Allocate calls per resource.")
+	r.describe(metricAllocateErrors, "counter", "Failed Allocate calls per resource.")
+	r.describe(metricStreams, "gauge", "Open ListAndWatch streams per resource.")
+	r.describe(metricSends, "counter", "Device lists sent on the ListAndWatch streams per resource.")
+	r.describe(metricDiscoveryDuration, "gauge", "Duration of the last device discovery per backend.")
+	r.describe(metricDiscoveryScans, "counter", "Device discoveries per backend.")
+	r.describe(metricDiscoveryErrors, "counter", "Failed device discoveries per backend.")
+	r.describe(metricRegistrations, "counter", "Registration attempts with kubelet per resource.")
+	r.describe(metricRegistrationFailures, "counter", "Failed registrations with kubelet per resource.")
+	r.describe(metricCardTemperature, "gauge", "Temperature of a card sensor.")
+	r.describe(metricCardPower, "gauge", "Power draw of a card.")
+	r.describe(metricCardVoltage, "gauge", "Voltage of a card rail.")
+	r.describe(metricCardCurrent, "gauge", "Current of a card rail.")
+	r.describe(metricCardFan, "gauge", "Fan speed of a card.")
+	r.describe(metricCUUsage, "counter", "Commands completed by a compute unit since the xclbin was loaded.")
+	r.describe(metricCUStatus, "gauge", "Control register of a compute unit: 1 start, 2 done, 4 idle, 8 ready.")
+	r.describe(metricXclbin, "gauge", "The xclbin loaded on a device, by UUID.")
+	r.describe(metricDevicePod, "gauge", "A container holding a device, according to kubelet.")
+	r.describe(metricPodDeviceSeconds, "counter", "Time a pod held the devices of a resource, summed over the devices.")
+	return r
+}
+
+// describe adds a metric, kind is counter or gauge
+func (r *metricRegistry) describe(name string, kind string, help string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.families[name] = &metricFamily{kind: kind, help: help, values: make(map[string]float64)}
+}
+
+// collector adds a function setting metrics on every scrape
+func (r *metricRegistry) collector(collect func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.collectors = append(r.collectors, collect)
+}
+
+// collect runs the collectors
+func (r *metricRegistry) collect() {
+	r.lock.Lock()
+	collectors := r.collectors
+	r.lock.Unlock()
+	for _, collect := range collectors {
+		collect()
+	}
+}
+
+// metricLabels renders the label set of name and value pairs
+func metricLabels(labels ...string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escaper.Replace(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// add adds the value to the metric with the label set of name and value pairs
+func (r *metricRegistry) add(name string, value float64, labels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.families[name].values[metricLabels(labels...)] += value
+}
+
+// set sets the metric with the label set of name and value pairs
+func (r *metricRegistry) set(name string, value float64, labels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.families[name].values[metricLabels(labels...)] = value
+}
+
+// reset removes every value of the metric, before the values of a gauge are
+// set again
+func (r *metricRegistry) reset(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.families[name].values = make(map[string]float64)
+}
+
+// write writes the metrics in the text exposition format, sorted by name and
+// label set
+func (r *metricRegistry) write(w io.Writer) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	names := []string{}
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := r.families[name]
+		if len(family.values) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, family.help, name, family.kind)
+		labels := []string{}
+		for label := range family.values {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			value := strconv.FormatFloat(family.values[label], 'g', -1, 64)
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", name, label, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// countDiscovery times a discovery backend and counts its errors
+func countDiscovery(backend string, discover func() ([]Device, error)) ([]Device, error) {
+	start := time.Now()
+	devices, err := discover()
+	metrics.set(metricDiscoveryDuration, time.Since(start).Seconds(), "backend", backend)
+	metrics.add(metricDiscoveryScans, 1, "backend", backend)
+	if err != nil {
+		metrics.add(metricDiscoveryErrors, 1, "backend", backend)
+	}
+	return devices, err
+}
+
+// updateDeviceMetrics counts the devices of every resource by health
+func (m *FPGADevicePlugin) updateDeviceMetrics() {
+	metrics.reset(metricDevices)
+	for devType, devices := range m.devices {
+		for _, domain := range resourceDomains() {
+			for _, health := range []string{pluginapi.Healthy, pluginapi.Unhealthy} {
+				metrics.set(metricDevices, 0, "resource", domain+"/"+devType, "health", health)
+			}
+			for _, device := range devices {
+				metrics.add(metricDevices, 1, "resource", domain+"/"+devType, "health", device.Healthy)
+			}
+		}
+	}
+}
+
+// serveMetrics writes the metrics in the text exposition format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.collect()
+	if err := metrics.write(w); err != nil {
+		httpLog.Debugf("Can't write the metrics: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// useMetrics replaces the metrics with an empty registry for the test
+func useMetrics(t *testing.T) *metricRegistry {
+	saved := metrics
+	metrics = newMetricRegistry()
+	t.Cleanup(func() { metrics = saved })
+	return metrics
+}
+
+// metricsText writes the registry in the text exposition format
+func metricsText(t *testing.T, r *metricRegistry) string {
+	t.Helper()
+	var b strings.Builder
+	if err := r.write(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestMetricLabels(t *testing.T) {
+	tests := []struct {
+		labels []string
+		expect string
+	}{
+		{nil, ""},
+		{[]string{"resource", "amd.com/u250"}, `{resource="amd.com/u250"}`},
+		{[]string{"resource", "a", "health", "Healthy"}, `{resource="a",health="Healthy"}`},
+		{[]string{"name", `C:\dir "x"` + "\nend"}, `{name="C:\\dir \"x\"\nend"}`},
+		// a name without value is dropped
+		{[]string{"resource", "a", "health"}, `{resource="a"}`},
+	}
+	for _, tt := range tests {
+		if got := metricLabels(tt.labels...); got != tt.expect {
+			t.Errorf("%q: labels %s, expect %s", tt.labels, got, tt.expect)
+		}
+	}
+}
+
+func TestMetricRegistryWrite(t *testing.T) {
+	r := newMetricRegistry()
+	if text := metricsText(t, r); text != "" {
+		t.Errorf("metrics without values are written:\n%s", text)
+	}
+	r.add(metricAllocations, 1, "resource", "amd.com/u250")
+	r.add(metricAllocations, 2, "resource", "amd.com/u250")
+	r.add(metricAllocations, 1, "resource", "amd.com/u200")
+	r.set(metricDiscoveryDuration, 0.25, "backend", "alveo")
+	r.set(metricDiscoveryDuration, 1.5, "backend", "alveo")
+	r.add(metricStreams, 1, "resource", "amd.com/u250")
+	r.add(metricStreams, -1, "resource", "amd.com/u250")
+	expect := `# HELP amd_fpga_plugin_allocations_total Successful Allocate calls per resource.
+# TYPE amd_fpga_plugin_allocations_total counter
+amd_fpga_plugin_allocations_total{resource="amd.com/u200"} 1
+amd_fpga_plugin_allocations_total{resource="amd.com/u250"} 3
+# HELP amd_fpga_plugin_discovery_duration_seconds Duration of the last device discovery per backend.
+# TYPE amd_fpga_plugin_discovery_duration_seconds gauge
+amd_fpga_plugin_discovery_duration_seconds{backend="alveo"} 1.5
+# HELP amd_fpga_plugin_list_and_watch_streams Open ListAndWatch streams per resource.
+# TYPE amd_fpga_plugin_list_and_watch_streams gauge
+amd_fpga_plugin_list_and_watch_streams{resource="amd.com/u250"} 0
+`
+	if text := metricsText(t, r); text != expect {
+		t.Errorf("metrics\n%s\nexpect\n%s", text, expect)
+	}
+
+	r.reset(metricAllocations)
+	if text := metricsText(t, r); strings.Contains(text, metricAllocations) {
+		t.Errorf("reset metric is written:\n%s", text)
+	}
+}
+
+func TestCountDiscovery(t *testing.T) {
+	r := useMetrics(t)
+	found := []Device{{DBDF: "0000:3b:00.1"}}
+	devices, err := countDiscovery("alveo", func() ([]Device, error) { return found, nil })
+	if err != nil || len(devices) != 1 {
+		t.Fatalf("devices %v, error %v", devices, err)
+	}
+	failure := errors.New("no sysfs")
+	if _, err := countDiscovery("alveo", func() ([]Device, error) { return nil, failure }); err != failure {
+		t.Errorf("error %v, expect %v", err, failure)
+	}
+	countDiscovery("ama", func() ([]Device, error) { return nil, nil })
+	text := metricsText(t, r)
+	for _, line := range []string{
+		`amd_fpga_plugin_discovery_scans_total{backend="alveo"} 2`,
+		`amd_fpga_plugin_discovery_errors_total{backend="alveo"} 1`,
+		`amd_fpga_plugin_discovery_scans_total{backend="ama"} 1`,
+		`amd_fpga_plugin_discovery_duration_seconds{backend="ama"} `,
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("no %s in\n%s", line, text)
+		}
+	}
+	if strings.Contains(text, `errors_total{backend="ama"}`) {
+		t.Errorf("errors counted for a successful discovery:\n%s", text)
+	}
+}
+
+func TestUpdateDeviceMetrics(t *testing.T) {
+	r := useMetrics(t)
+	c := defaultConfig()
+	c.LegacyResourceDomain = "xilinx.com"
+	useConfig(t, c)
+	m := &FPGADevicePlugin{devices: map[string]map[string]Device{
+		"u250": {
+			"0000:3b:00.1": {Healthy: "Healthy"},
+			"0000:3c:00.1": {Healthy: "Unhealthy"},
+			"0000:3d:00.1": {Healthy: "Healthy"},
+		},
+	}}
+	m.updateDeviceMetrics()
+	text := metricsText(t, r)
+	for _, line := range []string{
+		`amd_fpga_plugin_devices{resource="amd.com/u250",health="Healthy"} 2`,
+		`amd_fpga_plugin_devices{resource="amd.com/u250",health="Unhealthy"} 1`,
+		`amd_fpga_plugin_devices{resource="xilinx.com/u250",health="Healthy"} 2`,
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("no %s in\n%s", line, text)
+		}
+	}
+
+	// a resource without devices is no longer reported, and a resource
+	// without unhealthy devices reports 0
+	m.devices = map[string]map[string]Device{"u30": {"0000:3e:00.1": {Healthy: "Healthy"}}}
+	m.updateDeviceMetrics()
+	text = metricsText(t, r)
+	if strings.Contains(text, "u250") {
+		t.Errorf("removed resource is reported:\n%s", text)
+	}
+	if !strings.Contains(text, `amd_fpga_plugin_devices{resource="amd.com/u30",health="Unhealthy"} 0`) {
+		t.Errorf("no unhealthy count of 0 in\n%s", text)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	r := useMetrics(t)
+	r.add(metricRegistrations, 1, "resource", "amd.com/u250")
+	collected := 0
+	r.collector(func() {
+		collected++
+		r.set(metricStreams, float64(collected), "resource", "amd.com/u250")
+	})
+
+	for scrape := 1; scrape <= 2; scrape++ {
+		w := httptest.NewRecorder()
+		serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+			t.Errorf("content type %q", w.Header().Get("Content-Type"))
+		}
+		body := w.Body.String()
+		for _, line := range []string{
+			`amd_fpga_plugin_registrations_total{resource="amd.com/u250"} 1`,
+			`amd_fpga_plugin_list_and_watch_streams{resource="amd.com/u250"} ` + strconv.Itoa(scrape),
+		} {
+			if !strings.Contains(body, line+"\n") {
+				t.Errorf("scrape %d: no %s in\n%s", scrape, line, body)
+			}
+		}
+	}
+}
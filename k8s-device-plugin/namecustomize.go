@@ -0,0 +1,402 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// NameCustomize is the device name customization of NameCustomize.json. It
+// is an ordered list of rules, the first rule matching a device names it:
+//
+//	{
+//	    "rules": [
+//	        {
+//	            "name": "u250-prod",
+//	            "match": {"type": "u250", "shell": "xilinx_u250_gen3x16_*", "sn": "re:XFL1[0-9A-Z]+"},
+//	            "template": "{{.Type}}-{{.Shell | trimPrefix \"xilinx_\"}}"
+//	        }
+//	    ]
+//	}
+//
+// The legacy format maps "<type>-<shell>-<timestamp or uuid>" keys to names,
+// it is converted to rules in the sorted order of the keys. Name templates
+// are described in naming.go.
+type NameCustomize struct {
+	rules []*NameRule
+
+	lock sync.Mutex
+	// reported are the naming errors and rules logged per device
+	reported map[string]string
+}
+
+// NameRule names the devices matching all its matchers
+type NameRule struct {
+	Name     string            `json:"name"`
+	Match    map[string]string `json:"match"`
+	Template string            `json:"template"`
+
+	matchers map[string]*nameMatcher
+	tmpl     *template.Template
+	// legacy rules are converted from the legacy format, their template may
+	// be a legacy name expression
+	legacy bool
+}
+
+// nameMatcher matches a device attribute against a case insensitive glob
+// pattern, or a regular expression prefixed with "re:". Both have to match
+// the whole value.
+type nameMatcher struct {
+	glob   string
+	regexp *regexp.Regexp
+}
+
+// nameMatchAttributes are the device attributes a rule can match
+var nameMatchAttributes = map[string]func(device Device) string{
+	"type":      func(device Device) string { return device.deviceType },
+	"shell":     func(device Device) string { return device.shellVer },
+	"uuid":      func(device Device) string { return device.uuid },
+	"timestamp": func(device Device) string { return device.timestamp },
+	"vendor":    func(device Device) string { return device.vendorID },
+	"device":    func(device Device) string { return device.deviceID },
+	"sn":        func(device Device) string { return device.SN },
+	"bdf":       func(device Device) string { return device.DBDF },
+}
+
+func newNameMatcher(pattern string) (*nameMatcher, error) {
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(pattern, "re:") + ")$")
+		if err != nil {
+			return nil, err
+		}
+		return &nameMatcher{regexp: re}, nil
+	}
+	glob := strings.ToLower(pattern)
+	if _, err := filepath.Match(glob, ""); err != nil {
+		return nil, err
+	}
+	return &nameMatcher{glob: glob}, nil
+}
+
+func (m *nameMatcher) match(value string) bool {
+	if m.regexp != nil {
+		return m.regexp.MatchString(value)
+	}
+	ok, _ := filepath.Match(m.glob, strings.ToLower(value))
+	return ok
+}
+
+// compile checks the rule and prepares its matchers and template
+func (r *NameRule) compile() error {
+	if r.Template == "" {
+		return fmt.Errorf("no template")
+	}
+	r.matchers = make(map[string]*nameMatcher)
+	for attr, pattern := range r.Match {
+		if _, ok := nameMatchAttributes[attr]; !ok {
+			return fmt.Errorf("unknown match attribute %q", attr)
+		}
+		matcher, err := newNameMatcher(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q of %s: %v", pattern, attr, err)
+		}
+		r.matchers[attr] = matcher
+	}
+	tmpl, err := parseNameTemplate(r.Name, r.Template, r.legacy)
+	if err != nil {
+		return fmt.Errorf("invalid template %q: %v", r.Template, err)
+	}
+	r.tmpl = tmpl
+	return nil
+}
+
+func (r *NameRule) matches(device Device) bool {
+	for attr, matcher := range r.matchers {
+		if !matcher.match(nameMatchAttributes[attr](device)) {
+			return false
+		}
+	}
+	return true
+}
+
+// convertLegacyKeys converts the legacy "<type>-<shell>-<timestamp or uuid>"
+// keys to rules. Type, timestamp and uuid have no dashes, so the shell is
+// everything between the first and the last dash. A 6 character id is tried
+// as uuid before as timestamp, like before.
+func convertLegacyKeys(names map[string]string) ([]*NameRule, error) {
+	keys := []string{}
+	for key := range names {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	rules := []*NameRule{}
+	for _, key := range keys {
+		first, last := strings.Index(key, "-"), strings.LastIndex(key, "-")
+		if first < 0 || first == last {
+			return nil, fmt.Errorf("invalid key %q, expect <type>-<shell>-<timestamp or uuid>", key)
+		}
+		devType, shell, id := key[:first], key[first+1:last], key[last+1:]
+		// the legacy keys compare exactly, except for "*"
+		for _, value := range []*string{&devType, &shell, &id} {
+			if *value != "*" {
+				*value = "re:(?i)" + regexp.QuoteMeta(*value)
+			}
+		}
+		if len(key[last+1:]) == 6 {
+			rules = append(rules, &NameRule{
+				Name:     key,
+				Match:    map[string]string{"type": devType, "shell": shell, "uuid": id},
+				Template: names[key],
+				legacy:   true,
+			})
+		}
+		rules = append(rules, &NameRule{
+			Name:     key,
+			Match:    map[string]string{"type": devType, "shell": shell, "timestamp": id},
+			Template: names[key],
+			legacy:   true,
+		})
+	}
+	return rules, nil
+}
+
+// parseNameCustomize parses and validates the content of NameCustomize.json
+func parseNameCustomize(content []byte) (*NameCustomize, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("invalid json: %v", err)
+	}
+	rules := []*NameRule{}
+	if _, ok := raw["rules"]; ok {
+		var config struct {
+			Rules []*NameRule `json:"rules"`
+		}
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("invalid rules: %v", err)
+		}
+		rules = config.Rules
+	} else {
+		var names map[string]string
+		if err := json.Unmarshal(content, &names); err != nil {
+			return nil, fmt.Errorf("invalid json: %v", err)
+		}
+		legacy, err := convertLegacyKeys(names)
+		if err != nil {
+			return nil, err
+		}
+		rules = legacy
+	}
+	for i, rule := range rules {
+		if rule == nil {
+			return nil, fmt.Errorf("rule %d is empty", i)
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i)
+		}
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", rule.Name, err)
+		}
+	}
+	return &NameCustomize{
+		rules:    rules,
+		reported: make(map[string]string),
+	}, nil
+}
+
+// getRule returns the first rule matching the device, or nil
+func (n *NameCustomize) getRule(device Device) *NameRule {
+	if n == nil {
+		return nil
+	}
+	for _, rule := range n.rules {
+		if rule.matches(device) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// getName returns the customized name of the device and the rule naming it,
+// or "" if no rule matches
+func (n *NameCustomize) getName(device Device) (string, *NameRule, error) {
+	rule := n.getRule(device)
+	if rule == nil {
+		return "", nil, nil
+	}
+	name, err := renderName(rule.tmpl, device)
+	if err != nil {
+		return "", rule, fmt.Errorf("rule %q: %v", rule.Name, err)
+	}
+	return name, rule, nil
+}
+
+// validate names every device, it returns the errors per device
+func (n *NameCustomize) validate(devices []Device) []error {
+	errs := []error{}
+	for _, device := range devices {
+		if device.family.namesResource() {
+			continue
+		}
+		if _, _, err := n.getName(device); err != nil {
+			errs = append(errs, fmt.Errorf("device %s: %v", device.DBDF, err))
+		}
+	}
+	return errs
+}
+
+// report logs which rule named a device, or the naming error, once rather
+// than on every scan
+func (n *NameCustomize) report(device Device, name string, rule *NameRule, err error) {
+	msg := "-"
+	if err != nil {
+		msg = err.Error()
+	} else if rule != nil {
+		msg = rule.Name + "=" + name
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.reported[device.DBDF] == msg {
+		return
+	}
+	n.reported[device.DBDF] = msg
+	if err != nil {
+		namingLog.WithFields(deviceFields(device)).Errorf("Can't name device %s, it will be registered in default name format: %v", device.DBDF, err)
+	} else if rule != nil {
+		namingLog.WithFields(deviceFields(device)).Printf("Device %s is named %s by rule %q", device.DBDF, name, rule.Name)
+	} else {
+		namingLog.WithFields(deviceFields(device)).Printf("No rule matches device %s, it will be registered in default name format", device.DBDF)
+	}
+}
+
+// getDSAtype returns the device type of the device, which is the resource
+// name without prefix the device is registered under. A family renaming its
+// shells, e.g. ama_u30, comes first, then the name customization, then the
+// shell family decides whether the timestamp is part of the name.
+func getDSAtype(device Device, names *NameCustomize) string {
+	if cfg().DeviceNameCustomize && !device.family.namesResource() {
+		DSAtype, rule, err := names.getName(device)
+		if names != nil {
+			names.report(device, DSAtype, rule, err)
+		}
+		if err == nil && DSAtype != "" {
+			return DSAtype
+		}
+	}
+	return defaultDSAtype(device)
+}
+
+// defaultDSAtype returns the device type of the device in default name
+// format, the shell with the timestamp unless the shell family drops it
+func defaultDSAtype(device Device) string {
+	if !device.family.withTimestamp() {
+		return device.shellVer
+	}
+	return device.shellVer + "-" + device.timestamp
+}
+
+// validateNames checks the name customization names every device, it logs
+// the errors and returns an error if any device can't be named
+func validateNames(names *NameCustomize, devices []Device) error {
+	errs := names.validate(devices)
+	for _, e := range errs {
+		namingLog.Errorf("%s: %v", cfg().NameCustomizeFile, e)
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%d device(s) can't be named", len(errs))
+	}
+	return nil
+}
+
+// checkPendingNames validates the name customization loaded before the first
+// scan against the scanned devices, it is rejected like on a reload if any
+// device can't be named. The caller holds nameLock.
+func (m *FPGADevicePlugin) checkPendingNames() {
+	if !m.namesPending {
+		return
+	}
+	m.namesPending = false
+	if err := validateNames(m.names, m.scanned); err != nil {
+		namingLog.Errorf("Rejected %s, device will be registered in default name format: %v", cfg().NameCustomizeFile, err)
+		m.rejectedContent = m.namesContent
+		m.names = nil
+		m.namesContent = nil
+	}
+}
+
+// reloadNameCustomize reads NameCustomize.json again. A valid change takes
+// effect with an immediate device scan, which re-maps the devices and starts
+// or stops the resource servers as needed. An invalid file is rejected and
+// the name customization in force stays until the file changes. A file
+// loaded before the first scan is validated against the first scan.
+func (m *FPGADevicePlugin) reloadNameCustomize() {
+	m.nameLock.Lock()
+	hadNames := m.names != nil
+	m.nameLock.Unlock()
+	content, err := ioutil.ReadFile(cfg().NameCustomizeFile)
+	if err != nil {
+		if !hadNames {
+			namingLog.Errorf("Can't read %s, device will be registered in default name format: %v", cfg().NameCustomizeFile, err)
+		} else {
+			namingLog.Errorf("Can't read %s, keep the previous name customization: %v", cfg().NameCustomizeFile, err)
+		}
+		return
+	}
+	m.nameLock.Lock()
+	unchanged := (m.names != nil && bytes.Equal(content, m.namesContent)) ||
+		(m.rejectedContent != nil && bytes.Equal(content, m.rejectedContent))
+	m.nameLock.Unlock()
+	if unchanged {
+		return
+	}
+	names, err := parseNameCustomize(content)
+	m.nameLock.Lock()
+	defer m.nameLock.Unlock()
+	if err == nil && m.scannedOnce {
+		err = validateNames(names, m.scanned)
+	}
+	if err != nil {
+		if m.names == nil {
+			namingLog.Errorf("Rejected %s, device will be registered in default name format: %v", cfg().NameCustomizeFile, err)
+		} else {
+			namingLog.Errorf("Rejected %s, keep the previous name customization: %v", cfg().NameCustomizeFile, err)
+		}
+		m.rejectedContent = content
+		return
+	}
+	m.rejectedContent = nil
+	m.names = names
+	m.namesContent = content
+	m.namesPending = !m.scannedOnce
+	namingLog.Printf("Loaded name customization %s", cfg().NameCustomizeFile)
+
+	select {
+	case m.rescan <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConvertLegacyKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		names map[string]string
+		// want are the rule names and matches in order
+		want []NameRule
+		err  string
+	}{
+		{
+			name:  "timestamp",
+			names: map[string]string{"u250-xilinx_u250_gen3x16_xdma_shell_4_1-202210_1": "'u250'"},
+			want: []NameRule{{
+				Name:     "u250-xilinx_u250_gen3x16_xdma_shell_4_1-202210_1",
+				Match:    map[string]string{"type": "re:(?i)u250", "shell": "re:(?i)xilinx_u250_gen3x16_xdma_shell_4_1", "timestamp": "re:(?i)202210_1"},
+				Template: "'u250'",
+			}},
+		},
+		{
+			name:  "6 character id is tried as uuid first",
+			names: map[string]string{"u280-xilinx_u280-abc123": "'u280'"},
+			want: []NameRule{
+				{
+					Name:     "u280-xilinx_u280-abc123",
+					Match:    map[string]string{"type": "re:(?i)u280", "shell": "re:(?i)xilinx_u280", "uuid": "re:(?i)abc123"},
+					Template: "'u280'",
+				},
+				{
+					Name:     "u280-xilinx_u280-abc123",
+					Match:    map[string]string{"type": "re:(?i)u280", "shell": "re:(?i)xilinx_u280", "timestamp": "re:(?i)abc123"},
+					Template: "'u280'",
+				},
+			},
+		},
+		{
+			name:  "wildcards and dashes in the shell",
+			names: map[string]string{"*-xilinx_u30-gen3x4.base-*": "'u30'"},
+			want: []NameRule{{
+				Name:     "*-xilinx_u30-gen3x4.base-*",
+				Match:    map[string]string{"type": "*", "shell": `re:(?i)xilinx_u30-gen3x4\.base`, "timestamp": "*"},
+				Template: "'u30'",
+			}},
+		},
+		{
+			name: "sorted order of the keys",
+			names: map[string]string{
+				"u250-shell_b-1": "'b'",
+				"u250-shell_a-1": "'a'",
+				"*-shell_c-1":    "'c'",
+			},
+			want: []NameRule{
+				{Name: "*-shell_c-1", Match: map[string]string{"type": "*", "shell": "re:(?i)shell_c", "timestamp": "re:(?i)1"}, Template: "'c'"},
+				{Name: "u250-shell_a-1", Match: map[string]string{"type": "re:(?i)u250", "shell": "re:(?i)shell_a", "timestamp": "re:(?i)1"}, Template: "'a'"},
+				{Name: "u250-shell_b-1", Match: map[string]string{"type": "re:(?i)u250", "shell": "re:(?i)shell_b", "timestamp": "re:(?i)1"}, Template: "'b'"},
+			},
+		},
+		{name: "no keys", names: map[string]string{}, want: []NameRule{}},
+		{name: "no dash", names: map[string]string{"u250": "'u250'"}, err: `invalid key "u250"`},
+		{name: "one dash", names: map[string]string{"u250-shell": "'u250'"}, err: `invalid key "u250-shell"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := convertLegacyKeys(test.names)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []NameRule{}
+			for _, rule := range rules {
+				if !rule.legacy {
+					t.Errorf("rule %q is not legacy", rule.Name)
+				}
+				got = append(got, NameRule{Name: rule.Name, Match: rule.Match, Template: rule.Template})
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNameCustomizeRuleOrder(t *testing.T) {
+	u250 := Device{
+		deviceType: "u250",
+		shellVer:   "xilinx_u250_gen3x16_xdma_shell_4_1",
+		timestamp:  "202210_1",
+		uuid:       "abc123",
+		DBDF:       "0000:3b:00.1",
+		SN:         "XFL1A",
+	}
+	u280 := Device{
+		deviceType: "u280",
+		shellVer:   "xilinx_u280_gen3x16_xdma_base_1",
+		timestamp:  "202211_1",
+		uuid:       "def456",
+		DBDF:       "0000:5e:00.1",
+		SN:         "XFL1B",
+	}
+	tests := []struct {
+		name    string
+		content string
+		// want are the names of u250 and u280, "" if no rule matches
+		want     [2]string
+		wantRule [2]string
+	}{
+		{
+			name: "first matching rule wins",
+			content: `{"rules": [
+				{"name": "by-sn", "match": {"sn": "XFL1A"}, "template": "prod"},
+				{"name": "by-type", "match": {"type": "u2*"}, "template": "{{.Type}}"}
+			]}`,
+			want:     [2]string{"prod", "u280"},
+			wantRule: [2]string{"by-sn", "by-type"},
+		},
+		{
+			name: "catch-all first",
+			content: `{"rules": [
+				{"name": "all", "template": "fpga"},
+				{"name": "by-sn", "match": {"sn": "XFL1A"}, "template": "prod"}
+			]}`,
+			want:     [2]string{"fpga", "fpga"},
+			wantRule: [2]string{"all", "all"},
+		},
+		{
+			name: "all matchers of a rule must match",
+			content: `{"rules": [
+				{"name": "u250-b", "match": {"type": "u250", "sn": "XFL1B"}, "template": "b"},
+				{"name": "regexp", "match": {"shell": "re:xilinx_u(250|280)_gen3x16_.*", "timestamp": "2022*"}, "template": "{{.Type}}-gen3"}
+			]}`,
+			want:     [2]string{"u250-gen3", "u280-gen3"},
+			wantRule: [2]string{"regexp", "regexp"},
+		},
+		{
+			name: "globs are case insensitive, regexps match the whole value",
+			content: `{"rules": [
+				{"name": "prefix", "match": {"sn": "re:XFL1"}, "template": "prefix"},
+				{"name": "upper", "match": {"type": "U250"}, "template": "upper"}
+			]}`,
+			want:     [2]string{"upper", ""},
+			wantRule: [2]string{"upper", ""},
+		},
+		{
+			name:     "no rules",
+			content:  `{"rules": []}`,
+			want:     [2]string{"", ""},
+			wantRule: [2]string{"", ""},
+		},
+		{
+			name: "unnamed rules",
+			content: `{"rules": [
+				{"match": {"bdf": "0000:5e:00.1"}, "template": "second"}
+			]}`,
+			want:     [2]string{"", "second"},
+			wantRule: [2]string{"", "rule 0"},
+		},
+		{
+			name: "legacy keys in sorted order",
+			content: `{
+				"u250-xilinx_u250_gen3x16_xdma_shell_4_1-202210_1": "'specific'",
+				"*-*-*": "deviceType+'-any'"
+			}`,
+			want:     [2]string{"u250-any", "u280-any"},
+			wantRule: [2]string{"*-*-*", "*-*-*"},
+		},
+		{
+			name: "legacy uuid",
+			content: `{
+				"u280-xilinx_u280_gen3x16_xdma_base_1-DEF456": "'u280-'+uuid"
+			}`,
+			want:     [2]string{"", "u280-def456"},
+			wantRule: [2]string{"", "u280-xilinx_u280_gen3x16_xdma_base_1-DEF456"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			names, err := parseNameCustomize([]byte(test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, device := range []Device{u250, u280} {
+				name, rule, err := names.getName(device)
+				if err != nil {
+					t.Fatalf("device %s: %v", device.DBDF, err)
+				}
+				ruleName := ""
+				if rule != nil {
+					ruleName = rule.Name
+				}
+				if name != test.want[i] || ruleName != test.wantRule[i] {
+					t.Errorf("device %s is named %q by %q, want %q by %q", device.DBDF, name, ruleName, test.want[i], test.wantRule[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseNameCustomizeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"invalid json", `{"rules": [`, "invalid json"},
+		{"unknown field", `{"rules": [{"name": "a", "template": "a", "tmpl": "b"}]}`, "invalid rules"},
+		{"empty rule", `{"rules": [null]}`, "rule 0 is empty"},
+		{"no template", `{"rules": [{"name": "a"}]}`, "no template"},
+		{"unknown attribute", `{"rules": [{"name": "a", "match": {"model": "u250"}, "template": "a"}]}`, `unknown match attribute "model"`},
+		{"invalid glob", `{"rules": [{"name": "a", "match": {"type": "u[250"}, "template": "a"}]}`, "invalid pattern"},
+		{"invalid regexp", `{"rules": [{"name": "a", "match": {"type": "re:u(250"}, "template": "a"}]}`, "invalid pattern"},
+		{"unknown template attribute", `{"rules": [{"name": "a", "template": "{{.Model}}"}]}`, "invalid template"},
+		{"invalid legacy key", `{"u250": "'u250'"}`, "invalid key"},
+		{"legacy unbalanced quote", `{"*-*-*": "'u250"}`, "unbalanced quote"},
+		{"legacy unknown field", `{"*-*-*": "Nodes"}`, `unknown device field "Nodes"`},
+		{"legacy value not a string", `{"*-*-*": 1}`, "invalid json"},
+		{"not an object", `["*-*-*"]`, "invalid json"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parseNameCustomize([]byte(test.content)); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestReloadNameCustomize(t *testing.T) {
+	c := defaultConfig()
+	c.NameCustomizeFile = path.Join(t.TempDir(), "NameCustomize.json")
+	useConfig(t, c)
+	device := Device{DBDF: "0000:3b:00.1", SN: "XFL1A", shellVer: "xilinx_u250", timestamp: "0x1", deviceType: "0x5005"}
+	m := &FPGADevicePlugin{rescan: make(chan struct{}, 1), scanned: []Device{device}, scannedOnce: true}
+	rescanned := func() bool {
+		select {
+		case <-m.rescan:
+			return true
+		default:
+			return false
+		}
+	}
+
+	steps := []struct {
+		name string
+		// content of the file, nil removes it
+		content []byte
+		want    string
+		rescan  bool
+	}{
+		{name: "no file", want: ""},
+		{name: "loaded", content: []byte(`{"*-*-*": "'a-'+SN"}`), want: "a-XFL1A", rescan: true},
+		{name: "unchanged", content: []byte(`{"*-*-*": "'a-'+SN"}`), want: "a-XFL1A"},
+		{name: "invalid keeps the previous", content: []byte(`{"*-*-*": "'b-"}`), want: "a-XFL1A"},
+		{name: "truncated keeps the previous", content: []byte(`{"*-*-*": `), want: "a-XFL1A"},
+		// the scanned device would get an invalid name
+		{name: "invalid name keeps the previous", content: []byte(`{"*-*-*": "'b-'+DBDF"}`), want: "a-XFL1A"},
+		{name: "changed", content: []byte(`{"*-*-*": "'b-'+SN"}`), want: "b-XFL1A", rescan: true},
+		{name: "removed keeps the previous", want: "b-XFL1A"},
+	}
+	for _, step := range steps {
+		if step.content == nil {
+			os.Remove(c.NameCustomizeFile)
+		} else if err := ioutil.WriteFile(c.NameCustomizeFile, step.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		m.reloadNameCustomize()
+		if name, _, _ := m.names.getName(device); name != step.want {
+			t.Errorf("%s: got name %q, want %q", step.name, name, step.want)
+		}
+		if got := rescanned(); got != step.rescan {
+			t.Errorf("%s: rescan %v, want %v", step.name, got, step.rescan)
+		}
+	}
+}
+
+func TestPendingNameCustomize(t *testing.T) {
+	c := defaultConfig()
+	c.NameCustomizeFile = path.Join(t.TempDir(), "NameCustomize.json")
+	useConfig(t, c)
+	device := Device{DBDF: "0000:3b:00.1", SN: "XFL1A", shellVer: "xilinx_u250", timestamp: "0x1", deviceType: "0x5005"}
+	m := &FPGADevicePlugin{rescan: make(chan struct{}, 1)}
+	write := func(content string) {
+		if err := ioutil.WriteFile(c.NameCustomizeFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// before the first scan the file can't be checked against the devices
+	invalid := `{"*-*-*": "'b-'+DBDF"}`
+	write(invalid)
+	m.reloadNameCustomize()
+	if m.names == nil || !m.namesPending {
+		t.Fatalf("file not loaded pending the first scan")
+	}
+
+	// the first scan rejects it
+	m.nameLock.Lock()
+	m.scanned, m.scannedOnce = []Device{device}, true
+	m.checkPendingNames()
+	m.nameLock.Unlock()
+	if m.names != nil || m.namesPending {
+		t.Errorf("file naming a device %q kept", "b-"+device.DBDF)
+	}
+	<-m.rescan
+
+	// a rejected file is not retried until it changes
+	m.reloadNameCustomize()
+	if m.names != nil || len(m.rescan) != 0 {
+		t.Errorf("rejected file retried")
+	}
+	write(`{"*-*-*": "'a-'+SN"}`)
+	m.reloadNameCustomize()
+	if name, _, _ := m.names.getName(device); name != "a-XFL1A" || len(m.rescan) != 1 {
+		t.Errorf("changed file: name %q, rescan %v", name, len(m.rescan) == 1)
+	}
+
+	// the pending check is done once
+	m.nameLock.Lock()
+	m.checkPendingNames()
+	m.nameLock.Unlock()
+	if m.names == nil {
+		t.Errorf("validated file dropped")
+	}
+}
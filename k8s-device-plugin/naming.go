@@ -0,0 +1,231 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Resource names are built from name templates, in the text/template syntax,
+// over the NameAttributes of the device, e.g.
+//
+//	"{{.Type}}-{{.Shell | replace \"xilinx_\" \"\" | truncate 30}}-{{.Timestamp}}"
+//
+// Besides the builtin functions of text/template, the following functions
+// are available:
+//
+//	lower s                 lower case of s
+//	upper s                 upper case of s
+//	truncate n s            the first n characters of s
+//	replace old new s       s with all old replaced by new
+//	trimPrefix prefix s     s without the leading prefix
+//	trimSuffix suffix s     s without the trailing suffix
+//	hash s                  the first 8 hex digits of the sha256 of s
+//
+// The legacy name expressions, like "'u250-'+shellVer", join quoted literals
+// and device fields with "+". They are converted to name templates.
+
+// NameAttributes are the device attributes available to name templates
+type NameAttributes struct {
+	// device type, e.g. u250
+	Type string
+	// shell(VBNV), e.g. xilinx_u250_gen3x16_xdma_shell_4_1
+	Shell string
+	// shell timestamp
+	Timestamp string
+	// last 6 characters of the logic uuid
+	UUID string
+	// PCI BDF of the user PF, e.g. 0000:3b:00.1
+	BDF string
+	// PCI device id of the user PF, e.g. 0x5005
+	DeviceID string
+	// PCI vendor id of the user PF, e.g. 0x10ee
+	Vendor string
+	// serial number of the card
+	SN string
+	// index of the device on the node, starts from 1
+	Index string
+}
+
+// legacyNameFields maps the device fields of the legacy name expressions to
+// the name attributes
+var legacyNameFields = map[string]string{
+	"deviceType": "Type",
+	"shellVer":   "Shell",
+	"timestamp":  "Timestamp",
+	"uuid":       "UUID",
+	"DBDF":       "BDF",
+	"deviceID":   "DeviceID",
+	"SN":         "SN",
+	"index":      "Index",
+}
+
+// maxResourceNameLength is the limit of the name part of a resource name
+const maxResourceNameLength = 63
+
+// maxResourceDomainLength is the limit of the domain part of a resource name
+const maxResourceDomainLength = 253
+
+var resourceDomainRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+var resourceNameRegexp = regexp.MustCompile(`^([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9]$`)
+
+var nameFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"truncate": func(n int, s string) string {
+		if n >= 0 && len(s) > n {
+			return s[:n]
+		}
+		return s
+	},
+	"replace": func(old string, new string, s string) string {
+		return strings.Replace(s, old, new, -1)
+	},
+	"trimPrefix": func(prefix string, s string) string {
+		return strings.TrimPrefix(s, prefix)
+	},
+	"trimSuffix": func(suffix string, s string) string {
+		return strings.TrimSuffix(s, suffix)
+	},
+	"hash": func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])[:8]
+	},
+}
+
+func getNameAttributes(device Device) NameAttributes {
+	return NameAttributes{
+		Type:      device.deviceType,
+		Shell:     device.shellVer,
+		Timestamp: device.timestamp,
+		UUID:      device.uuid,
+		BDF:       device.DBDF,
+		DeviceID:  device.deviceID,
+		Vendor:    device.vendorID,
+		SN:        device.SN,
+		Index:     device.index,
+	}
+}
+
+// convertLegacyName converts a legacy name expression to a name template
+func convertLegacyName(aliasName string) (string, error) {
+	text := ""
+	for _, alias := range strings.Split(aliasName, "+") {
+		if strings.Contains(alias, "'") {
+			if len(alias) < 2 || !strings.HasPrefix(alias, "'") || !strings.HasSuffix(alias, "'") {
+				return "", fmt.Errorf("unbalanced quote in %q", alias)
+			}
+			text += strings.Replace(alias[1:len(alias)-1], "{{", `{{"{{"}}`, -1)
+			continue
+		}
+		attr, ok := legacyNameFields[alias]
+		if !ok {
+			return "", fmt.Errorf("unknown device field %q", alias)
+		}
+		text += "{{." + attr + "}}"
+	}
+	return text, nil
+}
+
+// parseNameTemplate parses a name template, or a legacy name expression if
+// allowed. The template is run once against empty attributes so unknown
+// attributes and functions are reported here rather than when naming the
+// devices.
+func parseNameTemplate(name string, text string, legacy bool) (*template.Template, error) {
+	if legacy && !strings.Contains(text, "{{") {
+		legacy, err := convertLegacyName(text)
+		if err != nil {
+			return nil, err
+		}
+		text = legacy
+	}
+	tmpl, err := template.New(name).Funcs(nameFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(&strings.Builder{}, NameAttributes{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// renderName builds the name of the device from the template and checks it
+// is a valid resource name
+func renderName(tmpl *template.Template, device Device) (string, error) {
+	var name strings.Builder
+	if err := tmpl.Execute(&name, getNameAttributes(device)); err != nil {
+		return "", err
+	}
+	if err := validateResourceName(name.String()); err != nil {
+		return "", err
+	}
+	return name.String(), nil
+}
+
+// validateResourceName checks the name part of an extended resource name
+// against the Kubernetes rules for qualified names
+func validateResourceName(name string) error {
+	if len(name) > maxResourceNameLength {
+		return fmt.Errorf("name %q is longer than %d characters", name, maxResourceNameLength)
+	}
+	if !resourceNameRegexp.MatchString(name) {
+		return fmt.Errorf("name %q must consist of alphanumeric characters, '-', '_' or '.', and must start and end with an alphanumeric character", name)
+	}
+	if strings.HasSuffix(name, MgmtResourceSuffix) {
+		return fmt.Errorf("name %q ends with %s, which is reserved for the dedicated mgmt resources", name, MgmtResourceSuffix)
+	}
+	return nil
+}
+
+// validateResourceDomain checks the domain part of an extended resource name,
+// which is a DNS subdomain outside of kubernetes.io
+func validateResourceDomain(domain string) error {
+	if len(domain) > maxResourceDomainLength {
+		return fmt.Errorf("domain %q is longer than %d characters", domain, maxResourceDomainLength)
+	}
+	if !resourceDomainRegexp.MatchString(domain) {
+		return fmt.Errorf("domain %q must be a lower case DNS subdomain", domain)
+	}
+	if domain == "kubernetes.io" || strings.HasSuffix(domain, ".kubernetes.io") {
+		return fmt.Errorf("domain %q is reserved by kubernetes", domain)
+	}
+	return nil
+}
+
+// trimResourceDomain returns the name part of a resource name, a name without
+// domain is returned as is
+func trimResourceDomain(resource string) string {
+	return resource[strings.LastIndex(resource, "/")+1:]
+}
+
+// isPluginResource tells whether the resource is registered by the plugin,
+// under ResourceDomain or LegacyResourceDomain
+func isPluginResource(resource string) bool {
+	i := strings.LastIndex(resource, "/")
+	if i < 0 {
+		return false
+	}
+	domain := resource[:i]
+	return domain == cfg().ResourceDomain || (cfg().LegacyResourceDomain != "" && domain == cfg().LegacyResourceDomain)
+}
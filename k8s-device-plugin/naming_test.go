@@ -0,0 +1,171 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderName(t *testing.T) {
+	device := Device{
+		deviceType: "u250",
+		shellVer:   "xilinx_u250_gen3x16_xdma_shell_4_1",
+		timestamp:  "202210_1",
+		uuid:       "abc123",
+		DBDF:       "0000:3b:00.1",
+		SN:         "XFL1A",
+		index:      "1",
+	}
+	tests := []struct {
+		name     string
+		template string
+		legacy   bool
+		want     string
+		// parseErr and renderErr are substrings of the expected errors
+		parseErr  string
+		renderErr string
+	}{
+		{name: "attributes", template: "{{.Type}}-{{.SN}}-{{.Index}}", want: "u250-XFL1A-1"},
+		{name: "replace and truncate", template: `{{.Shell | replace "xilinx_" "" | truncate 9}}`, want: "u250_gen3"},
+		{name: "truncate longer than the value", template: `{{.Type | truncate 10}}`, want: "u250"},
+		{name: "negative truncate", template: `{{.Type | truncate -1}}`, want: "u250"},
+		{name: "trim prefix and suffix", template: `{{.Shell | trimPrefix "xilinx_" | trimSuffix "_shell_4_1"}}`, want: "u250_gen3x16_xdma"},
+		{name: "case", template: `{{.Type | upper}}-{{"ABC" | lower}}`, want: "U250-abc"},
+		{name: "hash", template: `{{.Type}}-{{.Shell | hash}}`, want: "u250-" + nameFuncs["hash"].(func(string) string)(device.shellVer)},
+		{name: "legacy expression", template: "'fpga-'+deviceType+'-'+uuid", legacy: true, want: "fpga-u250-abc123"},
+		{name: "legacy literal only", template: "'u250'", legacy: true, want: "u250"},
+		{name: "legacy rule with a template", template: "{{.Type}}", legacy: true, want: "u250"},
+		{name: "legacy expression only in legacy rules", template: "'fpga-'+deviceType", renderErr: "must consist of"},
+		{name: "legacy unknown field", template: "'fpga-'+shell", legacy: true, parseErr: `unknown device field "shell"`},
+		{name: "legacy unbalanced quote", template: "'fpga-+deviceType", legacy: true, parseErr: "unbalanced quote"},
+		{name: "legacy empty part", template: "'fpga-'++SN", legacy: true, parseErr: `unknown device field ""`},
+		{name: "unknown attribute", template: "{{.Model}}", parseErr: "Model"},
+		{name: "unknown function", template: "{{.Type | title}}", parseErr: `function "title" not defined`},
+		{name: "wrong argument", template: `{{.Type | truncate "a"}}`, parseErr: "expected integer"},
+		{name: "invalid name", template: "{{.BDF}}", renderErr: "must consist of"},
+		{name: "empty name", template: `{{.Type | trimPrefix "u250"}}`, renderErr: "must consist of"},
+		{name: "too long", template: `{{.Shell}}-{{.Shell}}`, renderErr: "longer than 63"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpl, err := parseNameTemplate(test.name, test.template, test.legacy)
+			if test.parseErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.parseErr) {
+					t.Fatalf("parse error %v, want %q", err, test.parseErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse error %v", err)
+			}
+			name, err := renderName(tmpl, device)
+			if test.renderErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.renderErr) {
+					t.Fatalf("got %q, %v, want error %q", name, err, test.renderErr)
+				}
+				return
+			}
+			if err != nil || name != test.want {
+				t.Errorf("got %q, %v, want %q", name, err, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateResourceName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"xilinx_u250_gen3x16_xdma_shell_4_1-0": true,
+		"ama_u30":                              true,
+		"a":                                    true,
+		"U250.prod":                            true,
+		strings.Repeat("a", maxResourceNameLength):   true,
+		strings.Repeat("a", maxResourceNameLength+1): false,
+		"":          false,
+		"-u250":     false,
+		"u250_":     false,
+		".u250":     false,
+		"u250/prod": false,
+		"u250 prod": false,
+		"u250\n":    false,
+		// reserved for the dedicated mgmt resources
+		"u250" + MgmtResourceSuffix:        false,
+		"u250" + MgmtResourceSuffix + "-0": true,
+	} {
+		if err := validateResourceName(name); (err == nil) != valid {
+			t.Errorf("validateResourceName(%q) = %v, want valid %v", name, err, valid)
+		}
+	}
+}
+
+func TestValidateResourceDomain(t *testing.T) {
+	for domain, valid := range map[string]bool{
+		"amd.com":              true,
+		"xilinx.com":           true,
+		"fpga.example-corp.io": true,
+		"localdomain":          true,
+		"notkubernetes.io":     true,
+		strings.Repeat("a", 63) + "." + strings.Repeat("b", 189): true,
+		strings.Repeat("a", 63) + "." + strings.Repeat("b", 190): false,
+		"":                   false,
+		"AMD.com":            false,
+		"amd.com.":           false,
+		"-amd.com":           false,
+		"amd-.com":           false,
+		"amd..com":           false,
+		"amd.com/fpga":       false,
+		"kubernetes.io":      false,
+		"fpga.kubernetes.io": false,
+	} {
+		if err := validateResourceDomain(domain); (err == nil) != valid {
+			t.Errorf("validateResourceDomain(%q) = %v, want valid %v", domain, err, valid)
+		}
+	}
+}
+
+func TestIsPluginResource(t *testing.T) {
+	c := defaultConfig()
+	useConfig(t, c)
+	tests := []struct {
+		resource string
+		legacy   string
+		want     bool
+	}{
+		{"amd.com/u250", "", true},
+		{"xilinx.com/u250", "", false},
+		{"xilinx.com/u250", "xilinx.com", true},
+		{"amd.com/u250", "xilinx.com", true},
+		{"nvidia.com/gpu", "xilinx.com", false},
+		// only the domain up to the last slash counts
+		{"sub.amd.com/u250", "", false},
+		{"u250", "", false},
+		{"/u250", "", false},
+	}
+	for _, test := range tests {
+		c.LegacyResourceDomain = test.legacy
+		if got := isPluginResource(test.resource); got != test.want {
+			t.Errorf("isPluginResource(%q) with legacy domain %q = %v, want %v", test.resource, test.legacy, got, test.want)
+		}
+	}
+	if name := trimResourceDomain("xilinx.com/u250"); name != "u250" {
+		t.Errorf("trimResourceDomain: %s", name)
+	}
+	if name := trimResourceDomain("u250"); name != "u250" {
+		t.Errorf("trimResourceDomain without domain: %s", name)
+	}
+}
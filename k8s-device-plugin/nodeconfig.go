@@ -0,0 +1,310 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The node the plugin runs on is named by NODE_NAME, and its labels are read
+// from NODE_LABELS, comma separated key=value pairs, or from NODE_LABELS_FILE,
+// a file in the downward API format with one key="value" per line.
+const (
+	NodeNameEnv       = "NODE_NAME"
+	NodeLabelsEnv     = "NODE_LABELS"
+	NodeLabelsFileEnv = "NODE_LABELS_FILE"
+)
+
+// NodeOverride overrides the config on the nodes it selects. A node is
+// selected when its name matches the name glob and its labels match the
+// selector, an empty name or selector matches every node:
+//
+//	nodes:
+//	- name: "fpga-u30-*"
+//	  selector: "amd.com/card=u30,zone in (a,b),!maintenance"
+//	  config:
+//	    u30AllocUnit: Device
+//
+// The selector is a comma separated list of requirements, all of which have
+// to match: key=value, key==value, key!=value, key in (v1,v2),
+// key notin (v1,v2), key and !key. The overrides of all the selecting
+// sections apply in their order, after the config file and before the
+// environment and the flags.
+type NodeOverride struct {
+	Name     string          `json:"name"`
+	Selector string          `json:"selector"`
+	Config   json.RawMessage `json:"config"`
+
+	requirements []labelRequirement
+}
+
+// labelRequirement is one requirement of a label selector
+type labelRequirement struct {
+	key    string
+	op     string
+	values []string
+}
+
+// NodeInfo is the name and labels of the node the plugin runs on
+type NodeInfo struct {
+	Name   string
+	Labels map[string]string
+}
+
+// splitSelector splits a selector at the commas outside of parentheses
+func splitSelector(selector string) []string {
+	items := []string{}
+	depth, start := 0, 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(items, selector[start:])
+}
+
+// parseValueSet parses "(v1,v2)" of the in and notin operators
+func parseValueSet(set string) ([]string, error) {
+	set = strings.TrimSpace(set)
+	if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+		return nil, fmt.Errorf("invalid value set %q, expect (v1,v2)", set)
+	}
+	if strings.TrimSpace(set[1:len(set)-1]) == "" {
+		return nil, fmt.Errorf("empty value set %q, expect (v1,v2)", set)
+	}
+	values := []string{}
+	for _, value := range strings.Split(set[1:len(set)-1], ",") {
+		values = append(values, strings.TrimSpace(value))
+	}
+	return values, nil
+}
+
+// parseSelector parses a label selector
+func parseSelector(selector string) ([]labelRequirement, error) {
+	requirements := []labelRequirement{}
+	if strings.TrimSpace(selector) == "" {
+		return requirements, nil
+	}
+	for _, item := range splitSelector(selector) {
+		item = strings.TrimSpace(item)
+		var req labelRequirement
+		fields := strings.Fields(item)
+		switch {
+		case item == "":
+			return nil, fmt.Errorf("empty requirement in %q", selector)
+		case len(fields) >= 2 && (fields[1] == "in" || fields[1] == "notin"):
+			// the set follows the key and the operator, which the key may
+			// contain, e.g. node.kubernetes.io/instance-type in (a,b)
+			set := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(item, fields[0])), fields[1]))
+			values, err := parseValueSet(set)
+			if err != nil {
+				return nil, err
+			}
+			req = labelRequirement{key: fields[0], op: fields[1], values: values}
+		case strings.Contains(item, "!="):
+			kv := strings.SplitN(item, "!=", 2)
+			req = labelRequirement{key: strings.TrimSpace(kv[0]), op: "!=", values: []string{strings.TrimSpace(kv[1])}}
+		case strings.Contains(item, "="):
+			kv := strings.SplitN(strings.Replace(item, "==", "=", 1), "=", 2)
+			req = labelRequirement{key: strings.TrimSpace(kv[0]), op: "=", values: []string{strings.TrimSpace(kv[1])}}
+		case strings.HasPrefix(item, "!"):
+			req = labelRequirement{key: strings.TrimSpace(item[1:]), op: "!"}
+		default:
+			req = labelRequirement{key: item, op: "exists"}
+		}
+		if req.key == "" || strings.ContainsAny(req.key, " ()!=") {
+			return nil, fmt.Errorf("invalid requirement %q", item)
+		}
+		requirements = append(requirements, req)
+	}
+	return requirements, nil
+}
+
+func (r labelRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.op {
+	case "exists":
+		return ok
+	case "!":
+		return !ok
+	case "=":
+		return ok && value == r.values[0]
+	case "!=":
+		return !ok || value != r.values[0]
+	case "in", "notin":
+		in := false
+		for _, v := range r.values {
+			if ok && value == v {
+				in = true
+			}
+		}
+		return in == (r.op == "in")
+	}
+	return false
+}
+
+// compile checks the override and parses its selector
+func (o *NodeOverride) compile() error {
+	if o.Name != "" {
+		if _, err := filepath.Match(o.Name, ""); err != nil {
+			return fmt.Errorf("invalid name %q: %v", o.Name, err)
+		}
+	}
+	requirements, err := parseSelector(o.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector %q: %v", o.Selector, err)
+	}
+	o.requirements = requirements
+	return nil
+}
+
+// selects tells whether the override applies to the node
+func (o *NodeOverride) selects(node NodeInfo) bool {
+	if o.Name != "" {
+		if ok, _ := filepath.Match(o.Name, node.Name); !ok {
+			return false
+		}
+	}
+	for _, req := range o.requirements {
+		if !req.matches(node.Labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyNodeOverrides applies the overrides selecting the node, in order, and
+// returns their descriptions. The overrides can't set the version or nested
+// overrides.
+func (c *Config) applyNodeOverrides(node NodeInfo) ([]string, error) {
+	applied := []string{}
+	overrides := c.Nodes
+	c.Nodes = nil
+	for i, override := range overrides {
+		if err := override.compile(); err != nil {
+			return nil, fmt.Errorf("node override %d: %v", i, err)
+		}
+		if len(override.Config) == 0 {
+			return nil, fmt.Errorf("node override %d: no config", i)
+		}
+		var keys map[string]json.RawMessage
+		if err := json.Unmarshal(override.Config, &keys); err != nil {
+			return nil, fmt.Errorf("node override %d: invalid config: %v", i, err)
+		}
+		for _, key := range []string{"version", "nodes"} {
+			if _, ok := keys[key]; ok {
+				return nil, fmt.Errorf("node override %d: %s can't be overridden", i, key)
+			}
+		}
+		// unknown keys are errors even in the overrides of other nodes
+		target := defaultConfig()
+		if override.selects(node) {
+			target = c
+		}
+		decoder := json.NewDecoder(bytes.NewReader(override.Config))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(target); err != nil {
+			return nil, fmt.Errorf("node override %d: invalid config: %v", i, err)
+		}
+		if target != c {
+			continue
+		}
+		applied = append(applied, overrideName(i, override))
+	}
+	return applied, nil
+}
+
+// overrideName describes an override in the effective config
+func overrideName(i int, override *NodeOverride) string {
+	name := "#" + strconv.Itoa(i)
+	if override.Name != "" {
+		name += " name=" + override.Name
+	}
+	if override.Selector != "" {
+		name += " selector=" + override.Selector
+	}
+	return name
+}
+
+// parseDownwardLabels parses the labels of a downward API file, with one
+// key="value" per line
+func parseDownwardLabels(content []byte) (map[string]string, error) {
+	labels := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid label %q, expect key=\"value\"", line)
+		}
+		value, err := strconv.Unquote(kv[1])
+		if err != nil {
+			value = kv[1]
+		}
+		labels[kv[0]] = value
+	}
+	return labels, scanner.Err()
+}
+
+// getNodeInfo reads the name and labels of the node from the environment
+func getNodeInfo() (NodeInfo, error) {
+	node := NodeInfo{
+		Name:   os.Getenv(NodeNameEnv),
+		Labels: make(map[string]string),
+	}
+	if fname := os.Getenv(NodeLabelsFileEnv); fname != "" {
+		content, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return node, err
+		}
+		labels, err := parseDownwardLabels(content)
+		if err != nil {
+			return node, fmt.Errorf("%s: %v", fname, err)
+		}
+		node.Labels = labels
+	}
+	if value := os.Getenv(NodeLabelsEnv); value != "" {
+		labels, err := parsePairs(value)
+		if err != nil {
+			return node, fmt.Errorf("%s: %v", NodeLabelsEnv, err)
+		}
+		for key, value := range labels {
+			node.Labels[key] = value
+		}
+	}
+	return node, nil
+}
@@ -0,0 +1,313 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     []labelRequirement
+		err      string
+	}{
+		{selector: "", want: []labelRequirement{}},
+		{selector: "  ", want: []labelRequirement{}},
+		{selector: "amd.com/card=u30", want: []labelRequirement{{key: "amd.com/card", op: "=", values: []string{"u30"}}}},
+		{selector: "card == u30", want: []labelRequirement{{key: "card", op: "=", values: []string{"u30"}}}},
+		{selector: "card!=u30", want: []labelRequirement{{key: "card", op: "!=", values: []string{"u30"}}}},
+		{selector: "zone in (a, b)", want: []labelRequirement{{key: "zone", op: "in", values: []string{"a", "b"}}}},
+		{selector: "zone notin (a)", want: []labelRequirement{{key: "zone", op: "notin", values: []string{"a"}}}},
+		{selector: "zone in ( a , b )", want: []labelRequirement{{key: "zone", op: "in", values: []string{"a", "b"}}}},
+		{selector: "node.kubernetes.io/instance-type in (a,b)", want: []labelRequirement{{key: "node.kubernetes.io/instance-type", op: "in", values: []string{"a", "b"}}}},
+		{selector: "maintenance notin (planned)", want: []labelRequirement{{key: "maintenance", op: "notin", values: []string{"planned"}}}},
+		{selector: "fpga", want: []labelRequirement{{key: "fpga", op: "exists"}}},
+		{selector: "!maintenance", want: []labelRequirement{{key: "maintenance", op: "!"}}},
+		{
+			selector: "amd.com/card=u30,zone in (a,b),!maintenance",
+			want: []labelRequirement{
+				{key: "amd.com/card", op: "=", values: []string{"u30"}},
+				{key: "zone", op: "in", values: []string{"a", "b"}},
+				{key: "maintenance", op: "!"},
+			},
+		},
+		{selector: "card=u30,", err: "empty requirement"},
+		{selector: "zone in a,b", err: "invalid value set"},
+		{selector: "zone in (a", err: "invalid value set"},
+		{selector: "zone in ()", err: "empty value set"},
+		{selector: "zone notin ( )", err: "empty value set"},
+		{selector: "=u30", err: "invalid requirement"},
+		{selector: "!", err: "invalid requirement"},
+		{selector: "my card", err: "invalid requirement"},
+	}
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			got, err := parseSelector(test.selector)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, %v, want error %q", got, err, test.err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, %v, want %+v", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestNodeOverrideSelects(t *testing.T) {
+	node := NodeInfo{
+		Name:   "fpga-u30-1",
+		Labels: map[string]string{"amd.com/card": "u30", "zone": "a", "fpga": ""},
+	}
+	tests := []struct {
+		name     string
+		selector string
+		want     bool
+	}{
+		{"", "", true},
+		{"fpga-u30-*", "", true},
+		{"fpga-u250-*", "", false},
+		{"FPGA-U30-1", "", false},
+		{"", "amd.com/card=u30", true},
+		{"", "amd.com/card=u250", false},
+		{"", "amd.com/card!=u250", true},
+		{"", "absent!=u250", true},
+		{"", "zone in (a,b)", true},
+		{"", "zone in (b,c)", false},
+		{"", "zone notin (b,c)", true},
+		{"", "absent notin (b,c)", true},
+		{"", "absent in (b,c)", false},
+		{"", "fpga", true},
+		{"", "fpga=", true},
+		{"", "!fpga", false},
+		{"", "!maintenance", true},
+		{"fpga-*", "amd.com/card=u30,zone in (a,b),!maintenance", true},
+		{"fpga-*", "amd.com/card=u30,zone in (b),!maintenance", false},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %s", test.name, test.selector), func(t *testing.T) {
+			override := &NodeOverride{Name: test.name, Selector: test.selector}
+			if err := override.compile(); err != nil {
+				t.Fatal(err)
+			}
+			if got := override.selects(node); got != test.want {
+				t.Errorf("selects %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyNodeOverrides(t *testing.T) {
+	node := NodeInfo{
+		Name:   "fpga-u30-1",
+		Labels: map[string]string{"amd.com/card": "u30", "zone": "a"},
+	}
+	tests := []struct {
+		name    string
+		content string
+		applied []string
+		// want are the expected values by config key
+		want map[string]string
+		err  string
+	}{
+		{
+			name: "overrides apply in order",
+			content: `
+version: v1
+virtualNum: 2
+u30AllocUnit: Card
+nodes:
+- selector: "amd.com/card=u30"
+  config:
+    virtualNum: 4
+    u30AllocUnit: Device
+- name: "fpga-u30-*"
+  config:
+    virtualNum: 8
+`,
+			applied: []string{"#0 selector=amd.com/card=u30", "#1 name=fpga-u30-*"},
+			want:    map[string]string{"virtualNum": "8", "u30AllocUnit": "Device"},
+		},
+		{
+			name: "overrides of other nodes are skipped",
+			content: `
+version: v1
+virtualNum: 2
+nodes:
+- name: "fpga-u250-*"
+  config:
+    virtualNum: 4
+- selector: "zone=b"
+  config:
+    virtualNum: 6
+`,
+			applied: []string{},
+			want:    map[string]string{"virtualNum": "2"},
+		},
+		{
+			name: "the keys missing in the override are kept, the maps are merged",
+			content: `
+version: v1
+mgmtPolicy: Omit
+mgmtResourcePolicy: {u250: ReadOnly}
+nodes:
+- config:
+    mgmtResourcePolicy: {ama_u30: Dedicated}
+`,
+			applied: []string{"#0"},
+			want:    map[string]string{"mgmtPolicy": "Omit", "mgmtResourcePolicy": "map[ama_u30:Dedicated u250:ReadOnly]"},
+		},
+		{
+			name: "unknown key in the override of another node",
+			content: `
+version: v1
+nodes:
+- name: other
+  config:
+    virtualNumber: 4
+`,
+			err: "node override 0: invalid config",
+		},
+		{
+			name: "version override",
+			content: `
+version: v1
+nodes:
+- config:
+    version: v2
+`,
+			err: "version can't be overridden",
+		},
+		{
+			name: "nested overrides",
+			content: `
+version: v1
+nodes:
+- config:
+    nodes: []
+`,
+			err: "nodes can't be overridden",
+		},
+		{
+			name: "no config",
+			content: `
+version: v1
+nodes:
+- name: fpga-u30-1
+`,
+			err: "node override 0: no config",
+		},
+		{
+			name: "invalid selector",
+			content: `
+version: v1
+nodes:
+- selector: "zone in a"
+  config:
+    virtualNum: 4
+`,
+			err: "invalid selector",
+		},
+		{
+			name: "invalid name",
+			content: `
+version: v1
+nodes:
+- name: "fpga-[u30"
+  config:
+    virtualNum: 4
+`,
+			err: "invalid name",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := defaultConfig()
+			if err := parseConfig([]byte(test.content), config); err != nil {
+				t.Fatal(err)
+			}
+			applied, err := config.applyNodeOverrides(node)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(applied, test.applied) {
+				t.Errorf("applied %q, want %q", applied, test.applied)
+			}
+			if config.Nodes != nil {
+				t.Errorf("the overrides are kept in the effective config")
+			}
+			for key, want := range test.want {
+				if got := fmt.Sprint(config.configField(key).Interface()); got != want {
+					t.Errorf("%s is %s, want %s", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDownwardLabels(t *testing.T) {
+	content := "amd.com/card=\"u30\"\n\nzone=\"a,b\"\nraw=value\nempty=\"\"\n"
+	want := map[string]string{"amd.com/card": "u30", "zone": "a,b", "raw": "value", "empty": ""}
+	got, err := parseDownwardLabels([]byte(content))
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, %v, want %v", got, err, want)
+	}
+	if _, err := parseDownwardLabels([]byte("no label\n")); err == nil {
+		t.Errorf("no error for a line without =")
+	}
+}
+
+func TestGetNodeInfo(t *testing.T) {
+	fname := path.Join(t.TempDir(), "labels")
+	if err := ioutil.WriteFile(fname, []byte("zone=\"a\"\namd.com/card=\"u250\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(NodeNameEnv, "fpga-1")
+	t.Setenv(NodeLabelsFileEnv, fname)
+	// the labels of the environment win over the downward API file
+	t.Setenv(NodeLabelsEnv, "amd.com/card=u30, rack=7")
+	node, err := getNodeInfo()
+	want := map[string]string{"zone": "a", "amd.com/card": "u30", "rack": "7"}
+	if err != nil || node.Name != "fpga-1" || !reflect.DeepEqual(node.Labels, want) {
+		t.Errorf("got %+v, %v, want labels %v", node, err, want)
+	}
+
+	t.Setenv(NodeLabelsEnv, "rack")
+	if _, err := getNodeInfo(); err == nil || !strings.Contains(err.Error(), NodeLabelsEnv) {
+		t.Errorf("got %v, want an error of %s", err, NodeLabelsEnv)
+	}
+	t.Setenv(NodeLabelsEnv, "")
+	t.Setenv(NodeLabelsFileEnv, fname+".missing")
+	if _, err := getNodeInfo(); err == nil {
+		t.Errorf("missing labels file read")
+	}
+}
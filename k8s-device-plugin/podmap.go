@@ -0,0 +1,268 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metricDevicePod is the pod map in the metrics
+const metricDevicePod = "amd_fpga_device_pod_info"
+
+// PodMap keeps the containers holding each device of the plugin, as listed
+// by the kubelet PodResources API. Kubelet doesn't tell the plugin when a
+// device is freed, so the map is refreshed every PodResourcesInterval.
+type PodMap struct {
+	lock sync.Mutex
+	// holders are keyed by the device ID in the resource
+	holders map[string][]DeviceHolder
+	// synced is when the map was last refreshed, lastError why the last
+	// refresh failed, the map is then kept as of the last success
+	synced    time.Time
+	lastError string
+}
+
+var podMap = &PodMap{holders: make(map[string][]DeviceHolder)}
+
+// podResourcesEnabled tells whether the pod resources are listed, to track
+// the pods or for the allocation ledger
+func podResourcesEnabled() bool {
+	return cfg().PodResources || ledgerEnabled()
+}
+
+// update replaces the holders, it logs the devices taken and released
+func (p *PodMap) update(holders map[string][]DeviceHolder) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for id, deviceHolders := range holders {
+		for _, holder := range deviceHolders {
+			if !containsHolder(p.holders[id], holder) {
+				podsLog.WithField("resource", holder.Resource).Debugf("Device %s is held by %s/%s container %s", id, holder.Namespace, holder.Pod, holder.Container)
+			}
+		}
+	}
+	for id, deviceHolders := range p.holders {
+		for _, holder := range deviceHolders {
+			if !containsHolder(holders[id], holder) {
+				podsLog.WithField("resource", holder.Resource).Debugf("Device %s is released by %s/%s container %s", id, holder.Namespace, holder.Pod, holder.Container)
+			}
+		}
+	}
+	p.holders = holders
+	p.synced = time.Now()
+	p.lastError = ""
+}
+
+// setError records a failed refresh
+func (p *PodMap) setError(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.lastError = err.Error()
+}
+
+// clear empties the map when the pod resources are no longer listed
+func (p *PodMap) clear() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.holders = make(map[string][]DeviceHolder)
+	p.synced = time.Time{}
+	p.lastError = ""
+}
+
+// snapshot returns the holders, when they were refreshed and the error of the
+// last refresh. The holders must not be modified.
+func (p *PodMap) snapshot() (map[string][]DeviceHolder, time.Time, string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.holders, p.synced, p.lastError
+}
+
+func containsHolder(holders []DeviceHolder, holder DeviceHolder) bool {
+	for _, h := range holders {
+		if h == holder {
+			return true
+		}
+	}
+	return false
+}
+
+// holdersOf returns the containers holding a discovered device, through its
+// resources and its dedicated mgmt resource, which is keyed by the card
+func holdersOf(holders map[string][]DeviceHolder, dbdf string) []DeviceHolder {
+	result := append([]DeviceHolder{}, holders[dbdf]...)
+	if bdf := GetPciBDF(dbdf); bdf != dbdf {
+		result = append(result, holders[bdf]...)
+	}
+	return result
+}
+
+// run refreshes the pod map, syncs the allocation ledger and accounts the
+// usage of the pods with it, while the pod resources are listed, until the
+// context is cancelled
+func (p *PodMap) run(ctx context.Context) {
+	for {
+		if podResourcesEnabled() {
+			holders, err := getDeviceHolders()
+			if err != nil {
+				if ledgerEnabled() {
+					podsLog.Warnf("Can't list pod resources from %s, the devices shared by several resources are not released: %v", PodResourcesSocket, err)
+				} else {
+					podsLog.Debugf("Can't list pod resources from %s: %v", PodResourcesSocket, err)
+				}
+				p.setError(err)
+				// the devices are not charged while kubelet can't tell
+				// who holds them
+				podUsage.pause()
+			} else {
+				p.update(holders)
+				if ledgerEnabled() {
+					allocLedger.sync(devicesInUse(holders))
+				}
+				if cfg().PodResources {
+					podUsage.record(holders, time.Now())
+				}
+			}
+		} else {
+			p.clear()
+		}
+		if cfg().PodResources {
+			podUsage.writeReport(time.Now())
+		} else {
+			podUsage.pause()
+		}
+		select {
+		case <-time.After(time.Duration(cfg().PodResourcesInterval) * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// DevicePods are the containers holding a device
+type DevicePods struct {
+	// ID is the device ID in the resource, BDF the PCI function of the
+	// device and SN the serial number of its card
+	ID      string         `json:"id"`
+	BDF     string         `json:"bdf"`
+	SN      string         `json:"sn,omitempty"`
+	Holders []DeviceHolder `json:"holders"`
+}
+
+// podsReport is the body of the pods endpoint
+type podsReport struct {
+	Synced *time.Time `json:"synced,omitempty"`
+	Error  string     `json:"error,omitempty"`
+	// Free is set when the devices are selected by bdf or sn and none of
+	// them is held
+	Free    *bool        `json:"free,omitempty"`
+	Devices []DevicePods `json:"devices"`
+}
+
+// devicePods lists the discovered devices and the devices held through the
+// mgmt resources with their holders, sorted by ID
+func (m *FPGADevicePlugin) devicePods(holders map[string][]DeviceHolder) []DevicePods {
+	m.nameLock.Lock()
+	devices := m.scanned
+	m.nameLock.Unlock()
+
+	serials := make(map[string]string)
+	pods := []DevicePods{}
+	listed := make(map[string]bool)
+	for _, device := range devices {
+		bdf := GetPciBDF(device.DBDF)
+		if device.SN != AWS_SN {
+			serials[bdf] = device.SN
+		}
+		listed[device.DBDF] = true
+		pods = append(pods, DevicePods{ID: device.DBDF, BDF: bdf, Holders: holders[device.DBDF]})
+	}
+	for id, deviceHolders := range holders {
+		if !listed[id] {
+			pods = append(pods, DevicePods{ID: id, BDF: GetPciBDF(id), Holders: deviceHolders})
+		}
+	}
+	for i := range pods {
+		pods[i].SN = serials[pods[i].BDF]
+		if pods[i].Holders == nil {
+			pods[i].Holders = []DeviceHolder{}
+		}
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].ID < pods[j].ID
+	})
+	return pods
+}
+
+// collectPods sets the pod map metric, one series per device and container
+// holding it
+func (m *FPGADevicePlugin) collectPods() {
+	metrics.reset(metricDevicePod)
+	holders, _, _ := podMap.snapshot()
+	for _, pods := range m.devicePods(holders) {
+		for _, holder := range pods.Holders {
+			metrics.set(metricDevicePod, 1, "resource", holder.Resource, "device", pods.ID, "bdf", pods.BDF,
+				"sn", pods.SN, "namespace", holder.Namespace, "pod", holder.Pod, "container", holder.Container)
+		}
+	}
+}
+
+// podsHandler serves the pod map in JSON. With the bdf or sn query, only the
+// devices of that PCI function or card are listed and free tells whether all
+// of them are unused; it answers 404 if no device matches and 503 if the map
+// is not up to date, as the devices can't be told free then.
+func (m *FPGADevicePlugin) podsHandler(w http.ResponseWriter, r *http.Request) {
+	holders, synced, lastError := podMap.snapshot()
+	report := podsReport{Error: lastError, Devices: m.devicePods(holders)}
+	if !synced.IsZero() {
+		report.Synced = &synced
+	}
+	code := http.StatusOK
+	bdf, sn := r.URL.Query().Get("bdf"), r.URL.Query().Get("sn")
+	if bdf != "" || sn != "" {
+		selected := []DevicePods{}
+		free := true
+		for _, pods := range report.Devices {
+			if (bdf != "" && pods.BDF != bdf) || (sn != "" && pods.SN != sn) {
+				continue
+			}
+			selected = append(selected, pods)
+			if len(pods.Holders) != 0 {
+				free = false
+			}
+		}
+		report.Devices = selected
+		switch {
+		case len(selected) == 0:
+			code = http.StatusNotFound
+		case synced.IsZero() || lastError != "":
+			code = http.StatusServiceUnavailable
+		default:
+			report.Free = &free
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		httpLog.Debugf("Can't write the pod map: %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"google.golang.org/grpc"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+	"net"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePodResources is a kubelet PodResources API listing the same pods on
+// every call
+type fakePodResources struct {
+	podresourcesapi.UnimplementedPodResourcesListerServer
+	pods []*podresourcesapi.PodResources
+}
+
+func (f *fakePodResources) List(ctx context.Context, req *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: f.pods}, nil
+}
+
+// servePodResources serves the pods on a kubelet socket in a temporary
+// directory for the test
+func servePodResources(t *testing.T, pods ...*podresourcesapi.PodResources) {
+	t.Helper()
+	socket := path.Join(t.TempDir(), "kubelet.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(server, &fakePodResources{pods: pods})
+	go server.Serve(listener)
+	saved := PodResourcesSocket
+	PodResourcesSocket = socket
+	t.Cleanup(func() {
+		server.Stop()
+		PodResourcesSocket = saved
+	})
+}
+
+// podResources is a pod whose containers hold the devices of resources,
+// given as container name, resource name and device IDs
+func podResources(namespace string, name string, containers ...interface{}) *podresourcesapi.PodResources {
+	pod := &podresourcesapi.PodResources{Namespace: namespace, Name: name}
+	for i := 0; i+2 < len(containers); i += 3 {
+		pod.Containers = append(pod.Containers, &podresourcesapi.ContainerResources{
+			Name: containers[i].(string),
+			Devices: []*podresourcesapi.ContainerDevices{{
+				ResourceName: containers[i+1].(string),
+				DeviceIds:    containers[i+2].([]string),
+			}},
+		})
+	}
+	return pod
+}
+
+func TestGetDeviceHolders(t *testing.T) {
+	config := defaultConfig()
+	config.LegacyResourceDomain = "xilinx.com"
+	useConfig(t, config)
+	servePodResources(t,
+		podResources("ops", "monitor", "main", "amd.com/ama_u30-mgmt", []string{"0000:82:00.1"}),
+		podResources("default", "worker",
+			"b", "amd.com/u250", []string{"0000:3b:00.1"},
+			"a", "xilinx.com/u250", []string{"0000:3b:00.1", "0000:3c:00.1"},
+			"gpu", "nvidia.com/gpu", []string{"GPU-1"}),
+		podResources("default", "idle"),
+	)
+	holders, err := getDeviceHolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]DeviceHolder{
+		"0000:82:00.1": {{Namespace: "ops", Pod: "monitor", Container: "main", Resource: "amd.com/ama_u30-mgmt"}},
+		// sorted by container
+		"0000:3b:00.1": {
+			{Namespace: "default", Pod: "worker", Container: "a", Resource: "xilinx.com/u250"},
+			{Namespace: "default", Pod: "worker", Container: "b", Resource: "amd.com/u250"},
+		},
+		"0000:3c:00.1": {{Namespace: "default", Pod: "worker", Container: "a", Resource: "xilinx.com/u250"}},
+	}
+	if !reflect.DeepEqual(holders, want) {
+		t.Errorf("got %v, want %v", holders, want)
+	}
+
+	inUse := devicesInUse(map[string][]DeviceHolder{
+		"0000:3c:00.1": want["0000:3c:00.1"],
+		"0000:82:00.1": want["0000:82:00.1"],
+	})
+	wantInUse := map[string]string{
+		physicalDeviceID("0000:3c:00.1", false): "xilinx.com/u250",
+		physicalDeviceID("0000:82:00.1", true):  "amd.com/ama_u30-mgmt",
+	}
+	if !reflect.DeepEqual(inUse, wantInUse) {
+		t.Errorf("in use %v, want %v", inUse, wantInUse)
+	}
+}
+
+func TestPodMapRun(t *testing.T) {
+	useConfig(t, defaultConfig())
+	servePodResources(t, podResources("default", "worker", "main", "amd.com/u250", []string{"0000:3b:00.1"}))
+	p := &PodMap{holders: make(map[string][]DeviceHolder)}
+	p.setError(errors.New("previous error"))
+	// a cancelled context stops the map after one refresh
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p.run(ctx)
+	holders, synced, lastError := p.snapshot()
+	if synced.IsZero() || lastError != "" || len(holders["0000:3b:00.1"]) != 1 {
+		t.Errorf("holders %v, synced %v, error %q", holders, synced, lastError)
+	}
+
+	// the map is cleared once the pod resources are no longer listed
+	config := defaultConfig()
+	config.PodResources = false
+	useConfig(t, config)
+	p.run(ctx)
+	if holders, synced, lastError := p.snapshot(); len(holders) != 0 || !synced.IsZero() || lastError != "" {
+		t.Errorf("after disabling: holders %v, synced %v, error %q", holders, synced, lastError)
+	}
+}
+
+func TestPodMapRunListingError(t *testing.T) {
+	useConfig(t, defaultConfig())
+	// kubelet answers without implementing the listing
+	socket := path.Join(t.TempDir(), "kubelet.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(server, &podresourcesapi.UnimplementedPodResourcesListerServer{})
+	go server.Serve(listener)
+	defer server.Stop()
+	defer func(socket string) { PodResourcesSocket = socket }(PodResourcesSocket)
+	PodResourcesSocket = socket
+
+	podUsage.lock.Lock()
+	podUsage.held = map[usageKey]int{{"default", "worker", "amd.com/u250"}: 1}
+	podUsage.listed = time.Now()
+	podUsage.lock.Unlock()
+	p := &PodMap{holders: make(map[string][]DeviceHolder)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.run(ctx)
+	if _, _, lastError := p.snapshot(); lastError == "" {
+		t.Errorf("no listing error")
+	}
+	// the devices held at the last listing are not charged until the next one
+	podUsage.lock.Lock()
+	held, listed := podUsage.held, podUsage.listed
+	podUsage.lock.Unlock()
+	if held != nil || !listed.IsZero() {
+		t.Errorf("usage not paused: held %v, listed %v", held, listed)
+	}
+}
+
+func TestHoldersOf(t *testing.T) {
+	worker := DeviceHolder{Pod: "worker"}
+	monitor := DeviceHolder{Pod: "monitor"}
+	holders := map[string][]DeviceHolder{"0000:82:00.1-0": {worker}, "0000:82:00.1": {monitor}}
+	for dbdf, want := range map[string][]DeviceHolder{
+		"0000:82:00.1-0": {worker, monitor},
+		"0000:82:00.1-1": {monitor},
+		"0000:82:00.1":   {monitor},
+		"0000:3b:00.1":   {},
+	} {
+		if got := holdersOf(holders, dbdf); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", dbdf, got, want)
+		}
+	}
+	// the map of the holders is not modified
+	if len(holders["0000:82:00.1-0"]) != 1 {
+		t.Errorf("holders modified: %v", holders)
+	}
+}
+
+// usePodMap replaces the pod map for the test, the map is synced unless
+// holders is nil, with lastError as the error of the last refresh
+func usePodMap(t *testing.T, holders map[string][]DeviceHolder, lastError string) {
+	saved := podMap
+	podMap = &PodMap{holders: make(map[string][]DeviceHolder)}
+	if holders != nil {
+		podMap.update(holders)
+	}
+	podMap.lastError = lastError
+	t.Cleanup(func() { podMap = saved })
+}
+
+func TestPodsHandler(t *testing.T) {
+	worker := DeviceHolder{Namespace: "default", Pod: "worker", Container: "main", Resource: "amd.com/ama_u30"}
+	monitor := DeviceHolder{Namespace: "ops", Pod: "monitor", Container: "main", Resource: "amd.com/ama_u30-mgmt"}
+	m := &FPGADevicePlugin{scanned: []Device{
+		{DBDF: "0000:82:00.1-0", SN: "XFL1U30A"},
+		{DBDF: "0000:82:00.1-1", SN: "XFL1U30A"},
+		{DBDF: "0000:83:00.1-0", SN: "XFL1U30A"},
+		{DBDF: "0000:3b:00.1", SN: AWS_SN},
+	}}
+	synced := map[string][]DeviceHolder{"0000:82:00.1-1": {worker}, "0000:82:00.1": {monitor}}
+	tests := []struct {
+		name    string
+		holders map[string][]DeviceHolder
+		err     string
+		query   string
+		code    int
+		free    string
+		ids     []string
+	}{
+		{"all devices", synced, "", "", 200, "",
+			[]string{"0000:3b:00.1", "0000:82:00.1", "0000:82:00.1-0", "0000:82:00.1-1", "0000:83:00.1-0"}},
+		{"all devices before the first sync", nil, "", "", 200, "",
+			[]string{"0000:3b:00.1", "0000:82:00.1-0", "0000:82:00.1-1", "0000:83:00.1-0"}},
+		{"held card", synced, "", "?sn=XFL1U30A", 200, "false",
+			[]string{"0000:82:00.1", "0000:82:00.1-0", "0000:82:00.1-1", "0000:83:00.1-0"}},
+		{"free function", synced, "", "?bdf=0000:83:00.1", 200, "true", []string{"0000:83:00.1-0"}},
+		{"held through the mgmt resource", map[string][]DeviceHolder{"0000:82:00.1": {monitor}}, "", "?bdf=0000:82:00.1", 200, "false",
+			[]string{"0000:82:00.1", "0000:82:00.1-0", "0000:82:00.1-1"}},
+		{"bdf and sn", synced, "", "?bdf=0000:83:00.1&sn=XFL1U30A", 200, "true", []string{"0000:83:00.1-0"}},
+		{"bdf of another card", synced, "", "?bdf=0000:83:00.1&sn=XFL1U30B", 404, "", []string{}},
+		{"unknown bdf", synced, "", "?bdf=0000:99:00.1", 404, "", []string{}},
+		// the AWS cards share the serial number, it doesn't tell them apart
+		{"AWS serial number", synced, "", "?sn=" + AWS_SN, 404, "", []string{}},
+		{"not synced yet", nil, "", "?bdf=0000:83:00.1", 503, "", []string{"0000:83:00.1-0"}},
+		{"last refresh failed", synced, "connection refused", "?sn=XFL1U30A", 503, "",
+			[]string{"0000:82:00.1", "0000:82:00.1-0", "0000:82:00.1-1", "0000:83:00.1-0"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usePodMap(t, test.holders, test.err)
+			w := httptest.NewRecorder()
+			m.podsHandler(w, httptest.NewRequest("GET", "/pods"+test.query, nil))
+			if w.Code != test.code || w.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("got %d %s, want %d", w.Code, w.Header().Get("Content-Type"), test.code)
+			}
+			var report podsReport
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+				t.Fatalf("%v: %s", err, w.Body.String())
+			}
+			ids := []string{}
+			for _, pods := range report.Devices {
+				ids = append(ids, pods.ID)
+				if pods.Holders == nil {
+					t.Errorf("%s: null holders", pods.ID)
+				}
+			}
+			if !reflect.DeepEqual(ids, test.ids) {
+				t.Errorf("devices %v, want %v", ids, test.ids)
+			}
+			free := ""
+			if report.Free != nil {
+				free = map[bool]string{true: "true", false: "false"}[*report.Free]
+			}
+			if free != test.free {
+				t.Errorf("free %q, want %q", free, test.free)
+			}
+			if report.Error != test.err || (report.Synced == nil) != (test.holders == nil) {
+				t.Errorf("error %q synced %v", report.Error, report.Synced)
+			}
+		})
+	}
+}
+
+func TestCollectPods(t *testing.T) {
+	r := useMetrics(t)
+	usePodMap(t, map[string][]DeviceHolder{
+		"0000:3b:00.1": {{Namespace: "default", Pod: "worker", Container: "main", Resource: "amd.com/u250"}},
+	}, "")
+	m := &FPGADevicePlugin{scanned: []Device{{DBDF: "0000:3b:00.1", SN: "XFL1"}, {DBDF: "0000:3c:00.1", SN: "XFL2"}}}
+	m.collectPods()
+	text := metricsText(t, r)
+	line := `amd_fpga_device_pod_info{resource="amd.com/u250",device="0000:3b:00.1",bdf="0000:3b:00.1",sn="XFL1",namespace="default",pod="worker",container="main"} 1`
+	if !strings.Contains(text, line) || strings.Contains(text, "0000:3c:00.1") {
+		t.Errorf("pod metrics\n%s", text)
+	}
+
+	// the released devices are no longer reported
+	podMap.update(map[string][]DeviceHolder{})
+	m.collectPods()
+	if text := metricsText(t, r); strings.Contains(text, metricDevicePod+"{") {
+		t.Errorf("released device reported\n%s", text)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PodResourcesSocket is the kubelet PodResources API endpoint, the daemonset
+// has to mount /var/lib/kubelet/pod-resources for the plugin to reach it
+var PodResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+// listPodResources lists the devices assigned to every container by kubelet
+func listPodResources() (*podresourcesapi.ListPodResourcesResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, PodResourcesSocket, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := podresourcesapi.NewPodResourcesListerClient(conn)
+	return client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
+}
+
+// DeviceHolder is a container holding a device, according to kubelet
+type DeviceHolder struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	Resource  string `json:"resource"`
+}
+
+// getDeviceHolders returns the containers holding each device of the plugin,
+// according to kubelet. The devices are keyed by their ID in the resource,
+// the holders are sorted.
+func getDeviceHolders() (map[string][]DeviceHolder, error) {
+	resp, err := listPodResources()
+	if err != nil {
+		return nil, err
+	}
+	holders := make(map[string][]DeviceHolder)
+	for _, pod := range resp.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			for _, devices := range container.GetDevices() {
+				resourceName := devices.GetResourceName()
+				if !isPluginResource(resourceName) {
+					continue
+				}
+				for _, id := range devices.GetDeviceIds() {
+					holders[id] = append(holders[id], DeviceHolder{
+						Namespace: pod.GetNamespace(),
+						Pod:       pod.GetName(),
+						Container: container.GetName(),
+						Resource:  resourceName,
+					})
+				}
+			}
+		}
+	}
+	for _, deviceHolders := range holders {
+		sort.Slice(deviceHolders, func(i, j int) bool {
+			a, b := deviceHolders[i], deviceHolders[j]
+			if a.Namespace != b.Namespace {
+				return a.Namespace < b.Namespace
+			}
+			if a.Pod != b.Pod {
+				return a.Pod < b.Pod
+			}
+			if a.Container != b.Container {
+				return a.Container < b.Container
+			}
+			return a.Resource < b.Resource
+		})
+	}
+	return holders, nil
+}
+
+// devicesInUse returns the resource holding each device of the plugin, keyed
+// by physicalDeviceID
+func devicesInUse(holders map[string][]DeviceHolder) map[string]string {
+	inUse := make(map[string]string)
+	for id, deviceHolders := range holders {
+		for _, holder := range deviceHolders {
+			// kubelet only tells the resource, the dedicated mgmt resources
+			// are the only ones named with MgmtResourceSuffix
+			mgmt := strings.HasSuffix(holder.Resource, MgmtResourceSuffix)
+			inUse[physicalDeviceID(id, mgmt)] = holder.Resource
+		}
+	}
+	return inUse
+}
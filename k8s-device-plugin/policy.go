@@ -0,0 +1,154 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"strings"
+)
+
+// Policies for assigning the mgmt PF node (/dev/xclmgmt*) to containers
+const (
+	// the mgmt PF is assigned with MgmtPermissions, this is the legacy behaviour
+	MgmtPolicyReadWrite = "ReadWrite"
+	// the mgmt PF is assigned without write permission and mounted read only
+	MgmtPolicyReadOnly = "ReadOnly"
+	// the mgmt PF is never assigned to containers
+	MgmtPolicyOmit = "Omit"
+	// the mgmt PF is withheld from the tenant resource and is only handed out
+	// through a separate privileged resource
+	MgmtPolicyDedicated = "Dedicated"
+)
+
+// MgmtResourceSuffix is appended to the device type of a resource with the
+// Dedicated mgmt policy to name its mgmt resource, e.g. amd.com/<shell>-mgmt.
+// The other resource names can't end with it.
+const MgmtResourceSuffix = "-mgmt"
+
+// isMgmtDevices tells whether the devices are the ones of a dedicated mgmt
+// resource
+func isMgmtDevices(devices map[string]Device) bool {
+	for _, device := range devices {
+		return device.mgmtOnly
+	}
+	return false
+}
+
+func parseMgmtPolicy(value string) (string, error) {
+	for _, policy := range []string{MgmtPolicyReadWrite, MgmtPolicyReadOnly, MgmtPolicyOmit, MgmtPolicyDedicated} {
+		if strings.EqualFold(strings.TrimSpace(value), policy) {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("invalid mgmt policy %q, expect one of %s, %s, %s, %s", value,
+		MgmtPolicyReadWrite, MgmtPolicyReadOnly, MgmtPolicyOmit, MgmtPolicyDedicated)
+}
+
+// getMgmtPolicy returns the mgmt PF policy of the given resource (device type)
+func getMgmtPolicy(devType string) string {
+	if policy, ok := cfg().MgmtResourcePolicy[devType]; ok {
+		return policy
+	}
+	return cfg().MgmtPolicy
+}
+
+// isValidPermissions checks a device cgroup permission string, which is any
+// non-empty combination of r(ead), w(rite) and m(knod)
+func isValidPermissions(perm string) bool {
+	if perm == "" {
+		return false
+	}
+	for _, c := range perm {
+		if !strings.ContainsRune("rwm", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendDeviceNode assigns a host device node to the container, both in the
+// device cgroup and as a mount. The mount is read only when the permissions
+// don't allow writing.
+func appendDeviceNode(cres *pluginapi.ContainerAllocateResponse, node string, perm string) {
+	cres.Devices = append(cres.Devices, &pluginapi.DeviceSpec{
+		HostPath:      node,
+		ContainerPath: node,
+		Permissions:   perm,
+	})
+	cres.Mounts = append(cres.Mounts, &pluginapi.Mount{
+		HostPath:      node,
+		ContainerPath: node,
+		ReadOnly:      !strings.Contains(perm, "w"),
+	})
+}
+
+// appendDeviceNodes assigns all the nodes of a device to the container,
+// according to the mgmt PF policy of the resource
+func appendDeviceNodes(cres *pluginapi.ContainerAllocateResponse, devType string, dev Device) {
+	// When containers are on top of VM, it is possible only user PF is assigned
+	// to VM, so the Mgmt is empty. Don't add it to cgroup in that case
+	if dev.Nodes.Mgmt != "" {
+		switch getMgmtPolicy(devType) {
+		case MgmtPolicyReadWrite:
+			appendDeviceNode(cres, dev.Nodes.Mgmt, cfg().MgmtPermissions)
+		case MgmtPolicyReadOnly:
+			perm := strings.Replace(cfg().MgmtPermissions, "w", "", -1)
+			if perm == "" {
+				perm = "r"
+			}
+			appendDeviceNode(cres, dev.Nodes.Mgmt, perm)
+		}
+	}
+	appendDeviceNode(cres, dev.Nodes.User, cfg().UserPermissions)
+	// if this device supports qdma, assign the qdma node to pod too
+	if dev.Nodes.Qdma != "" {
+		appendDeviceNode(cres, dev.Nodes.Qdma, cfg().QdmaPermissions)
+	}
+}
+
+// addMgmtDevices adds a dedicated mgmt resource for every device type with the
+// Dedicated mgmt policy. The mgmt resource has one device per mgmt PF, so the
+// virtual devices sharing a card are not counted more than once. The device
+// keeps its Pairs, so the mgmt node handed out is the one of the intended card.
+func addMgmtDevices(devMap map[string]map[string]Device) {
+	mgmtMap := make(map[string]map[string]Device)
+	for devType, devices := range devMap {
+		if getMgmtPolicy(devType) != MgmtPolicyDedicated {
+			continue
+		}
+		mgmtDevices := make(map[string]Device)
+		mgmtNodes := make(map[string]bool)
+		for _, device := range devices {
+			if device.Nodes.Mgmt == "" || mgmtNodes[device.Nodes.Mgmt] {
+				continue
+			}
+			mgmtNodes[device.Nodes.Mgmt] = true
+			// strip the index of virtual device, the mgmt device is the card itself
+			device.DBDF = GetPciBDF(device.DBDF)
+			device.mgmtOnly = true
+			mgmtDevices[device.DBDF] = device
+		}
+		if len(mgmtDevices) != 0 {
+			mgmtMap[devType+MgmtResourceSuffix] = mgmtDevices
+		}
+	}
+	for mgmtType, mgmtDevices := range mgmtMap {
+		devMap[mgmtType] = mgmtDevices
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"reflect"
+	"testing"
+)
+
+func TestParseMgmtPolicy(t *testing.T) {
+	tests := map[string]string{
+		"ReadWrite":   MgmtPolicyReadWrite,
+		"readonly":    MgmtPolicyReadOnly,
+		" OMIT ":      MgmtPolicyOmit,
+		"Dedicated\n": MgmtPolicyDedicated,
+		"":            "",
+		"Read-Only":   "",
+		"None":        "",
+	}
+	for value, want := range tests {
+		policy, err := parseMgmtPolicy(value)
+		if want == "" {
+			if err == nil {
+				t.Errorf("%q: got %s, want an error", value, policy)
+			}
+			continue
+		}
+		if err != nil || policy != want {
+			t.Errorf("%q: got %s, %v, want %s", value, policy, err, want)
+		}
+	}
+}
+
+func TestGetMgmtPolicy(t *testing.T) {
+	c := defaultConfig()
+	c.MgmtPolicy = MgmtPolicyOmit
+	c.MgmtResourcePolicy = map[string]string{"ama_u30": MgmtPolicyReadOnly}
+	useConfig(t, c)
+
+	if policy := getMgmtPolicy("ama_u30"); policy != MgmtPolicyReadOnly {
+		t.Errorf("ama_u30: got %s", policy)
+	}
+	if policy := getMgmtPolicy("u250"); policy != MgmtPolicyOmit {
+		t.Errorf("u250: got %s, want the default policy", policy)
+	}
+}
+
+func TestIsValidPermissions(t *testing.T) {
+	for perm, valid := range map[string]bool{
+		"rwm": true,
+		"r":   true,
+		"mw":  true,
+		"rr":  true,
+		"":    false,
+		"rwx": false,
+		"RW":  false,
+		"r w": false,
+	} {
+		if isValidPermissions(perm) != valid {
+			t.Errorf("%q: valid %v, want %v", perm, !valid, valid)
+		}
+	}
+}
+
+func TestAppendDeviceNodes(t *testing.T) {
+	c := defaultConfig()
+	c.UserPermissions, c.QdmaPermissions = "rw", "r"
+	useConfig(t, c)
+
+	card := Device{Nodes: &Pairs{Mgmt: "/dev/xclmgmt15104", User: "/dev/dri/renderD128", Qdma: "/dev/xfpga/xdma0"}}
+	vm := Device{Nodes: &Pairs{User: "/dev/dri/renderD129"}}
+	user := &pluginapi.DeviceSpec{HostPath: "/dev/dri/renderD128", ContainerPath: "/dev/dri/renderD128", Permissions: "rw"}
+	qdma := &pluginapi.DeviceSpec{HostPath: "/dev/xfpga/xdma0", ContainerPath: "/dev/xfpga/xdma0", Permissions: "r"}
+	tests := []struct {
+		name     string
+		policy   string
+		mgmtPerm string
+		device   Device
+		// want are the device specs, a mount is expected for each of them
+		want []*pluginapi.DeviceSpec
+	}{
+		{
+			name:     "read write",
+			policy:   MgmtPolicyReadWrite,
+			mgmtPerm: "rwm",
+			device:   card,
+			want: []*pluginapi.DeviceSpec{
+				{HostPath: "/dev/xclmgmt15104", ContainerPath: "/dev/xclmgmt15104", Permissions: "rwm"},
+				user, qdma,
+			},
+		},
+		{
+			name:     "read only drops the write permission",
+			policy:   MgmtPolicyReadOnly,
+			mgmtPerm: "rwm",
+			device:   card,
+			want: []*pluginapi.DeviceSpec{
+				{HostPath: "/dev/xclmgmt15104", ContainerPath: "/dev/xclmgmt15104", Permissions: "rm"},
+				user, qdma,
+			},
+		},
+		{
+			name:     "read only keeps a readable node",
+			policy:   MgmtPolicyReadOnly,
+			mgmtPerm: "w",
+			device:   card,
+			want: []*pluginapi.DeviceSpec{
+				{HostPath: "/dev/xclmgmt15104", ContainerPath: "/dev/xclmgmt15104", Permissions: "r"},
+				user, qdma,
+			},
+		},
+		{name: "omit", policy: MgmtPolicyOmit, mgmtPerm: "rwm", device: card, want: []*pluginapi.DeviceSpec{user, qdma}},
+		{name: "dedicated", policy: MgmtPolicyDedicated, mgmtPerm: "rwm", device: card, want: []*pluginapi.DeviceSpec{user, qdma}},
+		{
+			name:     "no mgmt PF in a VM",
+			policy:   MgmtPolicyReadWrite,
+			mgmtPerm: "rwm",
+			device:   vm,
+			want: []*pluginapi.DeviceSpec{
+				{HostPath: "/dev/dri/renderD129", ContainerPath: "/dev/dri/renderD129", Permissions: "rw"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c.MgmtPolicy, c.MgmtPermissions = test.policy, test.mgmtPerm
+			cres := new(pluginapi.ContainerAllocateResponse)
+			appendDeviceNodes(cres, "u250", test.device)
+			if !reflect.DeepEqual(cres.Devices, test.want) {
+				t.Errorf("devices %v, want %v", cres.Devices, test.want)
+			}
+			if len(cres.Mounts) != len(test.want) {
+				t.Fatalf("%d mounts, want %d", len(cres.Mounts), len(test.want))
+			}
+			for i, mount := range cres.Mounts {
+				spec := test.want[i]
+				readOnly := spec.Permissions == "r" || spec.Permissions == "rm"
+				if mount.HostPath != spec.HostPath || mount.ContainerPath != spec.ContainerPath || mount.ReadOnly != readOnly {
+					t.Errorf("mount %v of %s, want read only %v", mount, spec.HostPath, readOnly)
+				}
+			}
+		})
+	}
+}
+
+func TestAddMgmtDevices(t *testing.T) {
+	c := defaultConfig()
+	c.MgmtResourcePolicy = map[string]string{"u250": MgmtPolicyDedicated, "u280": MgmtPolicyDedicated}
+	useConfig(t, c)
+
+	u250a := Device{DBDF: "0000:3b:00.1", Nodes: &Pairs{Mgmt: "/dev/xclmgmt15104", User: "/dev/dri/renderD128"}}
+	u250b := Device{DBDF: "0000:3c:00.1", Nodes: &Pairs{Mgmt: "/dev/xclmgmt15360", User: "/dev/dri/renderD129"}}
+	u30 := Device{DBDF: "0000:5e:00.1", Nodes: &Pairs{Mgmt: "/dev/xclmgmt24064", User: "/dev/dri/renderD130"}}
+	// without a mgmt PF there is no mgmt device
+	u280 := Device{DBDF: "0000:af:00.1", Nodes: &Pairs{User: "/dev/dri/renderD131"}}
+
+	c.VirtualDev = false
+	devMap := map[string]map[string]Device{
+		"u250":    {u250a.DBDF: u250a, u250b.DBDF: u250b},
+		"ama_u30": {u30.DBDF: u30},
+		"u280":    {u280.DBDF: u280},
+	}
+	addMgmtDevices(devMap)
+	mgmtA, mgmtB := u250a, u250b
+	mgmtA.mgmtOnly, mgmtB.mgmtOnly = true, true
+	want := map[string]map[string]Device{
+		"u250":      {u250a.DBDF: u250a, u250b.DBDF: u250b},
+		"u250-mgmt": {u250a.DBDF: mgmtA, u250b.DBDF: mgmtB},
+		"ama_u30":   {u30.DBDF: u30},
+		"u280":      {u280.DBDF: u280},
+	}
+	if !reflect.DeepEqual(devMap, want) {
+		t.Errorf("got %v, want %v", devMap, want)
+	}
+
+	// the virtual devices of a card share a single mgmt device
+	c.VirtualDev = true
+	devMap = map[string]map[string]Device{"u250": {}}
+	for _, id := range []string{"0000:3b:00.1-0", "0000:3b:00.1-1", "0000:3b:00.1-2"} {
+		device := u250a
+		device.DBDF = id
+		devMap["u250"][id] = device
+	}
+	addMgmtDevices(devMap)
+	mgmt, ok := devMap["u250-mgmt"]["0000:3b:00.1"]
+	if len(devMap["u250-mgmt"]) != 1 || !ok || !mgmt.mgmtOnly || mgmt.Nodes.Mgmt != u250a.Nodes.Mgmt {
+		t.Errorf("mgmt devices %v, want the card only", devMap["u250-mgmt"])
+	}
+	if len(devMap["u250"]) != 3 {
+		t.Errorf("virtual devices %v changed", devMap["u250"])
+	}
+}
+
+func TestAllocateMgmtOnly(t *testing.T) {
+	c := defaultConfig()
+	c.MgmtPermissions = "rw"
+	useConfig(t, c)
+
+	device := Device{DBDF: "0000:3b:00.1", Nodes: &Pairs{Mgmt: "/dev/xclmgmt15104", User: "/dev/dri/renderD128", Qdma: "/dev/xfpga/xdma0"}}
+	plugin := &FPGADevicePlugin{ctx: context.Background()}
+	// the devices tell the mgmt resource, not its name
+	user := plugin.NewFPGADevicePluginServer("u250"+MgmtResourceSuffix, map[string]Device{device.DBDF: device}, c.ResourceDomain)
+	device.mgmtOnly = true
+	server := plugin.NewFPGADevicePluginServer("u250"+MgmtResourceSuffix, map[string]Device{device.DBDF: device}, c.ResourceDomain)
+	if !server.mgmtOnly || user.mgmtOnly || plugin.NewFPGADevicePluginServer("u250", nil, c.ResourceDomain).mgmtOnly {
+		t.Fatalf("only the devices of a dedicated mgmt resource hand out the mgmt PF alone")
+	}
+
+	resp, err := server.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{device.DBDF}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*pluginapi.DeviceSpec{{HostPath: "/dev/xclmgmt15104", ContainerPath: "/dev/xclmgmt15104", Permissions: "rw"}}
+	if len(resp.ContainerResponses) != 1 || !reflect.DeepEqual(resp.ContainerResponses[0].Devices, want) {
+		t.Errorf("got %v, want the mgmt node only", resp.ContainerResponses)
+	}
+
+	_, err = server.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{{DevicesIDs: []string{"0000:3c:00.1"}}},
+	})
+	if err == nil {
+		t.Errorf("allocated a non-existing mgmt device")
+	}
+}
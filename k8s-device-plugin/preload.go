@@ -0,0 +1,187 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	XclbinUUIDFile = "xclbinuuid"
+	// the xclbin file starts with the magic, axlf_header is at 0x130, the
+	// platform VBNV at 0x170 and the uuid of the xclbin at 0x1b0
+	XclbinMagic      = "xclbin2\x00"
+	XclbinUUIDOffset = 0x1b0
+	XclbinUUIDSize   = 16
+)
+
+// XclbinPreload binds a resource to an xclbin in the node-local cache
+type XclbinPreload struct {
+	// xclbin file, relative to XclbinCacheDir
+	Xclbin string `json:"xclbin"`
+	// sha256 checksum of the xclbin file
+	Sha256 string `json:"sha256"`
+}
+
+var preloadLock sync.Mutex
+
+// loadXclbinPreloads reads the resource to xclbin bindings from a json file
+// like {"<resource>": {"xclbin": "vadd.xclbin", "sha256": "..."}}
+func loadXclbinPreloads(fname string) (map[string]*XclbinPreload, error) {
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]*XclbinPreload
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("Can't parse %s: %v", fname, err)
+	}
+	preloads := make(map[string]*XclbinPreload)
+	for resource, preload := range raw {
+		if preload == nil || preload.Xclbin == "" {
+			return nil, fmt.Errorf("no xclbin for resource %s in %s", resource, fname)
+		}
+		if len(preload.Sha256) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid sha256 for resource %s in %s", resource, fname)
+		}
+		preload.Sha256 = strings.ToLower(preload.Sha256)
+		preloads[trimResourceDomain(resource)] = preload
+	}
+	return preloads, nil
+}
+
+// getXclbinPreload returns the xclbin bound to the resource, or nil
+func getXclbinPreload(devType string) *XclbinPreload {
+	return cfg().XclbinPreloads[devType]
+}
+
+func (p *XclbinPreload) path() string {
+	return path.Join(cfg().XclbinCacheDir, p.Xclbin)
+}
+
+// normalizeUUID drops the dashes so the uuids from sysfs and from the xclbin
+// compare equal
+func normalizeUUID(uuid string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(uuid), "-", "", -1))
+}
+
+// getXclbinUUID reads the uuid from the header of an xclbin file
+func getXclbinUUID(fname string) (string, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	header := make([]byte, XclbinUUIDOffset+XclbinUUIDSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return "", fmt.Errorf("Can't read xclbin header of %s: %v", fname, err)
+	}
+	if !bytes.HasPrefix(header, []byte(XclbinMagic)) {
+		return "", fmt.Errorf("%s is not an xclbin file", fname)
+	}
+	return hex.EncodeToString(header[XclbinUUIDOffset:]), nil
+}
+
+// getLoadedXclbinUUID reads the uuid of the xclbin loaded on the device, an
+// empty uuid means it is unknown
+func getLoadedXclbinUUID(dev Device) string {
+	content, err := GetFileContent(path.Join(SysfsDevices, GetPciBDF(dev.DBDF), XclbinUUIDFile))
+	if err != nil {
+		return ""
+	}
+	return normalizeUUID(content)
+}
+
+// verifyChecksum checks the sha256 checksum of the cached xclbin
+func (p *XclbinPreload) verifyChecksum() error {
+	file, err := os.Open(p.path())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != p.Sha256 {
+		return fmt.Errorf("checksum mismatch of %s: %s, expect %s", p.path(), sum, p.Sha256)
+	}
+	return nil
+}
+
+// load programs the xclbin onto the device unless it is loaded already
+func (p *XclbinPreload) load(dev Device) error {
+	preloadLock.Lock()
+	defer preloadLock.Unlock()
+
+	uuid, err := getXclbinUUID(p.path())
+	if err != nil {
+		return err
+	}
+	if loaded := getLoadedXclbinUUID(dev); loaded == uuid {
+		preloadLog.WithFields(deviceFields(dev)).Debugf("xclbin %s is loaded on device %s already", p.Xclbin, dev.DBDF)
+		return nil
+	}
+	if err := p.verifyChecksum(); err != nil {
+		return err
+	}
+	preloadLog.WithFields(deviceFields(dev)).Printf("Loading xclbin %s onto device %s", p.Xclbin, dev.DBDF)
+	if err := runDeviceCommand(cfg().XclbinLoadCommand, dev, time.Duration(cfg().XclbinLoadTimeout)*time.Second, "{XCLBIN}", p.path()); err != nil {
+		return fmt.Errorf("Can't load xclbin %s onto device %s: %v", p.Xclbin, dev.DBDF, err)
+	}
+	if loaded := getLoadedXclbinUUID(dev); loaded != "" && loaded != uuid {
+		return fmt.Errorf("xclbin %s is loaded onto device %s, but the device reports uuid %s", p.Xclbin, dev.DBDF, loaded)
+	}
+	return nil
+}
+
+// preloadDevices loads the xclbin bound to the resource onto every allocated card
+func (m *FPGADevicePluginServer) preloadDevices(ids []string) error {
+	preload := getXclbinPreload(m.devType)
+	if preload == nil {
+		return nil
+	}
+	loaded := make(map[string]bool)
+	devices := m.currentDevices()
+	for _, id := range m.addCardSiblings(ids) {
+		dev, ok := devices[id]
+		if !ok {
+			return fmt.Errorf("invalid prestart request: unknown device: %s", id)
+		}
+		bdf := GetPciBDF(dev.DBDF)
+		if loaded[bdf] {
+			continue
+		}
+		loaded[bdf] = true
+		if err := preload.load(dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
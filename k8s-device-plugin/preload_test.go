@@ -0,0 +1,284 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// preloadFixture moves SysfsDevices and the xclbin cache to a temporary
+// tree, and puts a config without preloads in force until the test ends. The
+// test binds the xclbins through the returned config.
+func preloadFixture(t *testing.T) (string, *RuntimeConfig) {
+	root := t.TempDir()
+	sysfs := SysfsDevices
+	t.Cleanup(func() { SysfsDevices = sysfs })
+	SysfsDevices = path.Join(root, "sys")
+	c := defaultConfig()
+	c.XclbinCacheDir = path.Join(root, "cache")
+	if err := os.MkdirAll(c.XclbinCacheDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, c)
+	return root, cfg()
+}
+
+// writeXclbin writes an xclbin file with the uuid in its header to the cache
+// and returns its preload binding
+func writeXclbin(t *testing.T, name string, uuid string) *XclbinPreload {
+	raw, err := hex.DecodeString(normalizeUUID(uuid))
+	if err != nil || len(raw) != XclbinUUIDSize {
+		t.Fatalf("invalid uuid %s", uuid)
+	}
+	content := make([]byte, XclbinUUIDOffset+XclbinUUIDSize+64)
+	copy(content, XclbinMagic)
+	copy(content[XclbinUUIDOffset:], raw)
+	if err := ioutil.WriteFile(path.Join(cfg().XclbinCacheDir, name), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	return &XclbinPreload{Xclbin: name, Sha256: hex.EncodeToString(sum[:])}
+}
+
+// setLoadedUUID writes the uuid the driver reports for the device
+func setLoadedUUID(t *testing.T, bdf string, uuid string) {
+	dir := path.Join(SysfsDevices, bdf)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, XclbinUUIDFile), []byte(uuid+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadXclbinPreloads(t *testing.T) {
+	sum := strings.Repeat("AB", sha256.Size)
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		err     string
+	}{
+		{
+			name:    "resource prefix is dropped",
+			content: `{"amd.com/u250": {"xclbin": "vadd.xclbin", "sha256": "` + sum + `"}, "u280": {"xclbin": "u280/mm.xclbin", "sha256": "` + sum + `"}}`,
+			want:    map[string]string{"u250": "vadd.xclbin", "u280": "u280/mm.xclbin"},
+		},
+		{name: "empty file", content: `{}`, want: map[string]string{}},
+		{name: "not json", content: `u250: vadd.xclbin`, err: "Can't parse"},
+		{name: "null binding", content: `{"u250": null}`, err: "no xclbin for resource u250"},
+		{name: "no xclbin", content: `{"u250": {"sha256": "` + sum + `"}}`, err: "no xclbin for resource u250"},
+		{name: "short checksum", content: `{"u250": {"xclbin": "vadd.xclbin", "sha256": "abcd"}}`, err: "invalid sha256"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fname := path.Join(t.TempDir(), "XclbinPreload.json")
+			if err := ioutil.WriteFile(fname, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			preloads, err := loadXclbinPreloads(fname)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got %v, want error %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(preloads) != len(test.want) {
+				t.Errorf("got %d preloads, want %d", len(preloads), len(test.want))
+			}
+			for resource, xclbin := range test.want {
+				if preload := preloads[resource]; preload == nil || preload.Xclbin != xclbin || preload.Sha256 != strings.ToLower(sum) {
+					t.Errorf("%s: got %+v, want %s", resource, preload, xclbin)
+				}
+			}
+		})
+	}
+	if _, err := loadXclbinPreloads(path.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("missing file loaded")
+	}
+}
+
+func TestGetXclbinUUID(t *testing.T) {
+	preloadFixture(t)
+	uuid := "0123456789ab-cdef-0123-4567-89abcdef"
+	preload := writeXclbin(t, "vadd.xclbin", uuid)
+	if got, err := getXclbinUUID(preload.path()); err != nil || got != normalizeUUID(uuid) {
+		t.Errorf("got %s, %v, want %s", got, err, normalizeUUID(uuid))
+	}
+
+	content, _ := ioutil.ReadFile(preload.path())
+	for name, bad := range map[string][]byte{
+		"truncated.xclbin": content[:XclbinUUIDOffset+4],
+		"xclbin1.xclbin":   append([]byte("xclbin0\x00"), content[8:]...),
+		"empty.xclbin":     nil,
+	} {
+		fname := path.Join(cfg().XclbinCacheDir, name)
+		if err := ioutil.WriteFile(fname, bad, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := getXclbinUUID(fname); err == nil {
+			t.Errorf("%s: got uuid %s, want an error", name, got)
+		}
+	}
+}
+
+// axlf is the start of an xclbin file as laid out by xclbin.h
+type axlf struct {
+	Magic           [8]byte
+	SignatureLength int32
+	Reserved        [28]byte
+	KeyBlock        [256]byte
+	UniqueID        uint64
+	// axlf_header
+	Length              uint64
+	TimeStamp           uint64
+	FeatureRomTimeStamp uint64
+	VersionPatch        uint16
+	VersionMajor        uint8
+	VersionMinor        uint8
+	Mode                uint32
+	PlatformID          [16]byte
+	FeatureID           [16]byte
+	PlatformVBNV        [64]byte
+	UUID                [16]byte
+	DebugBin            [16]byte
+	NumSections         uint32
+}
+
+func TestGetXclbinUUIDAxlfLayout(t *testing.T) {
+	preloadFixture(t)
+	header := axlf{SignatureLength: -1, VersionMajor: 2, VersionMinor: 14, NumSections: 1}
+	copy(header.Magic[:], XclbinMagic)
+	copy(header.PlatformVBNV[:], "xilinx_u250_gen3x16_xdma_shell_4_1")
+	uuid := "6b7c1a4e-2f9d-4c3b-8e5a-0d1f2e3c4b5a"
+	raw, _ := hex.DecodeString(normalizeUUID(uuid))
+	copy(header.UUID[:], raw)
+	// the id of the platform precedes the VBNV, its bytes aren't the uuid
+	for i := range header.PlatformID {
+		header.PlatformID[i] = 0xff
+	}
+	var content bytes.Buffer
+	if err := binary.Write(&content, binary.LittleEndian, header); err != nil {
+		t.Fatal(err)
+	}
+	fname := path.Join(cfg().XclbinCacheDir, "layout.xclbin")
+	if err := ioutil.WriteFile(fname, content.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := getXclbinUUID(fname); err != nil || got != normalizeUUID(uuid) {
+		t.Errorf("got %s, %v, want %s", got, err, normalizeUUID(uuid))
+	}
+}
+
+func TestGetLoadedXclbinUUID(t *testing.T) {
+	preloadFixture(t)
+	dev := Device{DBDF: "0000:3b:00.1-2"}
+	if uuid := getLoadedXclbinUUID(dev); uuid != "" {
+		t.Errorf("got %q without the sysfs file", uuid)
+	}
+	// the driver may print the uuid with dashes and in upper case
+	setLoadedUUID(t, "0000:3b:00.1", " 01234567-89AB-CDEF-0123-456789ABCDEF")
+	if uuid := getLoadedXclbinUUID(dev); uuid != "0123456789abcdef0123456789abcdef" {
+		t.Errorf("got %q", uuid)
+	}
+}
+
+func TestPreloadDevices(t *testing.T) {
+	uuid := "0123456789abcdef0123456789abcdef"
+	newServer := func(root string, ids ...string) *FPGADevicePluginServer {
+		m := &FPGADevicePluginServer{devType: "u250", devices: map[string]Device{}}
+		for _, id := range ids {
+			m.devices[id] = Device{DBDF: id, Nodes: &Pairs{User: path.Join(root, id)}}
+		}
+		return m
+	}
+
+	t.Run("no binding", func(t *testing.T) {
+		root, rc := preloadFixture(t)
+		rc.XclbinPreloads = map[string]*XclbinPreload{}
+		rc.XclbinLoadCommand = "false"
+		if err := newServer(root, "0000:3b:00.1").preloadDevices([]string{"0000:3b:00.1"}); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("loaded once per card", func(t *testing.T) {
+		root, rc := preloadFixture(t)
+		rc.XclbinPreloads = map[string]*XclbinPreload{"u250": writeXclbin(t, "vadd.xclbin", uuid)}
+		// mkdir fails if the same card is loaded twice
+		rc.XclbinLoadCommand = "mkdir " + path.Join(root, "{BDF}")
+		m := newServer(root, "0000:3b:00.1-0", "0000:3b:00.1-1", "0000:3c:00.1-0")
+		if err := m.preloadDevices([]string{"0000:3b:00.1-0", "0000:3b:00.1-1", "0000:3c:00.1-0"}); err != nil {
+			t.Fatal(err)
+		}
+		for _, bdf := range []string{"0000:3b:00.1", "0000:3c:00.1"} {
+			if !FileExist(path.Join(root, bdf)) {
+				t.Errorf("xclbin not loaded onto %s", bdf)
+			}
+		}
+		if err := m.preloadDevices([]string{"0000:5e:00.1"}); err == nil {
+			t.Errorf("unknown device loaded")
+		}
+	})
+	t.Run("loaded already", func(t *testing.T) {
+		root, rc := preloadFixture(t)
+		rc.XclbinPreloads = map[string]*XclbinPreload{"u250": writeXclbin(t, "vadd.xclbin", uuid)}
+		rc.XclbinLoadCommand = "false"
+		setLoadedUUID(t, "0000:3b:00.1", uuid)
+		if err := newServer(root, "0000:3b:00.1").preloadDevices([]string{"0000:3b:00.1"}); err != nil {
+			t.Errorf("loaded xclbin loaded again: %v", err)
+		}
+	})
+	t.Run("checksum mismatch", func(t *testing.T) {
+		root, rc := preloadFixture(t)
+		preload := writeXclbin(t, "vadd.xclbin", uuid)
+		preload.Sha256 = strings.Repeat("0", sha256.Size*2)
+		rc.XclbinPreloads = map[string]*XclbinPreload{"u250": preload}
+		rc.XclbinLoadCommand = "mkdir " + path.Join(root, "{BDF}")
+		err := newServer(root, "0000:3b:00.1").preloadDevices([]string{"0000:3b:00.1"})
+		if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Errorf("got %v, want a checksum mismatch", err)
+		}
+		if FileExist(path.Join(root, "0000:3b:00.1")) {
+			t.Errorf("xclbin loaded despite the checksum mismatch")
+		}
+	})
+	t.Run("device reports another uuid", func(t *testing.T) {
+		root, rc := preloadFixture(t)
+		rc.XclbinPreloads = map[string]*XclbinPreload{"u250": writeXclbin(t, "vadd.xclbin", uuid)}
+		rc.XclbinLoadCommand = "cp {XCLBIN} " + path.Join(root, "loaded.xclbin")
+		setLoadedUUID(t, "0000:3b:00.1", strings.Repeat("f", 32))
+		err := newServer(root, "0000:3b:00.1").preloadDevices([]string{"0000:3b:00.1"})
+		if err == nil || !strings.Contains(err.Error(), "reports uuid") {
+			t.Errorf("got %v, want a uuid mismatch", err)
+		}
+		if !FileExist(path.Join(root, "loaded.xclbin")) {
+			t.Errorf("{XCLBIN} not replaced with the cached xclbin")
+		}
+	})
+}
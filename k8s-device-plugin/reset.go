@@ -0,0 +1,193 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Modes of resetting the allocated cards before a container starts, so the
+// bitstream and memory contents of the previous tenant are gone
+const (
+	// cards are not reset, PreStartContainer is not required
+	ResetModeOff = "Off"
+	// cards are hot reset through the xclmgmt node of their mgmt PF, which
+	// clears the bitstream and the card memory
+	ResetModeMgmt = "Mgmt"
+	// ResetModeSysfs is the former name of ResetModeMgmt, a PCI reset of the
+	// user PF through sysfs doesn't clear the card
+	ResetModeSysfs = "Sysfs"
+	// cards are reset by running ResetCommand
+	ResetModeCommand = "Command"
+
+	ReadyFile = "ready"
+
+	// XclmgmtHotReset is the XCLMGMT_IOCHOTRESET ioctl of the xclmgmt
+	// driver, _IO('X', XCLMGMT_IOC_HOT_RESET)
+	XclmgmtHotReset = 'X'<<8 | 4
+)
+
+func parseResetMode(value string) (string, error) {
+	if strings.EqualFold(strings.TrimSpace(value), ResetModeSysfs) {
+		return ResetModeMgmt, nil
+	}
+	for _, mode := range []string{ResetModeOff, ResetModeMgmt, ResetModeCommand} {
+		if strings.EqualFold(strings.TrimSpace(value), mode) {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("invalid reset mode %q, expect one of %s, %s, %s", value, ResetModeOff, ResetModeMgmt, ResetModeCommand)
+}
+
+// hotResetCard resets the card through the xclmgmt node of its mgmt PF
+func hotResetCard(mgmtNode string) error {
+	file, err := os.OpenFile(mgmtNode, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), XclmgmtHotReset, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// expandDeviceArgs splits a command line into arguments and replaces the
+// placeholders {BDF}, {SN}, {SHELL}, {USER} and {MGMT} with the values of the
+// device, plus the extra old, new placeholder pairs. The command is not run
+// through a shell.
+func expandDeviceArgs(command string, dev Device, extra ...string) []string {
+	replacer := strings.NewReplacer(append([]string{
+		"{BDF}", GetPciBDF(dev.DBDF),
+		"{SN}", dev.SN,
+		"{SHELL}", dev.shellVer,
+		"{USER}", dev.Nodes.User,
+		"{MGMT}", dev.Nodes.Mgmt,
+	}, extra...)...)
+	args := strings.Fields(command)
+	for i := range args {
+		args[i] = replacer.Replace(args[i])
+	}
+	return args
+}
+
+// runDeviceCommand runs a configured command for the device, it fails if the
+// command doesn't finish within the timeout
+func runDeviceCommand(command string, dev Device, timeout time.Duration, extra ...string) error {
+	args := expandDeviceArgs(command, dev, extra...)
+	if len(args) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	commandLog.WithFields(deviceFields(dev)).Debugf("%s: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+	return nil
+}
+
+// isDeviceReady checks the device is back after a reset: the user PF node is
+// there and the driver reports the device ready, if it reports it at all
+func isDeviceReady(dev Device) bool {
+	if !FileExist(dev.Nodes.User) {
+		return false
+	}
+	fname := path.Join(SysfsDevices, GetPciBDF(dev.DBDF), ReadyFile)
+	if !FileExist(fname) {
+		return true
+	}
+	content, err := GetFileContent(fname)
+	if err != nil {
+		return false
+	}
+	ready, err := strconv.ParseUint(strings.TrimSpace(content), 0, 64)
+	return err == nil && ready != 0
+}
+
+// waitDeviceReady waits for the device to become ready again after a reset
+func waitDeviceReady(dev Device, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !isDeviceReady(dev) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("device %s is not ready %v after reset", dev.DBDF, timeout)
+		}
+		time.Sleep(time.Second)
+	}
+	return nil
+}
+
+// resetDevice resets one device and waits for it to come back
+func resetDevice(dev Device) error {
+	timeout := time.Duration(cfg().ResetTimeout) * time.Second
+	resetLog.WithFields(deviceFields(dev)).Printf("Resetting device %s", dev.DBDF)
+	switch cfg().ResetMode {
+	case ResetModeMgmt:
+		if dev.Nodes.Mgmt == "" {
+			return fmt.Errorf("Can't reset device %s: the card has no mgmt PF, use the %s reset mode", dev.DBDF, ResetModeCommand)
+		}
+		if err := hotResetCard(dev.Nodes.Mgmt); err != nil {
+			return fmt.Errorf("Can't reset device %s through %s: %v", dev.DBDF, dev.Nodes.Mgmt, err)
+		}
+	case ResetModeCommand:
+		if err := runDeviceCommand(cfg().ResetCommand, dev, timeout); err != nil {
+			return fmt.Errorf("Can't reset device %s: %v", dev.DBDF, err)
+		}
+	default:
+		return nil
+	}
+	if err := waitDeviceReady(dev, timeout); err != nil {
+		return err
+	}
+	resetLog.WithFields(deviceFields(dev)).Printf("Device %s is reset", dev.DBDF)
+	return nil
+}
+
+// resetDevices resets every card of the allocated devices once
+func (m *FPGADevicePluginServer) resetDevices(ids []string) error {
+	if cfg().VirtualDev {
+		m.logger().Warn("Device Plugin running in device-sharing mode, shared devices are not reset")
+		return nil
+	}
+	reset := make(map[string]bool)
+	devices := m.currentDevices()
+	for _, id := range m.addCardSiblings(ids) {
+		dev, ok := devices[id]
+		if !ok {
+			return fmt.Errorf("invalid prestart request: unknown device: %s", id)
+		}
+		bdf := GetPciBDF(dev.DBDF)
+		if reset[bdf] {
+			continue
+		}
+		reset[bdf] = true
+		if err := resetDevice(dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
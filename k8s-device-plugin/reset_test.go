@@ -0,0 +1,200 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// resetFixture moves SysfsDevices to a temporary tree and puts a config
+// with the reset mode in force, both are restored when the test ends
+func resetFixture(t *testing.T, mode string, command string) (string, *Config) {
+	root := t.TempDir()
+	sysfs := SysfsDevices
+	t.Cleanup(func() { SysfsDevices = sysfs })
+	SysfsDevices = path.Join(root, "sys")
+	c := defaultConfig()
+	c.ResetMode, c.ResetCommand, c.ResetTimeout = mode, command, 1
+	useConfig(t, c)
+	return root, c
+}
+
+// fixtureDevice creates the user node and the sysfs folder of a device, the
+// ready file is only written if ready isn't empty
+func fixtureDevice(t *testing.T, root string, bdf string, ready string) Device {
+	dir := path.Join(SysfsDevices, bdf)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if ready != "" {
+		if err := ioutil.WriteFile(path.Join(dir, ReadyFile), []byte(ready+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	user := path.Join(root, "renderD-"+bdf)
+	if err := ioutil.WriteFile(user, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Device{DBDF: bdf, SN: "XFL1A", shellVer: "xilinx_u250", Nodes: &Pairs{User: user, Mgmt: "/dev/xclmgmt1"}}
+}
+
+func TestParseResetMode(t *testing.T) {
+	for value, want := range map[string]string{
+		"off":     ResetModeOff,
+		"MGMT":    ResetModeMgmt,
+		"Command": ResetModeCommand,
+		// the former name of the mgmt reset
+		" sysfs\n": ResetModeMgmt,
+		"":         "",
+		"reboot":   "",
+	} {
+		mode, err := parseResetMode(value)
+		if mode != want || (err != nil) != (want == "") {
+			t.Errorf("parseResetMode(%q) = %q, %v, want %q", value, mode, err, want)
+		}
+	}
+}
+
+func TestExpandDeviceArgs(t *testing.T) {
+	dev := Device{DBDF: "0000:82:00.1-3", SN: "XFL1U30A", shellVer: "ama_u30", Nodes: &Pairs{User: "/dev/dri/renderD128"}}
+	got := expandDeviceArgs(" xbutil  reset -d {BDF} --sn={SN}{SHELL} {USER} '{MGMT}'", dev)
+	// the index of the virtual device is dropped, quotes are not parsed and
+	// missing nodes expand to nothing
+	want := []string{"xbutil", "reset", "-d", "0000:82:00.1", "--sn=XFL1U30Aama_u30", "/dev/dri/renderD128", "''"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if args := expandDeviceArgs("   ", dev); len(args) != 0 {
+		t.Errorf("blank command expanded to %q", args)
+	}
+}
+
+func TestIsDeviceReady(t *testing.T) {
+	root, _ := resetFixture(t, ResetModeMgmt, "")
+	for ready, want := range map[string]bool{
+		"":    true, // no ready file, the user node is enough
+		"1":   true,
+		"0x1": true,
+		"0":   false,
+		"0x0": false,
+		"yes": false,
+	} {
+		bdf := "0000:3b:00." + strings.Replace(ready, "x", "", -1)
+		dev := fixtureDevice(t, root, bdf, ready)
+		if got := isDeviceReady(dev); got != want {
+			t.Errorf("ready %q: got %v, want %v", ready, got, want)
+		}
+	}
+	dev := fixtureDevice(t, root, "0000:5e:00.1", "1")
+	os.Remove(dev.Nodes.User)
+	if isDeviceReady(dev) {
+		t.Errorf("ready without the user node")
+	}
+}
+
+func TestResetDevices(t *testing.T) {
+	t.Run("mgmt", func(t *testing.T) {
+		root, _ := resetFixture(t, ResetModeMgmt, "")
+		dev := fixtureDevice(t, root, "0000:3b:00.1", "1")
+		// a regular file stands in for the xclmgmt node, it doesn't know
+		// the hot reset ioctl
+		dev.Nodes.Mgmt = path.Join(root, "xclmgmt1")
+		if err := ioutil.WriteFile(dev.Nodes.Mgmt, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		m := &FPGADevicePluginServer{devices: map[string]Device{dev.DBDF: dev}}
+		err := m.resetDevices([]string{dev.DBDF})
+		if err == nil || !strings.Contains(err.Error(), "through "+dev.Nodes.Mgmt) || !strings.Contains(err.Error(), syscall.ENOTTY.Error()) {
+			t.Errorf("got %v, want the ioctl error of %s", err, dev.Nodes.Mgmt)
+		}
+		if err := m.resetDevices([]string{"0000:5e:00.1"}); err == nil {
+			t.Errorf("unknown device reset")
+		}
+	})
+	t.Run("missing mgmt node", func(t *testing.T) {
+		root, _ := resetFixture(t, ResetModeMgmt, "")
+		dev := fixtureDevice(t, root, "0000:3b:00.1", "1")
+		dev.Nodes.Mgmt = path.Join(root, "xclmgmt-missing")
+		m := &FPGADevicePluginServer{devices: map[string]Device{dev.DBDF: dev}}
+		if err := m.resetDevices([]string{dev.DBDF}); err == nil || !strings.Contains(err.Error(), "through "+dev.Nodes.Mgmt) {
+			t.Errorf("got %v, want a missing node error", err)
+		}
+	})
+	t.Run("no mgmt PF", func(t *testing.T) {
+		root, _ := resetFixture(t, ResetModeMgmt, "")
+		dev := fixtureDevice(t, root, "0000:3b:00.1", "1")
+		dev.Nodes.Mgmt = ""
+		m := &FPGADevicePluginServer{devices: map[string]Device{dev.DBDF: dev}}
+		if err := m.resetDevices([]string{dev.DBDF}); err == nil || !strings.Contains(err.Error(), "use the "+ResetModeCommand+" reset mode") {
+			t.Errorf("got %v, want a hint to the command reset mode", err)
+		}
+	})
+	t.Run("not ready after reset", func(t *testing.T) {
+		root, _ := resetFixture(t, ResetModeCommand, "true")
+		dev := fixtureDevice(t, root, "0000:3b:00.1", "0")
+		m := &FPGADevicePluginServer{devices: map[string]Device{dev.DBDF: dev}}
+		if err := m.resetDevices([]string{dev.DBDF}); err == nil || !strings.Contains(err.Error(), "not ready") {
+			t.Errorf("got %v, want a not ready error", err)
+		}
+	})
+	t.Run("command resets each card once", func(t *testing.T) {
+		root, c := resetFixture(t, ResetModeCommand, "")
+		// mkdir fails if the same card is reset twice
+		c.ResetCommand = "mkdir " + path.Join(root, "reset-{BDF}")
+		devices := map[string]Device{}
+		for _, id := range []string{"0000:82:00.1-0", "0000:82:00.1-1", "0000:83:00.1-0"} {
+			dev := fixtureDevice(t, root, id, "")
+			dev.shellVer, dev.SN = U30CommonShell, "XFL1U30-"+id[5:7]
+			dev.family = cfg().ShellFamilies[0]
+			devices[id] = dev
+		}
+		m := &FPGADevicePluginServer{devices: devices}
+		// the U30 sibling 0000:82:00.1-1 is added by U30AllocUnit=Card
+		if err := m.resetDevices([]string{"0000:82:00.1-0", "0000:83:00.1-0"}); err != nil {
+			t.Fatal(err)
+		}
+		for _, bdf := range []string{"0000:82:00.1", "0000:83:00.1"} {
+			if !FileExist(path.Join(root, "reset-"+bdf)) {
+				t.Errorf("card %s not reset", bdf)
+			}
+		}
+	})
+	t.Run("failed command", func(t *testing.T) {
+		root, _ := resetFixture(t, ResetModeCommand, "ls {USER}-missing")
+		dev := fixtureDevice(t, root, "0000:3b:00.1", "")
+		m := &FPGADevicePluginServer{devices: map[string]Device{dev.DBDF: dev}}
+		err := m.resetDevices([]string{dev.DBDF})
+		if err == nil || !strings.Contains(err.Error(), "No such file") {
+			t.Errorf("got %v, want the output of the failed command", err)
+		}
+	})
+	t.Run("shared devices", func(t *testing.T) {
+		_, c := resetFixture(t, ResetModeMgmt, "")
+		c.VirtualDev = true
+		m := &FPGADevicePluginServer{devices: map[string]Device{}}
+		if err := m.resetDevices([]string{"0000:3b:00.1"}); err != nil {
+			t.Errorf("shared devices reset: %v", err)
+		}
+	})
+}
@@ -17,12 +17,10 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
-	"io/ioutil"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 	"net"
 	"os"
@@ -30,171 +28,179 @@ import (
 	"reflect"
 	_ "runtime/debug"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	resourceNamePrefix = "amd.com/"
-	serverSockPath     = pluginapi.DevicePluginPath
-	AWS_SN             = "F1-Node"
+	serverSockPath = pluginapi.DevicePluginPath
+	AWS_SN         = "F1-Node"
 )
 
 // FPGADevicePluginServer implements the Kubernetes device plugin API
 type FPGADevicePluginServer struct {
 	devType string
 	devices map[string]Device
-	socket  string
-	stop    chan interface{}
-	update  chan map[string]Device
-
+	// domain is the resource domain the server registers under, either
+	// ResourceDomain or LegacyResourceDomain
+	domain       string
+	resourceName string
+	// mgmtOnly is set for the dedicated mgmt resource, which hands out
+	// only the mgmt PF nodes
+	mgmtOnly bool
+	// preStart is PreStartRequired as registered with kubelet, the server is
+	// restarted when it changes
+	preStart bool
+	socket   string
+	// ctx is cancelled when the server stops
+	ctx    context.Context
+	cancel context.CancelFunc
+	update chan map[string]Device
+
+	lock   sync.Mutex
 	server *grpc.Server
+	// failed is set when the server couldn't start or register, it is
+	// started again on the next scan
+	failed bool
+	// registered is set once the server registered with kubelet
+	registered bool
 }
 
 type FPGADevicePlugin struct {
-	devices    map[string]map[string]Device
+	devices map[string]map[string]Device
+	// servers are keyed by resource name, every device type has a server
+	// per resource domain
 	servers    map[string]*FPGADevicePluginServer
 	updateChan chan map[string]map[string]Device
+	// ctx is cancelled when the plugin stops, which ends the device scan
+	ctx    context.Context
+	cancel context.CancelFunc
+	// cdiSpec is the content of the last written CDI spec file, and
+	// cdiSpecPath its path
+	cdiSpec     []byte
+	cdiSpecPath string
+	// rescan triggers a device scan without waiting for the next period
+	rescan chan struct{}
+
+	nameLock sync.Mutex
+	// names and namesContent are the name customization in force and the
+	// content of NameCustomize.json it was parsed from, rejectedContent the
+	// content of the last rejected file
+	names           *NameCustomize
+	namesContent    []byte
+	rejectedContent []byte
+	// scanned are the devices found by the last scan, a new name
+	// customization is validated against them. namesPending is set when the
+	// name customization was loaded before the first scan, it is validated
+	// against the first scan then.
+	scanned      []Device
+	scannedOnce  bool
+	namesPending bool
+
+	statusLock sync.Mutex
+	// discovery is the state of the device scan and published are the servers
+	// as of the last sync, for the health probes
+	discovery discoveryStatus
+	published []*FPGADevicePluginServer
 }
 
-// get keys from struct
-func getKeys(m map[string]string) []string {
-	j := 0
-	keys := make([]string, len(m))
-	for k := range m {
-		keys[j] = k
-		j++
-	}
-	return keys
-}
-
-// check euqal strings
-func IsEqual(keyValue string, devValue string) bool {
-	if strings.EqualFold(keyValue, devValue) || keyValue == "*" {
-		return true
-	} else {
-		return false
-	}
-}
-
-// find matched key for name ustomzie deivce
-func getMatchKey(keyList []string, device Device) string {
-	for _, key := range keyList {
-		keyArray := strings.Split(key, "-")
-		if len(keyArray) != 3 {
-			return "False"
-		}
-		if len(keyArray[2]) == 6 &&
-			IsEqual(keyArray[0], device.deviceType) &&
-			IsEqual(keyArray[1], device.shellVer) &&
-			IsEqual(keyArray[2], device.uuid) {
-			return key
-		} else if IsEqual(keyArray[0], device.deviceType) &&
-			IsEqual(keyArray[1], device.shellVer) &&
-			IsEqual(keyArray[2], device.timestamp) {
-			return key
-		}
-	}
-	return "" //return empty if there's no matched key (physical) founded
-}
-
-// get customzied DSAtype Name
-func getModifiedDSAtype(aliasName string, device Device) string {
-	immutable := reflect.ValueOf(device)
-	DSAtype := ""
-	aliasArray := strings.Split(aliasName, "+")
-	for _, alias := range aliasArray {
-		if strings.Contains(alias, "'") {
-			DSAtype = DSAtype + alias[1:len(alias)-1]
-		} else {
-			DSAtype = DSAtype + immutable.FieldByName(alias).String()
-		}
-	}
-	//For Kuberbetes requirement, the lengeth of customized name can not over 63 characters.
-	//When customized name is over 63 character, deivce plugin will use shellVer + timestamp as device name
-	if len(DSAtype) > 60 {
-		DSAtype = device.shellVer + "-" + device.timestamp
-		log.Warn("The customize name for device", device.DBDF, " is over 60 character, plugin will use default name", DSAtype, "as device name")
-		return DSAtype
-	} else {
-		return DSAtype
-	}
-}
+// discoveryRetryMin and discoveryRetryMax bound the delay before the device
+// scan is retried after an error, the delay doubles on every failure
+const (
+	discoveryRetryMin = 5 * time.Second
+	discoveryRetryMax = 5 * time.Minute
+)
 
-// NewFPGADevicePlugin returns an initialized FPGADevicePlugin
-func NewFPGADevicePlugin() *FPGADevicePlugin {
-	log.Debugf("create FPGA device plugin")
+// NewFPGADevicePlugin returns an initialized FPGADevicePlugin, which scans
+// the devices until the context is cancelled. The update channel is closed
+// when the scan ends.
+func NewFPGADevicePlugin(ctx context.Context) *FPGADevicePlugin {
+	serverLog.Debugf("create FPGA device plugin")
 	updateChan := make(chan map[string]map[string]Device)
+	ctx, cancel := context.WithCancel(ctx)
 	plugin := FPGADevicePlugin{
 		devices:    make(map[string]map[string]Device),
 		servers:    make(map[string]*FPGADevicePluginServer),
 		updateChan: updateChan,
+		ctx:        ctx,
+		cancel:     cancel,
+		rescan:     make(chan struct{}, 1),
 	}
 
-	// Open jsonFile NameCustomize
-	jsonFile, err := os.Open("/opt/xilinx/device-plugin-configmap/NameCustomize.json")
-	// if we os.Open returns an error then handle it
-	if err != nil && strings.EqualFold(DeviceNameCustomize, "True") {
-		log.Error("Not found file NameCustomize.jon, device will be registered in defualt name format")
-		log.Error(err)
+	if cfg().DeviceNameCustomize {
+		plugin.reloadNameCustomize()
 	}
-	//fmt.Println("Successfully Opened target json file")
-	defer jsonFile.Close()
-
-	byteValue, _ := ioutil.ReadAll(jsonFile)
-
-	var ModifyNames map[string]string
-	json.Unmarshal([]byte(byteValue), &ModifyNames)
-	keyList := getKeys(ModifyNames)
+	plugin.discovery.Running = true
 	go func() {
+		defer close(updateChan)
+		defer func() {
+			plugin.statusLock.Lock()
+			plugin.discovery.Running = false
+			plugin.statusLock.Unlock()
+		}()
+		retry := discoveryRetryMin
 		for {
 			devices, err := GetDevices()
 			if err != nil {
-				time.Sleep(75 * time.Second)
-				devices, err = GetDevices()
-				if err != nil {
-					log.Errorf("Error to get FPGA devices: %v", err)
-					break
-				}
-			}
-			devMap := make(map[string]map[string]Device)
-			for _, device := range devices {
-				DSAtype := ""
-				if strings.EqualFold(U30NameConvention, "CommonName") && strings.Contains(device.shellVer, U30CommonShell) {
-					DSAtype = device.shellVer
-				} else if strings.EqualFold(DeviceNameCustomize, "True") {
-					matchkey := getMatchKey(keyList, device)
-					if strings.EqualFold(matchkey, "") {
-						DSAtype = device.shellVer + "-" + device.timestamp
-						//log.Println("No matched physical name for device", device.DBDF, ", plugin will use default name", DSAtype, "as device name")
-					} else {
-						DSAtype = getModifiedDSAtype(ModifyNames[matchkey], device)
-					}
-				} else {
-					if strings.EqualFold(device.shellVer, "MA35") {
-						DSAtype = device.shellVer
-					} else {
-						DSAtype = device.shellVer + "-" + device.timestamp
-					}
+				discoveryLog.Errorf("Error to get FPGA devices, retry in %v: %v", retry, err)
+				plugin.setDiscoveryError(err)
+				select {
+				case <-time.After(retry):
+				case <-ctx.Done():
+					return
 				}
-				id := device.DBDF
-				if subMap, ok := devMap[DSAtype]; ok {
-					subMap = devMap[DSAtype]
-					subMap[id] = device
-				} else {
-					subMap = make(map[string]Device)
-					devMap[DSAtype] = subMap
-					subMap[id] = device
+				if retry *= 2; retry > discoveryRetryMax {
+					retry = discoveryRetryMax
 				}
+				continue
+			}
+			retry = discoveryRetryMin
+			plugin.setDiscovered()
+			plugin.nameLock.Lock()
+			plugin.scanned = devices
+			plugin.scannedOnce = true
+			plugin.checkPendingNames()
+			names := plugin.names
+			plugin.nameLock.Unlock()
+			devMap := buildDeviceMap(devices, names)
+			select {
+			case updateChan <- devMap:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case <-time.After(5 * time.Second):
+			case <-plugin.rescan:
+			case <-ctx.Done():
+				return
 			}
-			updateChan <- devMap
-			time.Sleep(5 * time.Second)
 		}
-		close(updateChan)
 	}()
 
 	return &plugin
 }
 
+// buildDeviceMap maps every device type, i.e. the resource name without
+// domain, to its devices, keyed by device ID
+func buildDeviceMap(devices []Device, names *NameCustomize) map[string]map[string]Device {
+	devMap := make(map[string]map[string]Device)
+	for _, device := range devices {
+		DSAtype := getDSAtype(device, names)
+		id := device.DBDF
+		if subMap, ok := devMap[DSAtype]; ok {
+			subMap = devMap[DSAtype]
+			subMap[id] = device
+		} else {
+			subMap = make(map[string]Device)
+			devMap[DSAtype] = subMap
+			subMap[id] = device
+		}
+	}
+	addAggregateDevices(devMap)
+	addMgmtDevices(devMap)
+	return devMap
+}
+
 func (m *FPGADevicePlugin) checkDeviceUpdate(n map[string]map[string]Device) {
 	added := make(map[string]map[string]Device)
 	updated := make(map[string]map[string]Device)
@@ -214,43 +220,181 @@ func (m *FPGADevicePlugin) checkDeviceUpdate(n map[string]map[string]Device) {
 		added[nDevType] = nDevices
 	}
 
-	//create new server for added devices
+	for rDevType, rDevices := range removed {
+		serverLog.Debugf("Remove device %v", rDevices)
+		delete(m.devices, rDevType)
+	}
 	for aDevType, aDevices := range added {
-		devicePluginServer := m.NewFPGADevicePluginServer(aDevType, aDevices)
 		m.devices[aDevType] = aDevices
-		m.servers[aDevType] = devicePluginServer
-		go func(aDevType string, aDevices map[string]Device, name string) {
-			if err := m.servers[aDevType].Serve(name); err != nil {
-				log.Println("Could not contact Kubelet, Exit. Did you enable the device plugin feature gate?")
-				os.Exit(1)
-			}
-			m.servers[aDevType].update <- aDevices
-		}(aDevType, aDevices, resourceNamePrefix+aDevType)
 	}
-
-	//stop server for removed devices
-	for rDevType, rDevices := range removed {
-		log.Debugf("Remove device %v", rDevices)
-		m.servers[rDevType].Stop()
-		delete(m.servers, rDevType)
-		delete(m.devices, rDevType)
+	for uDevType, uDevices := range updated {
+		m.devices[uDevType] = uDevices
 	}
 
+	// stop the servers of the removed devices, create the servers of the
+	// added devices
+	m.syncServers()
+
 	//send update for updated devices
 	for uDevType, uDevices := range updated {
-		m.devices[uDevType] = uDevices
-		m.servers[uDevType].update <- uDevices
+		for _, server := range m.servers {
+			if server.devType == uDevType {
+				server.sendUpdate(uDevices)
+			}
+		}
+	}
+
+	if len(added) != 0 || len(removed) != 0 || len(updated) != 0 {
+		if err := m.writeCDISpec(); err != nil {
+			cdiLog.Errorf("Failed to write CDI spec %s: %v", cdiSpecFile(), err)
+		}
+	}
+}
+
+// resourceDomains returns the domains every device type is registered under
+func resourceDomains() []string {
+	if cfg().LegacyResourceDomain != "" {
+		return []string{cfg().ResourceDomain, cfg().LegacyResourceDomain}
+	}
+	return []string{cfg().ResourceDomain}
+}
+
+// syncServers makes the servers match the devices and the config: a server
+// runs for every device type under every resource domain. The servers which
+// are no longer wanted, or whose registration options changed, are stopped,
+// the missing ones are started. The other servers keep running.
+func (m *FPGADevicePlugin) syncServers() {
+	wanted := make(map[string]bool)
+	for devType := range m.devices {
+		for _, domain := range resourceDomains() {
+			wanted[domain+"/"+devType] = true
+		}
+	}
+	for resourceName, server := range m.servers {
+		if wanted[resourceName] && server.preStart == server.preStartRequired() && !server.hasFailed() {
+			continue
+		}
+		serverLog.WithField("resource", resourceName).Printf("Stopping device plugin server")
+		server.Stop()
+		delete(m.servers, resourceName)
+	}
+	for devType, devices := range m.devices {
+		for _, domain := range resourceDomains() {
+			if _, ok := m.servers[domain+"/"+devType]; !ok {
+				server := m.startServer(devType, devices, domain)
+				m.servers[server.resourceName] = server
+			}
+		}
+	}
+	m.updateDeviceMetrics()
+	m.publishServers()
+}
+
+// restartServers stops and starts every server, so they register with a
+// restarted kubelet
+func (m *FPGADevicePlugin) restartServers() {
+	for resourceName, server := range m.servers {
+		server.Stop()
+		delete(m.servers, resourceName)
+	}
+	m.syncServers()
+}
+
+// reload applies a changed config: the name customization is read again, the
+// servers are synced and the devices are scanned again
+func (m *FPGADevicePlugin) reload() {
+	if cfg().DeviceNameCustomize {
+		m.reloadNameCustomize()
+	}
+	m.syncServers()
+	if err := m.writeCDISpec(); err != nil {
+		cdiLog.Errorf("Failed to write CDI spec %s: %v", cdiSpecFile(), err)
 	}
+	select {
+	case m.rescan <- struct{}{}:
+	default:
+	}
+}
+
+// Stop ends the device scan and stops every server, which removes their
+// sockets
+func (m *FPGADevicePlugin) Stop() {
+	m.cancel()
+	for resourceName, server := range m.servers {
+		server.Stop()
+		delete(m.servers, resourceName)
+	}
+	m.publishServers()
+}
+
+// startServer creates the server of the devices under the given resource
+// domain, and starts serving them in the background
+func (m *FPGADevicePlugin) startServer(devType string, devices map[string]Device, domain string) *FPGADevicePluginServer {
+	server := m.NewFPGADevicePluginServer(devType, devices, domain)
+	go func() {
+		if err := server.Serve(); err != nil {
+			// the plugin was stopped while the server was starting
+			if m.ctx.Err() != nil {
+				return
+			}
+			server.lock.Lock()
+			server.failed = true
+			server.lock.Unlock()
+			server.logger().Errorf("Could not contact Kubelet, retrying on the next scan. Did you enable the device plugin feature gate?")
+			return
+		}
+		server.sendUpdate(devices)
+	}()
+	return server
+}
+
+// logger returns the logger of the server, its messages carry the resource
+func (m *FPGADevicePluginServer) logger() *log.Entry {
+	return serverLog.WithField("resource", m.resourceName)
+}
+
+// hasFailed tells whether the server couldn't start or register
+func (m *FPGADevicePluginServer) hasFailed() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.failed
 }
 
 // NewFPGADevicePluginServer returns an initialized FPGADevicePluginServer
-func (m *FPGADevicePlugin) NewFPGADevicePluginServer(devType string, devices map[string]Device) *FPGADevicePluginServer {
-	return &FPGADevicePluginServer{
-		devType: devType,
-		devices: devices,
-		socket:  path.Join(serverSockPath, devType+"-fpga.sock"),
-		stop:    make(chan interface{}),
-		update:  make(chan map[string]Device, 1),
+func (m *FPGADevicePlugin) NewFPGADevicePluginServer(devType string, devices map[string]Device, domain string) *FPGADevicePluginServer {
+	socket := devType + "-fpga.sock"
+	if domain != cfg().ResourceDomain {
+		socket = devType + "-legacy-fpga.sock"
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	server := &FPGADevicePluginServer{
+		devType:      devType,
+		devices:      devices,
+		domain:       domain,
+		resourceName: domain + "/" + devType,
+		mgmtOnly:     isMgmtDevices(devices),
+		socket:       path.Join(serverSockPath, socket),
+		ctx:          ctx,
+		cancel:       cancel,
+		update:       make(chan map[string]Device, 1),
+	}
+	server.preStart = server.preStartRequired()
+	return server
+}
+
+// sendUpdate hands the devices to ListAndWatch without blocking, an update
+// not picked up yet is replaced
+func (m *FPGADevicePluginServer) sendUpdate(devices map[string]Device) {
+	for {
+		select {
+		case m.update <- devices:
+			return
+		default:
+		}
+		select {
+		case <-m.update:
+		default:
+		}
 	}
 }
 
@@ -269,31 +413,54 @@ func waitForServer(socket string, timeout time.Duration) error {
 	}
 
 	if err != nil {
-		fmt.Errorf("Failed dial context at %s", socket)
-		return err
+		return fmt.Errorf("Failed dial context at %s: %v", socket, err)
 	}
 	return nil
 }
 
-func (m *FPGADevicePluginServer) deviceExists(id string) bool {
-	for k, _ := range m.devices {
-		if k == id {
-			return true
-		}
-	}
-	return false
+// currentDevices returns the devices of the server, ListAndWatch replaces
+// them on every update
+func (m *FPGADevicePluginServer) currentDevices() map[string]Device {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.devices
 }
 
+// PreStartContainer is called by kubelet before each container start when
+// PreStartRequired is set, it resets the allocated cards and loads the xclbin
+// bound to the resource
 func (m *FPGADevicePluginServer) PreStartContainer(ctx context.Context, rqt *pluginapi.PreStartContainerRequest) (*pluginapi.PreStartContainerResponse, error) {
-	return nil, fmt.Errorf("PreStartContainer() should not be called")
+	if !m.preStartRequired() {
+		return nil, fmt.Errorf("PreStartContainer() should not be called")
+	}
+	m.logger().Debugf("In PreStartContainer(%s): %v", m.devType, rqt.DevicesIDs)
+	if err := m.resetDevices(rqt.DevicesIDs); err != nil {
+		m.logger().Errorf("Failed to reset devices %v: %v", rqt.DevicesIDs, err)
+		return nil, err
+	}
+	if err := m.preloadDevices(rqt.DevicesIDs); err != nil {
+		m.logger().Errorf("Failed to load xclbin onto devices %v: %v", rqt.DevicesIDs, err)
+		return nil, err
+	}
+	return &pluginapi.PreStartContainerResponse{}, nil
 }
 
 func (m *FPGADevicePluginServer) GetDevicePluginOptions(ctx context.Context, empty *pluginapi.Empty) (*pluginapi.DevicePluginOptions, error) {
-	return new(pluginapi.DevicePluginOptions), nil
+	return &pluginapi.DevicePluginOptions{
+		PreStartRequired: m.preStart,
+	}, nil
+}
+
+// preStartRequired tells whether kubelet has to call PreStartContainer
+func (m *FPGADevicePluginServer) preStartRequired() bool {
+	return !m.mgmtOnly && (cfg().ResetMode != ResetModeOff || getXclbinPreload(m.devType) != nil)
 }
 
 // Start starts the gRPC server of the device plugin
 func (m *FPGADevicePluginServer) Start() error {
+	if m.ctx.Err() != nil {
+		return m.ctx.Err()
+	}
 	err := m.cleanup()
 	if err != nil {
 		return err
@@ -304,10 +471,16 @@ func (m *FPGADevicePluginServer) Start() error {
 		return err
 	}
 
+	m.lock.Lock()
+	if m.ctx.Err() != nil {
+		m.lock.Unlock()
+		sock.Close()
+		return m.ctx.Err()
+	}
 	m.server = grpc.NewServer()
 	pluginapi.RegisterDevicePluginServer(m.server, m)
-
 	go m.server.Serve(sock)
+	m.lock.Unlock()
 
 	// Wait for the server to start
 	if err = waitForServer(m.socket, 10*time.Second); err != nil {
@@ -317,16 +490,17 @@ func (m *FPGADevicePluginServer) Start() error {
 	return nil
 }
 
-// Stop stops the gRPC server
+// Stop stops the gRPC server and removes its socket, ListAndWatch returns
 func (m *FPGADevicePluginServer) Stop() error {
+	m.cancel()
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	if m.server == nil {
 		return nil
 	}
 
 	m.server.Stop()
 	m.server = nil
-	close(m.stop)
-	close(m.update)
 
 	return m.cleanup()
 }
@@ -340,14 +514,20 @@ func (m *FPGADevicePluginServer) cleanup() error {
 }
 
 // Register registers the device plugin for the given resourceName with Kubelet.
-func (m *FPGADevicePluginServer) Register(kubeletEndpoint, resourceName string) error {
+func (m *FPGADevicePluginServer) Register(kubeletEndpoint, resourceName string) (err error) {
+	metrics.add(metricRegistrations, 1, "resource", resourceName)
+	defer func() {
+		if err != nil {
+			metrics.add(metricRegistrationFailures, 1, "resource", resourceName)
+		}
+	}()
 	conn, err := grpc.Dial(kubeletEndpoint, grpc.WithInsecure(),
 		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
 			return net.DialTimeout("unix", addr, timeout)
 		}))
 
 	if err != nil {
-		log.Debugf("Cann't connect to kubelet service")
+		m.logger().Debugf("Cann't connect to kubelet service")
 		return err
 	}
 	defer conn.Close()
@@ -361,7 +541,7 @@ func (m *FPGADevicePluginServer) Register(kubeletEndpoint, resourceName string)
 
 	_, err = client.Register(context.Background(), reqt)
 	if err != nil {
-		log.Debugf("Cann't register to kubelet service")
+		m.logger().Debugf("Cann't register to kubelet service")
 		return err
 	}
 	return nil
@@ -380,29 +560,33 @@ func IsContain(items []string, item string) bool {
 func (m *FPGADevicePluginServer) sendDevices(s pluginapi.DevicePlugin_ListAndWatchServer) error {
 	resp := new(pluginapi.ListAndWatchResponse)
 
-	check_range := m.devices
+	check_range := m.currentDevices()
 	SerialNums := []string{}
 	for _, device := range check_range {
-		if IsContain(SerialNums, device.SN) && strings.EqualFold(U30AllocUnit, "Card") && strings.Contains(device.shellVer, U30CommonShell) && device.SN != "" {
-			log.Printf("U30AllocUnit set as Card, same serial number U30 device already exists")
-		} else if IsContain(SerialNums, device.SN) && strings.EqualFold(U30AllocUnit, "Card") && strings.Contains(device.shellVer, VtShell) && device.SN != "" {
-			log.Printf("U30AllocUnit set as Card, same serial number U30 device already exists")
+		// a device taken through the same resource under another domain is
+		// reported unhealthy, so kubelet doesn't allocate it again
+		if ledgerEnabled() && allocLedger.heldByOther(m.resourceName, physicalDeviceID(device.DBDF, m.mgmtOnly)) {
+			device.Healthy = pluginapi.Unhealthy
+		}
+		if IsContain(SerialNums, device.SN) && strings.EqualFold(cfg().U30AllocUnit, "Card") && isCardUnit(device) && device.SN != "" {
+			m.logger().WithFields(deviceFields(device)).Printf("U30AllocUnit set as Card, a %s device with the same serial number already exists", device.family.Name)
 		} else {
-			if device.SN == "" && device.deviceType == "u30" {
-				log.Warn("U30 Device %v has empty Serial number", device.DBDF, ",the device allocate unit will not be able to set in card layer")
+			if device.SN == "" && isCardUnit(device) {
+				m.logger().WithFields(deviceFields(device)).Warnf("%s Device %v has empty Serial number, the device allocate unit will not be able to set in card layer", device.family.Name, device.DBDF)
 				SerialNums = append(SerialNums, device.SN)
-				resp.Devices = append(resp.Devices, &pluginapi.Device{ID: device.DBDF, Health: device.Healthy})
+				resp.Devices = append(resp.Devices, &pluginapi.Device{ID: device.DBDF, Health: device.Healthy, Topology: device.topology})
 			} else {
 				SerialNums = append(SerialNums, device.SN)
-				resp.Devices = append(resp.Devices, &pluginapi.Device{ID: device.DBDF, Health: device.Healthy})
+				resp.Devices = append(resp.Devices, &pluginapi.Device{ID: device.DBDF, Health: device.Healthy, Topology: device.topology})
 			}
 		}
 	}
-	log.Printf("Check SeialNums arry: %v", SerialNums)
-	log.Printf("Sending %d device(s) %v to kubelet", len(resp.Devices), resp.Devices)
+	m.logger().Printf("Check SeialNums arry: %v", SerialNums)
+	m.logger().Printf("Sending %d device(s) %v to kubelet", len(resp.Devices), resp.Devices)
+	metrics.add(metricSends, 1, "resource", m.resourceName)
 	if err := s.Send(resp); err != nil {
 		m.Stop()
-		log.Debugf("Cannot update device list")
+		m.logger().Debugf("Cannot update device list")
 		return err
 	}
 	return nil
@@ -410,14 +594,26 @@ func (m *FPGADevicePluginServer) sendDevices(s pluginapi.DevicePlugin_ListAndWat
 
 // ListAndWatch lists devices and update that list according to the health status
 func (m *FPGADevicePluginServer) ListAndWatch(e *pluginapi.Empty, s pluginapi.DevicePlugin_ListAndWatchServer) error {
-	log.Debugf("In ListAndWatch(%s): stream: %v", m.devType, s)
+	m.logger().Debugf("In ListAndWatch(%s): stream: %v", m.devType, s)
 	//debug.PrintStack()
-	for m.devices = range m.update {
+	refresh := allocLedger.subscribe()
+	defer allocLedger.unsubscribe(refresh)
+	metrics.add(metricStreams, 1, "resource", m.resourceName)
+	defer metrics.add(metricStreams, -1, "resource", m.resourceName)
+	for {
+		select {
+		case devices := <-m.update:
+			m.lock.Lock()
+			m.devices = devices
+			m.lock.Unlock()
+		case <-refresh:
+		case <-m.ctx.Done():
+			return nil
+		}
 		if err := m.sendDevices(s); err != nil {
 			return err
 		}
 	}
-	return nil
 }
 
 // GetPreferredAllocation returns a preferred set of devices to allocate
@@ -429,134 +625,128 @@ func (m *FPGADevicePluginServer) GetPreferredAllocation(context.Context, *plugin
 	return &pluginapi.PreferredAllocationResponse{}, nil
 }
 
+// addCardSiblings adds the devices on the same card as the requested devices
+// when U30AllocUnit is Card, for the shell families allocated by card
+func (m *FPGADevicePluginServer) addCardSiblings(deviceIDs []string) []string {
+	// Check same serial number devices, devices with same serail number "F1-node" will be marked as independent devices
+	deviceIDs_arry := append([]string{}, deviceIDs...)
+	if strings.EqualFold(cfg().U30AllocUnit, "Card") {
+		devices := m.currentDevices()
+		for id2 := range deviceIDs_arry {
+			for _, device := range devices {
+				if isCardUnit(device) {
+					if device.SN == devices[deviceIDs_arry[id2]].SN && strings.EqualFold(device.SN, AWS_SN) != true && IsContain(deviceIDs_arry, device.DBDF) == false {
+						deviceIDs_arry = append(deviceIDs_arry, device.DBDF)
+					}
+				}
+			}
+		}
+	}
+	return deviceIDs_arry
+}
+
 // Allocate which return list of devices.
-func (m *FPGADevicePluginServer) Allocate(ctx context.Context, req *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	log.Debugf("In Allocate()")
-	AWS_SN := "F1-Node"
-	response := new(pluginapi.AllocateResponse)
+func (m *FPGADevicePluginServer) Allocate(ctx context.Context, req *pluginapi.AllocateRequest) (response *pluginapi.AllocateResponse, err error) {
+	m.logger().Debugf("In Allocate()")
+	defer func() {
+		if err != nil {
+			metrics.add(metricAllocateErrors, 1, "resource", m.resourceName)
+		} else {
+			metrics.add(metricAllocations, 1, "resource", m.resourceName)
+		}
+		m.auditAllocation(req, response, err)
+	}()
+	if m.domain != cfg().ResourceDomain {
+		m.logger().Warnf("Resource %s is deprecated, please request %s/%s instead", m.resourceName, cfg().ResourceDomain, m.devType)
+	}
+	response = new(pluginapi.AllocateResponse)
+	devices := m.currentDevices()
+	// check the devices of every container before any of them is taken
+	requests := [][]string{}
+	keys := []string{}
 	for _, creq := range req.ContainerRequests {
-		log.Debugf("Request IDs: %v", creq.DevicesIDs)
+		deviceIDs_arry := m.addCardSiblings(creq.DevicesIDs)
+		for _, id := range deviceIDs_arry {
+			if _, ok := devices[id]; !ok {
+				return nil, fmt.Errorf("Invalid allocation request with non-existing device %s", id)
+			}
+			keys = append(keys, physicalDeviceID(id, m.mgmtOnly))
+		}
+		requests = append(requests, deviceIDs_arry)
+	}
+	if ledgerEnabled() {
+		var acquired []string
+		if acquired, err = allocLedger.acquire(m.resourceName, keys); err != nil {
+			return nil, fmt.Errorf("Invalid allocation request for %s: %v", m.resourceName, err)
+		}
+		// a failed allocation doesn't hold the devices it took
+		defer func() {
+			if err != nil {
+				allocLedger.release(acquired)
+			}
+		}()
+	}
+	for i, creq := range req.ContainerRequests {
+		m.logger().Debugf("Request IDs: %v", creq.DevicesIDs)
 
 		cres := new(pluginapi.ContainerAllocateResponse)
 
-		// Check same serial number devices, devices with same serail number "F1-node" will be marked as independent devices
-		deviceIDs_arry := creq.DevicesIDs
-		if strings.EqualFold(U30AllocUnit, "Card") {
-			for id2 := range deviceIDs_arry {
-				for _, device := range m.devices {
-					if strings.Contains(device.shellVer, VtShell) || strings.Contains(device.shellVer, U30CommonShell) {
-						if device.SN == m.devices[deviceIDs_arry[id2]].SN && strings.EqualFold(device.SN, AWS_SN) != true && IsContain(deviceIDs_arry, device.DBDF) == false {
-							deviceIDs_arry = append(deviceIDs_arry, device.DBDF)
-						}
-					}
+		deviceIDs_arry := requests[i]
+
+		if m.mgmtOnly {
+			for _, id := range deviceIDs_arry {
+				m.logger().WithField("bdf", GetPciBDF(id)).Printf("Receiving mgmt request %s", id)
+				dev := devices[id]
+				if cfg().CDIMode != CDIModeInject {
+					appendDeviceNode(cres, dev.Nodes.Mgmt, cfg().MgmtPermissions)
 				}
 			}
-		}
-
-		if strings.EqualFold(VirtualDev, "True") {
-			log.Println("Device Plugin running in device-sharing mode, all same worker node Alveo devices will be allocate to the target container")
+			if cfg().CDIMode == CDIModeInject {
+				setCDIDevices(cres, m.resourceName, m.mgmtOnly, deviceIDs_arry)
+			}
+		} else if cfg().VirtualDev {
+			m.logger().Println("Device Plugin running in device-sharing mode, all same worker node Alveo devices will be allocate to the target container")
 			all_devices_arry, err := GetDevices()
 			if err != nil {
 				time.Sleep(75 * time.Second)
 				all_devices_arry, err = GetDevices()
 				if err != nil {
-					log.Errorf("Error to get FPGA devices: %v", err)
+					m.logger().Errorf("Error to get FPGA devices: %v", err)
 					break
 				}
 			}
+			ids := []string{}
+			nodes := make(map[string]bool)
 			for _, dev := range all_devices_arry {
-				if dev.Nodes.Mgmt != "" {
-					cres.Devices = append(cres.Devices, &pluginapi.DeviceSpec{
-						HostPath:      dev.Nodes.Mgmt,
-						ContainerPath: dev.Nodes.Mgmt,
-						Permissions:   "rwm",
-					})
-					cres.Mounts = append(cres.Mounts, &pluginapi.Mount{
-						HostPath:      dev.Nodes.Mgmt,
-						ContainerPath: dev.Nodes.Mgmt,
-						ReadOnly:      false,
-					})
-				}
-				cres.Devices = append(cres.Devices, &pluginapi.DeviceSpec{
-					HostPath:      dev.Nodes.User,
-					ContainerPath: dev.Nodes.User,
-					Permissions:   "rwm",
-				})
-				cres.Mounts = append(cres.Mounts, &pluginapi.Mount{
-					HostPath:      dev.Nodes.User,
-					ContainerPath: dev.Nodes.User,
-					ReadOnly:      false,
-				})
-				// if this device supports qdma, assign the qdma node to pod too
-				if dev.Nodes.Qdma != "" {
-					cres.Devices = append(cres.Devices, &pluginapi.DeviceSpec{
-						HostPath:      dev.Nodes.Qdma,
-						ContainerPath: dev.Nodes.Qdma,
-						Permissions:   "rwm",
-					})
-					cres.Mounts = append(cres.Mounts, &pluginapi.Mount{
-						HostPath:      dev.Nodes.Qdma,
-						ContainerPath: dev.Nodes.Qdma,
-						ReadOnly:      false,
-					})
+				if cfg().CDIMode != CDIModeInject {
+					appendDeviceNodes(cres, m.devType, dev)
+				} else if !nodes[dev.Nodes.User] {
+					// the virtual devices of a device share its nodes
+					nodes[dev.Nodes.User] = true
+					ids = append(ids, dev.DBDF)
 				}
 			}
+			if cfg().CDIMode == CDIModeInject {
+				setCDIDevices(cres, m.resourceName, m.mgmtOnly, ids)
+			}
 
 		} else {
 			for _, id := range deviceIDs_arry {
-				log.Printf("Receiving request %s", id)
-				dev, ok := m.devices[id]
-				if !ok {
-					return nil, fmt.Errorf("Invalid allocation request with non-existing device %s", id)
-				}
-				if !m.deviceExists(id) {
-					return nil, fmt.Errorf("invalid allocation request: unknown device: %s", id)
-				}
-
-				// Before we have mgmt and user pf separated, we add both to the device cgroup.
-				// It is still safe with mgmt pf assigned to container since xilinx device driver
-				// makes sure flashing DSA(shell) through mgmt pf in container is denied.
-				// This is not good. we will change that later, then only the user pf node is
-				// required to be assigned to container(device cgroup of the container)
-				//
-				// When containers are on top of VM, it is possible only user PF is assigned
-				// to VM, so the Mgmt is empty. Don't add it to cgroup in that case
-				if dev.Nodes.Mgmt != "" {
-					cres.Devices = append(cres.Devices, &pluginapi.DeviceSpec{
-						HostPath:      dev.Nodes.Mgmt,
-						ContainerPath: dev.Nodes.Mgmt,
-						Permissions:   "rwm",
-					})
-					cres.Mounts = append(cres.Mounts, &pluginapi.Mount{
-						HostPath:      dev.Nodes.Mgmt,
-						ContainerPath: dev.Nodes.Mgmt,
-						ReadOnly:      false,
-					})
-				}
-				cres.Devices = append(cres.Devices, &pluginapi.DeviceSpec{
-					HostPath:      dev.Nodes.User,
-					ContainerPath: dev.Nodes.User,
-					Permissions:   "rwm",
-				})
-				cres.Mounts = append(cres.Mounts, &pluginapi.Mount{
-					HostPath:      dev.Nodes.User,
-					ContainerPath: dev.Nodes.User,
-					ReadOnly:      false,
-				})
-				// if this device supports qdma, assign the qdma node to pod too
-				if dev.Nodes.Qdma != "" {
-					cres.Devices = append(cres.Devices, &pluginapi.DeviceSpec{
-						HostPath:      dev.Nodes.Qdma,
-						ContainerPath: dev.Nodes.Qdma,
-						Permissions:   "rwm",
-					})
-					cres.Mounts = append(cres.Mounts, &pluginapi.Mount{
-						HostPath:      dev.Nodes.Qdma,
-						ContainerPath: dev.Nodes.Qdma,
-						ReadOnly:      false,
-					})
+				m.logger().WithField("bdf", GetPciBDF(id)).Printf("Receiving request %s", id)
+				dev := devices[id]
+
+				// The mgmt PF used to be always assigned to the container, relying
+				// on the xilinx device driver to deny flashing the shell(DSA) through
+				// the mgmt pf in container. How the mgmt PF is assigned is now decided
+				// by the mgmt policy of the resource, see MgmtPolicy.
+				if cfg().CDIMode != CDIModeInject {
+					appendDeviceNodes(cres, m.devType, dev)
 				}
 			}
+			// the device nodes and mounts are described in the CDI spec
+			if cfg().CDIMode == CDIModeInject {
+				setCDIDevices(cres, m.resourceName, m.mgmtOnly, deviceIDs_arry)
+			}
 		}
 		response.ContainerResponses = append(response.ContainerResponses, cres)
 	}
@@ -565,22 +755,25 @@ func (m *FPGADevicePluginServer) Allocate(ctx context.Context, req *pluginapi.Al
 }
 
 // Serve starts the gRPC server and register the device plugin to Kubelet
-func (m *FPGADevicePluginServer) Serve(resourceName string) error {
-	log.Debugf("In Serve(%s)", m.socket)
+func (m *FPGADevicePluginServer) Serve() error {
+	m.logger().Debugf("In Serve(%s)", m.socket)
 	err := m.Start()
 	if err != nil {
-		log.Errorf("Could not start device plugin: %v", err)
+		m.logger().Errorf("Could not start device plugin: %v", err)
 		return err
 	}
-	log.Infof("Starting to serve on %s", m.socket)
+	m.logger().Infof("Starting to serve on %s", m.socket)
 
-	err = m.Register(pluginapi.KubeletSocket, resourceName)
+	err = m.Register(pluginapi.KubeletSocket, m.resourceName)
 	if err != nil {
-		log.Errorf("Could not register device plugin: %v", err)
+		m.logger().Errorf("Could not register device plugin: %v", err)
 		m.Stop()
 		return err
 	}
-	log.Infof("Registered device plugin with Kubelet %s", resourceName)
+	m.logger().Infof("Registered device plugin with Kubelet")
+	m.lock.Lock()
+	m.registered = true
+	m.lock.Unlock()
 
 	return nil
 }
@@ -0,0 +1,192 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeListAndWatch is a kubelet stream keeping the device lists sent to it
+type fakeListAndWatch struct {
+	grpc.ServerStream
+	sent []*pluginapi.ListAndWatchResponse
+}
+
+func (f *fakeListAndWatch) Send(resp *pluginapi.ListAndWatchResponse) error {
+	f.sent = append(f.sent, resp)
+	return nil
+}
+
+func TestSendUpdate(t *testing.T) {
+	plugin := &FPGADevicePlugin{ctx: context.Background()}
+	server := plugin.NewFPGADevicePluginServer("u250", nil, cfg().ResourceDomain)
+	first := map[string]Device{"0000:3b:00.1": {DBDF: "0000:3b:00.1"}}
+	second := map[string]Device{"0000:3c:00.1": {DBDF: "0000:3c:00.1"}}
+
+	// nobody reads the updates, the pending one is replaced
+	done := make(chan struct{})
+	go func() {
+		server.sendUpdate(first)
+		server.sendUpdate(second)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sendUpdate blocked")
+	}
+	if devices := <-server.update; len(devices) != 1 || devices["0000:3c:00.1"].DBDF == "" {
+		t.Errorf("got update %v, want the last one", devices)
+	}
+	select {
+	case devices := <-server.update:
+		t.Errorf("unexpected update %v", devices)
+	default:
+	}
+}
+
+func TestSendDevicesTopology(t *testing.T) {
+	useSynthetic(t, "cards:\n- shell: xilinx_u250_gen3x16_xdma_shell_4_1\n  count: 3\n  numaNodes: [1, -1]\n", "", false)
+	devices, err := GetSyntheticDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := &FPGADevicePlugin{ctx: context.Background()}
+	server := plugin.NewFPGADevicePluginServer("u250", nil, cfg().ResourceDomain)
+	server.devices = map[string]Device{}
+	for _, device := range devices {
+		server.devices[device.DBDF] = device
+	}
+	// a discovered device has no known node
+	server.devices["0000:3b:00.1"] = Device{DBDF: "0000:3b:00.1", Healthy: pluginapi.Healthy}
+	stream := &fakeListAndWatch{}
+	if err := server.sendDevices(stream); err != nil || len(stream.sent) != 1 {
+		t.Fatalf("%d lists sent, error %v", len(stream.sent), err)
+	}
+	got := map[string]int64{}
+	for _, device := range stream.sent[0].Devices {
+		got[device.ID] = -1
+		if device.Topology != nil && len(device.Topology.Nodes) == 1 {
+			got[device.ID] = device.Topology.Nodes[0].ID
+		} else if device.Topology != nil {
+			t.Errorf("%s: topology %v", device.ID, device.Topology)
+		}
+	}
+	expect := map[string]int64{"0000:80:00.1": 1, "0000:81:00.1": -1, "0000:82:00.1": 1, "0000:3b:00.1": -1}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("NUMA nodes %v, expect %v", got, expect)
+	}
+}
+
+func TestSyncServers(t *testing.T) {
+	c := defaultConfig()
+	c.LegacyResourceDomain = "xilinx.com"
+	useConfig(t, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	u250 := map[string]Device{"0000:3b:00.1": {DBDF: "0000:3b:00.1"}}
+	m := &FPGADevicePlugin{
+		devices: map[string]map[string]Device{"u250": u250},
+		servers: make(map[string]*FPGADevicePluginServer),
+		ctx:     ctx,
+	}
+	for _, server := range []*FPGADevicePluginServer{
+		m.NewFPGADevicePluginServer("u250", u250, "amd.com"),
+		m.NewFPGADevicePluginServer("u250", u250, "xilinx.com"),
+		// the device type is gone
+		m.NewFPGADevicePluginServer("u280", nil, "amd.com"),
+	} {
+		m.servers[server.resourceName] = server
+	}
+	amd, legacy, removed := m.servers["amd.com/u250"], m.servers["xilinx.com/u250"], m.servers["amd.com/u280"]
+
+	m.syncServers()
+	if len(m.servers) != 2 || m.servers["amd.com/u250"] != amd || m.servers["xilinx.com/u250"] != legacy {
+		t.Errorf("servers %v, want the ones of u250 kept", m.servers)
+	}
+	if removed.ctx.Err() == nil || amd.ctx.Err() != nil || legacy.ctx.Err() != nil {
+		t.Errorf("only the server of u280 is stopped")
+	}
+
+	// the legacy domain is dropped by a reload
+	c.LegacyResourceDomain = ""
+	m.syncServers()
+	if len(m.servers) != 1 || m.servers["amd.com/u250"] != amd || legacy.ctx.Err() == nil {
+		t.Errorf("servers %v, want the legacy server stopped", m.servers)
+	}
+
+	// the servers are stopped with the plugin
+	m.cancel = cancel
+	m.Stop()
+	if len(m.servers) != 0 || amd.ctx.Err() == nil {
+		t.Errorf("servers %v left after stop", m.servers)
+	}
+}
+
+func TestPluginStopEndsScan(t *testing.T) {
+	defer func(sysfs string) { SysfsDevices = sysfs }(SysfsDevices)
+	SysfsDevices = t.TempDir()
+	useConfig(t, defaultConfig())
+
+	plugin := NewFPGADevicePlugin(context.Background())
+	plugin.Stop()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-plugin.updateChan:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("the device scan didn't stop")
+		}
+	}
+}
+
+func TestDiscoveryKeepsRetrying(t *testing.T) {
+	defer func(sysfs string) { SysfsDevices = sysfs }(SysfsDevices)
+	SysfsDevices = path.Join(t.TempDir(), "missing")
+	useConfig(t, defaultConfig())
+
+	plugin := NewFPGADevicePlugin(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for plugin.status().Discovery.LastError == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("the failed scan wasn't reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the scan waits for the retry rather than giving up
+	if discovery := plugin.status().Discovery; !discovery.Running || discovery.Scans != 0 {
+		t.Errorf("discovery %+v, want a running scan", discovery)
+	}
+
+	plugin.Stop()
+	for range plugin.updateChan {
+	}
+	if plugin.status().Discovery.Running {
+		t.Errorf("the scan is still running once stopped")
+	}
+}
@@ -0,0 +1,423 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"os"
+	"path"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// SyntheticBusBase is the PCI bus of the first synthetic card
+	SyntheticBusBase = 0x80
+	// SyntheticRenderBase is the render node minor of the first synthetic
+	// device, like the DRM render nodes
+	SyntheticRenderBase = 128
+	// SyntheticOverTemp is the temperature reported by an overtemp fault
+	// without temperature
+	SyntheticOverTemp = 105
+)
+
+// The faults of the synthetic devices
+const (
+	SyntheticFaultRemove    = "remove"
+	SyntheticFaultUnhealthy = "unhealthy"
+	SyntheticFaultOverTemp  = "overtemp"
+)
+
+// SyntheticCards are the cards fabricated by the synthetic backend, they are
+// read from SyntheticSpecFile, YAML or JSON:
+//
+//	cards:
+//	- shell: xilinx_u250_gen3x16_xdma_shell_4_1
+//	  count: 2
+//	  numaNodes: [0, 1]
+//	- shell: xilinx_u30_gen3x4_base_2
+//	  devicesPerCard: 2
+//	  serialNumbers: [XFL1U30A]
+//	  replicas: 2
+//
+// The devices are served like discovered ones, with stand-in device nodes
+// created in SyntheticDevDir.
+type SyntheticCard struct {
+	// Shell is the VBNV of the cards
+	Shell string `json:"shell"`
+	// Type is the device type, by default the second part of the shell
+	Type      string `json:"type,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+	UUID      string `json:"uuid,omitempty"`
+	// Count is the number of cards, 1 by default
+	Count int `json:"count,omitempty"`
+	// DevicesPerCard is the number of devices sharing the serial number of
+	// a card, e.g. 2 for a U30, 1 by default
+	DevicesPerCard int `json:"devicesPerCard,omitempty"`
+	// SerialNumbers are the serial numbers of the cards, generated if
+	// missing
+	SerialNumbers []string `json:"serialNumbers,omitempty"`
+	// Replicas is the number of containers sharing each device, VirtualNum
+	// in virtual device mode and 1 otherwise by default
+	Replicas int `json:"replicas,omitempty"`
+	// Mgmt tells whether the cards have a mgmt PF, true by default
+	Mgmt *bool `json:"mgmt,omitempty"`
+	// Qdma tells whether the cards have a qdma node
+	Qdma bool `json:"qdma,omitempty"`
+	// NUMANodes are the NUMA nodes of the cards in turn, a negative node
+	// or none is unknown
+	NUMANodes []int `json:"numaNodes,omitempty"`
+}
+
+// SyntheticFault is a fault scripted in SyntheticControlFile, YAML or JSON:
+//
+//	faults:
+//	- device: 0000:80:00.1
+//	  fault: unhealthy
+//	  after: 30s
+//	  for: 2m
+//	- device: XFL1U30A
+//	  fault: remove
+//
+// A fault applies from its after delay, counted from the modification time
+// of the file, for its duration or as long as it is in the file. The file is
+// read on every scan, rewriting it restarts the script.
+type SyntheticFault struct {
+	// Device is the BDF, the device ID or the serial number of the faulty
+	// devices
+	Device string `json:"device"`
+	// Fault is remove, unhealthy or overtemp
+	Fault string `json:"fault"`
+	After string `json:"after,omitempty"`
+	For   string `json:"for,omitempty"`
+	// Temperature is the temperature in degrees Celsius of an overtemp
+	// fault
+	Temperature int `json:"temperature,omitempty"`
+
+	after    time.Duration
+	duration time.Duration
+}
+
+// parseSyntheticFile decodes a synthetic spec or control file, unknown keys
+// are errors
+func parseSyntheticFile(fname string, v interface{}) error {
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	content, err = yaml.YAMLToJSON(content)
+	if err != nil {
+		return fmt.Errorf("Can't parse %s: %v", fname, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("Can't parse %s: %v", fname, err)
+	}
+	return nil
+}
+
+// loadSyntheticCards reads and validates the synthetic cards
+func loadSyntheticCards(fname string) ([]*SyntheticCard, error) {
+	var spec struct {
+		Cards []*SyntheticCard `json:"cards"`
+	}
+	if err := parseSyntheticFile(fname, &spec); err != nil {
+		return nil, err
+	}
+	total := 0
+	for i, card := range spec.Cards {
+		if card == nil || card.Shell == "" {
+			return nil, fmt.Errorf("card %d in %s has no shell", i, fname)
+		}
+		if card.Type == "" {
+			parts := strings.Split(card.Shell, "_")
+			if len(parts) < 2 {
+				return nil, fmt.Errorf("card %d in %s: no type in shell %q, set the type", i, fname, card.Shell)
+			}
+			card.Type = parts[1]
+		}
+		if card.Count == 0 {
+			card.Count = 1
+		}
+		if card.DevicesPerCard == 0 {
+			card.DevicesPerCard = 1
+		}
+		if card.Count < 0 || card.DevicesPerCard < 0 || card.Replicas < 0 {
+			return nil, fmt.Errorf("card %d in %s: negative count, devicesPerCard or replicas", i, fname)
+		}
+		if len(card.SerialNumbers) > card.Count {
+			return nil, fmt.Errorf("card %d in %s: %d serial numbers for %d cards", i, fname, len(card.SerialNumbers), card.Count)
+		}
+		total += card.Count * card.DevicesPerCard
+	}
+	if total > 0x100-SyntheticBusBase {
+		return nil, fmt.Errorf("%d synthetic devices in %s, expect at most %d", total, fname, 0x100-SyntheticBusBase)
+	}
+	return spec.Cards, nil
+}
+
+// loadSyntheticFaults reads the faults of the control file, they apply from
+// the modification time of the file
+func loadSyntheticFaults(fname string) ([]*SyntheticFault, time.Time, error) {
+	info, err := os.Stat(fname)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var control struct {
+		Faults []*SyntheticFault `json:"faults"`
+	}
+	if err := parseSyntheticFile(fname, &control); err != nil {
+		return nil, time.Time{}, err
+	}
+	for i, fault := range control.Faults {
+		if fault == nil || fault.Device == "" {
+			return nil, time.Time{}, fmt.Errorf("fault %d in %s has no device", i, fname)
+		}
+		switch fault.Fault {
+		case SyntheticFaultRemove, SyntheticFaultUnhealthy, SyntheticFaultOverTemp:
+		default:
+			return nil, time.Time{}, fmt.Errorf("fault %d in %s: unknown fault %q, expect %s, %s or %s", i, fname, fault.Fault,
+				SyntheticFaultRemove, SyntheticFaultUnhealthy, SyntheticFaultOverTemp)
+		}
+		if fault.After != "" {
+			if fault.after, err = time.ParseDuration(fault.After); err != nil {
+				return nil, time.Time{}, fmt.Errorf("fault %d in %s: invalid after %q: %v", i, fname, fault.After, err)
+			}
+		}
+		if fault.For != "" {
+			if fault.duration, err = time.ParseDuration(fault.For); err != nil {
+				return nil, time.Time{}, fmt.Errorf("fault %d in %s: invalid for %q: %v", i, fname, fault.For, err)
+			}
+		}
+		if fault.Temperature == 0 {
+			fault.Temperature = SyntheticOverTemp
+		}
+	}
+	return control.Faults, info.ModTime(), nil
+}
+
+// active tells whether the fault applies at now, for a script started at
+// start
+func (f *SyntheticFault) active(start time.Time, now time.Time) bool {
+	from := start.Add(f.after)
+	if now.Before(from) {
+		return false
+	}
+	return f.duration == 0 || now.Before(from.Add(f.duration))
+}
+
+// matches tells whether the fault targets the device
+func (f *SyntheticFault) matches(device Device) bool {
+	return f.Device == device.DBDF || f.Device == GetPciBDF(device.DBDF) ||
+		(device.SN != "" && f.Device == device.SN)
+}
+
+// createStandInNode creates a character device with the numbers of
+// /dev/null, so the container runtimes accept it as a device. Without the
+// privilege to create device nodes, a regular file is created instead.
+func createStandInNode(node string) error {
+	if FileExist(node) {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(node), 0755); err != nil {
+		return err
+	}
+	err := syscall.Mknod(node, syscall.S_IFCHR|0666, 1<<8|3)
+	if err == nil {
+		return os.Chmod(node, 0666)
+	}
+	if !os.IsPermission(err) {
+		return fmt.Errorf("Can't create %s: %v", node, err)
+	}
+	discoveryLog.Warnf("Can't create device node %s, a regular file stands in: %v", node, err)
+	return ioutil.WriteFile(node, nil, 0666)
+}
+
+// syntheticFaults is the last fault of every synthetic device, the changes
+// are logged once rather than on every scan. syntheticTemperatures are the
+// temperatures of the synthetic devices in an overtemp fault by device ID,
+// the telemetry reports the hottest device of each card. syntheticLock
+// guards both, the devices are scanned and read concurrently.
+var (
+	syntheticLock         sync.Mutex
+	syntheticFaults       = make(map[string]string)
+	syntheticTemperatures = make(map[string]int)
+)
+
+// GetSyntheticDevices fabricates the devices of the synthetic cards and
+// applies the faults of the control file
+func GetSyntheticDevices() ([]Device, error) {
+	cards, err := loadSyntheticCards(cfg().SyntheticSpecFile)
+	if err != nil {
+		return nil, err
+	}
+	var faults []*SyntheticFault
+	var start time.Time
+	if cfg().SyntheticControlFile != "" && FileExist(cfg().SyntheticControlFile) {
+		if faults, start, err = loadSyntheticFaults(cfg().SyntheticControlFile); err != nil {
+			discoveryLog.Errorf("Invalid synthetic control file, no fault is applied: %v", err)
+			faults = nil
+		}
+	}
+	now := time.Now()
+
+	var devices []Device
+	bus := SyntheticBusBase
+	for _, card := range cards {
+		sum := sha1.Sum([]byte(card.Shell))
+		uuid := card.UUID
+		if uuid == "" {
+			uuid = hex.EncodeToString(sum[:3])
+		}
+		timestamp := card.Timestamp
+		if timestamp == "" {
+			timestamp = "0"
+		}
+		replicas := card.Replicas
+		if replicas == 0 {
+			replicas = 1
+			if cfg().VirtualDev {
+				replicas = cfg().VirtualNum
+			}
+		}
+		shell := card.Shell
+		family := getShellFamily(shell)
+		if family != nil && family.Rename {
+			shell = family.Name
+		}
+		for i := 0; i < card.Count; i++ {
+			SN := fmt.Sprintf("SYN%s%04X", strings.ToUpper(card.Type), bus)
+			if i < len(card.SerialNumbers) {
+				SN = card.SerialNumbers[i]
+			}
+			// kubelet's topology manager aligns the devices with a known
+			// node with the CPUs of the pod
+			var topology *pluginapi.TopologyInfo
+			if len(card.NUMANodes) != 0 {
+				if node := card.NUMANodes[i%len(card.NUMANodes)]; node >= 0 {
+					topology = &pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: int64(node)}}}
+				}
+			}
+			for j := 0; j < card.DevicesPerCard; j++ {
+				userBDF := fmt.Sprintf("0000:%02x:00.1", bus)
+				instance, _ := GetInstance(fmt.Sprintf("0000:%02x:00.0", bus))
+				nodes := &Pairs{
+					User: path.Join(cfg().SyntheticDevDir, "dri", DRMSTR+strconv.Itoa(SyntheticRenderBase+bus-SyntheticBusBase)),
+				}
+				if card.Mgmt == nil || *card.Mgmt {
+					nodes.Mgmt = path.Join(cfg().SyntheticDevDir, "xclmgmt"+instance)
+				}
+				if card.Qdma {
+					nodes.Qdma = path.Join(cfg().SyntheticDevDir, "xfpga", QDMASTR+instance+".0")
+				}
+				bus++
+				for _, node := range []string{nodes.User, nodes.Mgmt, nodes.Qdma} {
+					if node == "" {
+						continue
+					}
+					if err := createStandInNode(node); err != nil {
+						return nil, err
+					}
+				}
+				for k := 0; k < replicas; k++ {
+					id := userBDF
+					if replicas > 1 || cfg().VirtualDev {
+						id = userBDF + "-" + strconv.Itoa(k)
+					}
+					device := Device{
+						index:      strconv.Itoa(len(devices) + 1),
+						shellVer:   shell,
+						deviceType: card.Type,
+						uuid:       uuid,
+						timestamp:  timestamp,
+						DBDF:       id,
+						deviceID:   "0x5005",
+						vendorID:   XilinxVendorID,
+						Healthy:    pluginapi.Healthy,
+						SN:         SN,
+						Nodes:      nodes,
+						family:     family,
+						vbnv:       card.Shell,
+						topology:   topology,
+					}
+					if applySyntheticFaults(&device, faults, start, now) {
+						devices = append(devices, device)
+					}
+				}
+			}
+		}
+	}
+	return devices, nil
+}
+
+// applySyntheticFaults applies the active faults to the device, it returns
+// false if the device is removed
+func applySyntheticFaults(device *Device, faults []*SyntheticFault, start time.Time, now time.Time) bool {
+	state := ""
+	temperature := 0
+	for _, fault := range faults {
+		if !fault.matches(*device) || !fault.active(start, now) {
+			continue
+		}
+		switch fault.Fault {
+		case SyntheticFaultRemove:
+			state = "removed"
+		case SyntheticFaultUnhealthy:
+			if state == "" {
+				state = "unhealthy"
+			}
+		case SyntheticFaultOverTemp:
+			temperature = fault.Temperature
+			if state == "" {
+				state = fmt.Sprintf("unhealthy, temperature %dC", fault.Temperature)
+			}
+		}
+	}
+	syntheticLock.Lock()
+	if temperature != 0 {
+		syntheticTemperatures[device.DBDF] = temperature
+	} else {
+		delete(syntheticTemperatures, device.DBDF)
+	}
+	changed := state != syntheticFaults[device.DBDF]
+	syntheticFaults[device.DBDF] = state
+	syntheticLock.Unlock()
+	if changed && state == "" {
+		discoveryLog.WithFields(deviceFields(*device)).Printf("Synthetic device %s recovered", device.DBDF)
+	} else if changed {
+		discoveryLog.WithFields(deviceFields(*device)).Printf("Synthetic device %s %s", device.DBDF, state)
+	}
+	if state == "removed" {
+		return false
+	}
+	if state != "" {
+		device.Healthy = pluginapi.Unhealthy
+	}
+	return true
+}
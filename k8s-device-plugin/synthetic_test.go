@@ -0,0 +1,373 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSyntheticFile writes a synthetic spec or control file in dir
+func writeSyntheticFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+	fname := path.Join(dir, name)
+	if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+// useSynthetic serves the synthetic cards of spec with the faults of
+// control, none if empty
+func useSynthetic(t *testing.T, spec string, control string, virtual bool) string {
+	t.Helper()
+	dir := t.TempDir()
+	c := defaultConfig()
+	c.ResetMode = ResetModeOff
+	c.SyntheticSpecFile = writeSyntheticFile(t, dir, "cards.yaml", spec)
+	c.SyntheticDevDir = path.Join(dir, "dev")
+	c.SyntheticControlFile = path.Join(dir, "faults.yaml")
+	if control != "" {
+		writeSyntheticFile(t, dir, "faults.yaml", control)
+	}
+	c.VirtualDev = virtual
+	c.VirtualNum = 3
+	useConfig(t, c)
+	syntheticLock.Lock()
+	syntheticFaults = make(map[string]string)
+	syntheticTemperatures = make(map[string]int)
+	syntheticLock.Unlock()
+	return c.SyntheticControlFile
+}
+
+func TestLoadSyntheticCards(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  string
+		cards []*SyntheticCard
+		err   string
+	}{
+		{"defaults", "cards:\n- shell: xilinx_u250_gen3x16_xdma_shell_4_1\n",
+			[]*SyntheticCard{{Shell: "xilinx_u250_gen3x16_xdma_shell_4_1", Type: "u250", Count: 1, DevicesPerCard: 1}}, ""},
+		{"json", `{"cards": [{"shell": "custom", "type": "u55c", "count": 2, "numaNodes": [1]}]}`,
+			[]*SyntheticCard{{Shell: "custom", Type: "u55c", Count: 2, DevicesPerCard: 1, NUMANodes: []int{1}}}, ""},
+		{"no cards", "cards: []\n", []*SyntheticCard{}, ""},
+		{"no shell", "cards:\n- type: u250\n", nil, "card 0 in"},
+		{"null card", "cards:\n- null\n", nil, "has no shell"},
+		{"no type in shell", "cards:\n- shell: custom\n", nil, `no type in shell "custom"`},
+		{"negative count", "cards:\n- shell: a_b\n  count: -1\n", nil, "negative count"},
+		{"negative replicas", "cards:\n- shell: a_b\n  replicas: -2\n", nil, "negative count"},
+		{"too many serial numbers", "cards:\n- shell: a_b\n  serialNumbers: [A, B]\n", nil, "2 serial numbers for 1 cards"},
+		{"too many devices", "cards:\n- shell: a_b\n  count: 65\n  devicesPerCard: 2\n", nil, "130 synthetic devices"},
+		{"unknown key", "cards:\n- shell: a_b\n  numa: [0]\n", nil, `unknown field "numa"`},
+		{"not yaml", "cards: [", nil, "Can't parse"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cards, err := loadSyntheticCards(writeSyntheticFile(t, dir, "cards.yaml", tt.spec))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, expect %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cards, tt.cards) {
+				t.Errorf("cards %+v, expect %+v", cards, tt.cards)
+			}
+		})
+	}
+	if _, err := loadSyntheticCards(path.Join(dir, "missing.yaml")); !os.IsNotExist(err) {
+		t.Errorf("missing file: error %v", err)
+	}
+}
+
+func TestLoadSyntheticFaults(t *testing.T) {
+	dir := t.TempDir()
+	fname := writeSyntheticFile(t, dir, "faults.yaml",
+		"faults:\n- device: XFL1\n  fault: overtemp\n  after: 1m\n  for: 30s\n- device: 0000:80:00.1\n  fault: overtemp\n  temperature: 90\n")
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(fname, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	faults, start, err := loadSyntheticFaults(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !start.Equal(mtime) {
+		t.Errorf("start %v, expect the modification time %v", start, mtime)
+	}
+	if len(faults) != 2 || faults[0].after != time.Minute || faults[0].duration != 30*time.Second {
+		t.Fatalf("faults %+v", faults)
+	}
+	if faults[0].Temperature != SyntheticOverTemp || faults[1].Temperature != 90 {
+		t.Errorf("temperatures %d and %d, expect %d and 90", faults[0].Temperature, faults[1].Temperature, SyntheticOverTemp)
+	}
+
+	errors := map[string]string{
+		"faults:\n- fault: remove\n":                             "has no device",
+		"faults:\n- device: A\n  fault: melt\n":                  `unknown fault "melt"`,
+		"faults:\n- device: A\n  fault: remove\n  after: soon\n": `invalid after "soon"`,
+		"faults:\n- device: A\n  fault: remove\n  for: \"5\"\n":  `invalid for "5"`,
+		"faults:\n- device: A\n  fault: remove\n  until: 5m\n":   `unknown field "until"`,
+	}
+	for content, expect := range errors {
+		_, _, err := loadSyntheticFaults(writeSyntheticFile(t, dir, "faults.yaml", content))
+		if err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("%q: error %v, expect %q", content, err, expect)
+		}
+	}
+}
+
+func TestSyntheticFaultActive(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		after    time.Duration
+		duration time.Duration
+		elapsed  time.Duration
+		active   bool
+	}{
+		{"immediate", 0, 0, 0, true},
+		{"forever", 0, 0, 24 * time.Hour, true},
+		{"before the delay", time.Minute, 0, 59 * time.Second, false},
+		{"at the delay", time.Minute, 0, time.Minute, true},
+		{"during", time.Minute, time.Minute, 90 * time.Second, true},
+		{"at the end", time.Minute, time.Minute, 2 * time.Minute, false},
+		{"after the end", 0, time.Second, time.Hour, false},
+		{"clock before the file", 0, 0, -time.Second, false},
+	}
+	for _, tt := range tests {
+		fault := &SyntheticFault{after: tt.after, duration: tt.duration}
+		if active := fault.active(start, start.Add(tt.elapsed)); active != tt.active {
+			t.Errorf("%s: active %v, expect %v", tt.name, active, tt.active)
+		}
+	}
+}
+
+func TestSyntheticFaultMatches(t *testing.T) {
+	device := Device{DBDF: "0000:80:00.1-1", SN: "XFL1"}
+	for target, matches := range map[string]bool{
+		"0000:80:00.1-1": true,
+		"0000:80:00.1":   true,
+		"XFL1":           true,
+		"80:00.1":        false,
+		"0000:80:00.1-0": false,
+		"xfl1":           false,
+		"":               false,
+	} {
+		fault := &SyntheticFault{Device: target}
+		if fault.matches(device) != matches {
+			t.Errorf("%q: matches %v, expect %v", target, !matches, matches)
+		}
+	}
+	if (&SyntheticFault{Device: ""}).matches(Device{DBDF: "0000:80:00.1"}) {
+		t.Errorf("empty device matches a device without serial number")
+	}
+}
+
+func TestGetSyntheticDevices(t *testing.T) {
+	useSynthetic(t, `cards:
+- shell: xilinx_u250_gen3x16_xdma_shell_4_1
+  count: 2
+  numaNodes: [1]
+  qdma: true
+- shell: xilinx_u30_gen3x4_base_2
+  devicesPerCard: 2
+  serialNumbers: [XFL1U30A]
+  replicas: 2
+  mgmt: false
+  numaNodes: [0]
+`, "", false)
+	devices, err := GetSyntheticDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type summary struct {
+		DBDF, SN, deviceType string
+		numaNode             int64
+		mgmt, qdma           bool
+	}
+	var got []summary
+	for _, device := range devices {
+		numaNode := int64(-1)
+		if device.topology != nil {
+			numaNode = device.topology.Nodes[0].ID
+		}
+		got = append(got, summary{device.DBDF, device.SN, device.deviceType, numaNode,
+			device.Nodes.Mgmt != "", device.Nodes.Qdma != ""})
+		for _, node := range []string{device.Nodes.User, device.Nodes.Mgmt, device.Nodes.Qdma} {
+			if node != "" && !strings.HasPrefix(node, cfg().SyntheticDevDir) {
+				t.Errorf("%s: node %s outside %s", device.DBDF, node, cfg().SyntheticDevDir)
+			} else if node != "" && !FileExist(node) {
+				t.Errorf("%s: no stand-in node %s", device.DBDF, node)
+			}
+		}
+		if device.Healthy != "Healthy" {
+			t.Errorf("%s is %s", device.DBDF, device.Healthy)
+		}
+	}
+	expect := []summary{
+		{"0000:80:00.1", "SYNU2500080", "u250", 1, true, true},
+		{"0000:81:00.1", "SYNU2500081", "u250", 1, true, true},
+		{"0000:82:00.1-0", "XFL1U30A", "u30", 0, false, false},
+		{"0000:82:00.1-1", "XFL1U30A", "u30", 0, false, false},
+		{"0000:83:00.1-0", "XFL1U30A", "u30", 0, false, false},
+		{"0000:83:00.1-1", "XFL1U30A", "u30", 0, false, false},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("devices\n%+v\nexpect\n%+v", got, expect)
+	}
+	if devices[2].family == nil || devices[2].shellVer != devices[2].family.Name {
+		t.Errorf("U30 shell %q is not renamed after its family", devices[2].shellVer)
+	}
+	if devices[0].uuid == "" || devices[0].uuid != devices[1].uuid || devices[0].uuid == devices[2].uuid {
+		t.Errorf("uuids %q %q %q, expect one per shell", devices[0].uuid, devices[1].uuid, devices[2].uuid)
+	}
+}
+
+func TestGetSyntheticDevicesVirtual(t *testing.T) {
+	useSynthetic(t, "cards:\n- shell: xilinx_u250_gen3x16_xdma_shell_4_1\n- shell: xilinx_u55c_gen3x16_xdma_base_3\n  replicas: 1\n", "", true)
+	devices, err := GetSyntheticDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, device := range devices {
+		ids = append(ids, device.DBDF)
+	}
+	expect := []string{"0000:80:00.1-0", "0000:80:00.1-1", "0000:80:00.1-2", "0000:81:00.1-0"}
+	if !reflect.DeepEqual(ids, expect) {
+		t.Errorf("ids %v, expect %v", ids, expect)
+	}
+}
+
+func TestGetSyntheticDevicesFaults(t *testing.T) {
+	control := useSynthetic(t, "cards:\n- shell: xilinx_u250_gen3x16_xdma_shell_4_1\n  count: 3\n  serialNumbers: [A, B, C]\n", "", false)
+	states := func() map[string]string {
+		t.Helper()
+		devices, err := GetSyntheticDevices()
+		if err != nil {
+			t.Fatal(err)
+		}
+		states := make(map[string]string)
+		for _, device := range devices {
+			states[device.SN] = device.Healthy
+		}
+		return states
+	}
+	// script starts at the modification time of the control file
+	script := func(content string, age time.Duration) {
+		t.Helper()
+		writeSyntheticFile(t, path.Dir(control), path.Base(control), content)
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(control, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	faults := `faults:
+- device: 0000:80:00.1
+  fault: unhealthy
+  after: 1m
+  for: 1m
+- device: B
+  fault: remove
+  for: 1m
+- device: C
+  fault: overtemp
+  after: 1m
+- device: C
+  fault: remove
+  after: 2m
+`
+	tests := []struct {
+		name    string
+		control string
+		age     time.Duration
+		states  map[string]string
+	}{
+		{"no control file", "", 0, map[string]string{"A": "Healthy", "B": "Healthy", "C": "Healthy"}},
+		{"started", faults, 0, map[string]string{"A": "Healthy", "C": "Healthy"}},
+		{"after a minute", faults, 90 * time.Second, map[string]string{"A": "Unhealthy", "B": "Healthy", "C": "Unhealthy"}},
+		{"removal wins", faults, 3 * time.Minute, map[string]string{"A": "Healthy", "B": "Healthy"}},
+		{"invalid control file", "faults:\n- device: A\n  fault: melt\n", 0, map[string]string{"A": "Healthy", "B": "Healthy", "C": "Healthy"}},
+		{"fault removed from the file", "faults: []\n", time.Hour, map[string]string{"A": "Healthy", "B": "Healthy", "C": "Healthy"}},
+	}
+	for _, tt := range tests {
+		if tt.control != "" {
+			script(tt.control, tt.age)
+		}
+		if got := states(); !reflect.DeepEqual(got, tt.states) {
+			t.Errorf("%s: states %v, expect %v", tt.name, got, tt.states)
+		}
+	}
+	syntheticLock.Lock()
+	defer syntheticLock.Unlock()
+	if syntheticFaults["0000:80:00.1"] != "" || syntheticFaults["0000:82:00.1"] != "" {
+		t.Errorf("recovered faults are still recorded: %v", syntheticFaults)
+	}
+}
+
+// TestApplySyntheticFaultsConcurrent applies the faults to the devices from
+// several goroutines while the telemetry reads them, go test -race reports
+// an unlocked access to the recorded faults
+func TestApplySyntheticFaultsConcurrent(t *testing.T) {
+	useSynthetic(t, "cards:\n- shell: xilinx_u250_gen3x16_xdma_shell_4_1\n", "", false)
+	captureLog(t, log.InfoLevel)
+	faults := []*SyntheticFault{{Device: "0000:80:00.1", Fault: SyntheticFaultOverTemp, Temperature: 90}}
+	start := time.Now()
+	ready, done := make(chan struct{}), make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			<-ready
+			for j := 0; j < 1000; j++ {
+				device := Device{DBDF: "0000:80:00.1"}
+				// the fault is raised and cleared on every other pass
+				if (i+j)%2 == 0 {
+					applySyntheticFaults(&device, faults, start, start)
+				} else {
+					applySyntheticFaults(&device, nil, start, start)
+				}
+				readSyntheticSensors("0000:80:00.1")
+			}
+		}(i)
+	}
+	close(ready)
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	device := Device{DBDF: "0000:80:00.1"}
+	if applySyntheticFaults(&device, faults, start, start); device.Healthy != "Unhealthy" {
+		t.Errorf("device %s in an overtemp fault", device.Healthy)
+	}
+	syntheticLock.Lock()
+	defer syntheticLock.Unlock()
+	if syntheticFaults["0000:80:00.1"] != "unhealthy, temperature 90C" {
+		t.Errorf("fault %q recorded", syntheticFaults["0000:80:00.1"])
+	}
+}
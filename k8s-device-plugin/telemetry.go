@@ -0,0 +1,251 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cardReading is a value of a card, e.g. a sensor in the unit of its metric,
+// with the labels telling it from the other values of the card
+type cardReading struct {
+	metric string
+	labels []string
+	value  float64
+}
+
+// hwmonInput matches the inputs of a hwmon device, e.g. temp1_input
+var hwmonInput = regexp.MustCompile(`^(temp|in|curr|power|fan)([0-9]+)_input$`)
+
+// hwmonScales are the hwmon metrics and the scale of their raw values, in
+// millidegree Celsius, millivolt, milliampere, microwatt and RPM
+var hwmonScales = map[string]struct {
+	metric string
+	scale  float64
+}{
+	"temp":  {metricCardTemperature, 1e-3},
+	"in":    {metricCardVoltage, 1e-3},
+	"curr":  {metricCardCurrent, 1e-3},
+	"power": {metricCardPower, 1e-6},
+	"fan":   {metricCardFan, 1},
+}
+
+// readHwmonSensors reads the sensors of the hwmon devices under dir
+func readHwmonSensors(dir string) []cardReading {
+	readings := []cardReading{}
+	hwmons, _ := filepath.Glob(path.Join(dir, "hwmon", "hwmon*"))
+	for _, hwmon := range hwmons {
+		files, err := ioutil.ReadDir(hwmon)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			match := hwmonInput.FindStringSubmatch(file.Name())
+			if match == nil {
+				continue
+			}
+			content, err := GetFileContent(path.Join(hwmon, file.Name()))
+			if err != nil {
+				continue
+			}
+			raw, err := strconv.ParseFloat(strings.TrimSpace(content), 64)
+			if err != nil {
+				continue
+			}
+			sensor := match[1] + match[2]
+			if label, err := GetFileContent(path.Join(hwmon, sensor+"_label")); err == nil && strings.TrimSpace(label) != "" {
+				sensor = strings.TrimSpace(label)
+			}
+			scale := hwmonScales[match[1]]
+			readings = append(readings, cardReading{metric: scale.metric, labels: []string{"sensor", sensor}, value: raw * scale.scale})
+		}
+	}
+	return readings
+}
+
+// xmcPowerRails are the rails the power draw of a card is computed from, like
+// xbutil does
+var xmcPowerRails = []string{"12v_pex", "12v_aux", "3v3_pex"}
+
+// readXmcSensors reads the sensors of the xmc folder of a card: temperatures
+// in degree Celsius, voltages in millivolt, currents in milliampere and the
+// fan speed in RPM. Temperatures of 0 are sensors the card doesn't have.
+func readXmcSensors(dir string) []cardReading {
+	readings := []cardReading{}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return readings
+	}
+	volts := make(map[string]float64)
+	amps := make(map[string]float64)
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, "xmc_") {
+			continue
+		}
+		content, err := GetFileContent(path.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		raw, err := strconv.ParseFloat(strings.TrimSpace(content), 64)
+		if err != nil {
+			continue
+		}
+		name = strings.TrimPrefix(name, "xmc_")
+		switch {
+		case name == "fan_rpm":
+			readings = append(readings, cardReading{metric: metricCardFan, labels: []string{"sensor", "fan"}, value: raw})
+		case strings.HasSuffix(name, "_vol"):
+			rail := strings.TrimSuffix(name, "_vol")
+			volts[rail] = raw / 1e3
+			readings = append(readings, cardReading{metric: metricCardVoltage, labels: []string{"sensor", rail}, value: raw / 1e3})
+		case strings.HasSuffix(name, "_curr"):
+			rail := strings.TrimSuffix(name, "_curr")
+			amps[rail] = raw / 1e3
+			readings = append(readings, cardReading{metric: metricCardCurrent, labels: []string{"sensor", rail}, value: raw / 1e3})
+		case strings.Contains(name, "temp") && raw != 0:
+			sensor := strings.TrimSuffix(strings.Replace(name, "_temp", "", 1), "_")
+			readings = append(readings, cardReading{metric: metricCardTemperature, labels: []string{"sensor", sensor}, value: raw})
+		}
+	}
+	power, found := 0.0, false
+	for _, rail := range xmcPowerRails {
+		if v, ok := volts[rail]; ok {
+			power += v * amps[rail]
+			found = true
+		}
+	}
+	if found {
+		readings = append(readings, cardReading{metric: metricCardPower, labels: []string{"sensor", "total"}, value: power})
+	}
+	return readings
+}
+
+// readSyntheticSensors fabricates the sensors of a synthetic card, its
+// temperature is the highest of the overtemp faults of its devices if any
+func readSyntheticSensors(bdf string) []cardReading {
+	temperature := 45.0
+	hot := false
+	syntheticLock.Lock()
+	for id, t := range syntheticTemperatures {
+		if GetPciBDF(id) == bdf && (!hot || float64(t) > temperature) {
+			temperature = float64(t)
+			hot = true
+		}
+	}
+	syntheticLock.Unlock()
+	return []cardReading{
+		{metric: metricCardTemperature, labels: []string{"sensor", "fpga"}, value: temperature},
+		{metric: metricCardPower, labels: []string{"sensor", "total"}, value: 25},
+		{metric: metricCardVoltage, labels: []string{"sensor", "12v_pex"}, value: 12},
+		{metric: metricCardCurrent, labels: []string{"sensor", "12v_pex"}, value: 25.0 / 12},
+		{metric: metricCardFan, labels: []string{"sensor", "fan"}, value: 3000},
+	}
+}
+
+// readCardSensors reads the sensors of the card of a device: the xmc or
+// hwmon_sdm folder of an Alveo card, the hwmon devices of an AMA card
+func readCardSensors(device Device) []cardReading {
+	bdf := GetPciBDF(device.DBDF)
+	if cfg().SyntheticSpecFile != "" {
+		return readSyntheticSensors(bdf)
+	}
+	dir := path.Join(SysfsDevices, bdf)
+	readings := readHwmonSensors(dir)
+	for _, prefix := range []string{SNSTR, SNSTRV70} {
+		folder, err := GetFileNameFromPrefix(dir, prefix)
+		if err != nil || folder == "" {
+			continue
+		}
+		readings = append(readings, readXmcSensors(path.Join(dir, folder))...)
+		readings = append(readings, readHwmonSensors(path.Join(dir, folder))...)
+	}
+	return readings
+}
+
+// cardTelemetry are the readings of a card with its labels
+type cardTelemetry struct {
+	labels   []string
+	readings []cardReading
+}
+
+// telemetryCache keeps the last readings of the cards, the cards are read at most
+// every TelemetryInterval seconds whatever the scrape rate
+type telemetryCache struct {
+	lock    sync.Mutex
+	updated time.Time
+	cards   []cardTelemetry
+}
+
+var telemetry telemetryCache
+
+// telemetryMetrics are the metrics set from the telemetry cache
+var telemetryMetrics = []string{
+	metricCardTemperature, metricCardPower, metricCardVoltage, metricCardCurrent, metricCardFan,
+	metricCUUsage, metricCUStatus, metricXclbin,
+}
+
+// collectTelemetry sets the sensor and compute unit metrics of every card
+// the plugin discovered, whether or not its resources are registered with
+// kubelet. The metrics are removed when the telemetry is off.
+func (m *FPGADevicePlugin) collectTelemetry() {
+	for _, metric := range telemetryMetrics {
+		metrics.reset(metric)
+	}
+	if !cfg().Telemetry {
+		return
+	}
+	telemetry.lock.Lock()
+	defer telemetry.lock.Unlock()
+	if time.Since(telemetry.updated) >= time.Duration(cfg().TelemetryInterval)*time.Second {
+		m.nameLock.Lock()
+		devices := m.scanned
+		names := m.names
+		m.nameLock.Unlock()
+
+		cards := []cardTelemetry{}
+		seen := make(map[string]bool)
+		for _, device := range devices {
+			bdf := GetPciBDF(device.DBDF)
+			if seen[bdf] {
+				continue
+			}
+			seen[bdf] = true
+			cards = append(cards, cardTelemetry{
+				labels: []string{"bdf", bdf, "sn", device.SN, "shell", device.vbnv,
+					"resource", cfg().ResourceDomain + "/" + getDSAtype(device, names)},
+				readings: append(readCardSensors(device), readCUStats(device)...),
+			})
+		}
+		telemetry.cards = cards
+		telemetry.updated = time.Now()
+	}
+
+	for _, card := range telemetry.cards {
+		for _, reading := range card.readings {
+			metrics.set(reading.metric, reading.value, append(card.labels, reading.labels...)...)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFiles creates the files under dir, the names may have folders
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		fname := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readingValues keys the readings by metric and labels
+func readingValues(readings []cardReading) map[string]float64 {
+	values := make(map[string]float64)
+	for _, reading := range readings {
+		values[reading.metric+"{"+strings.Join(reading.labels, "=")+"}"] = reading.value
+	}
+	return values
+}
+
+func checkReadings(t *testing.T, readings []cardReading, want map[string]float64) {
+	t.Helper()
+	got := readingValues(readings)
+	if len(got) != len(readings) {
+		t.Errorf("duplicate readings in %v", readings)
+	}
+	for key, value := range want {
+		if v, ok := got[key]; !ok || math.Abs(v-value) > 1e-9 {
+			t.Errorf("%s is %v, want %v", key, got[key], value)
+		}
+	}
+	for key, value := range got {
+		if _, ok := want[key]; !ok {
+			t.Errorf("unexpected reading %s %v", key, value)
+		}
+	}
+}
+
+func TestReadXmcSensors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  map[string]float64
+	}{
+		{
+			name: "temperatures in degree Celsius, missing sensors at 0",
+			files: map[string]string{
+				"xmc_fpga_temp":     "62\n",
+				"xmc_cage_temp0":    "35",
+				"xmc_se98_temp1":    "0",
+				"xmc_fan_temp":      "41",
+				"xmc_fan_rpm":       "3120",
+				"xmc_serial_num":    "XFL1A",
+				"other_fpga_temp":   "99",
+				"xmc_vccint_temp":   "invalid",
+				"xmc_hbm_temp_unit": "c",
+			},
+			want: map[string]float64{
+				metricCardTemperature + "{sensor=fpga}":  62,
+				metricCardTemperature + "{sensor=cage0}": 35,
+				metricCardTemperature + "{sensor=fan}":   41,
+				metricCardFan + "{sensor=fan}":           3120,
+			},
+		},
+		{
+			name: "rails in volt and ampere, power of the main rails",
+			files: map[string]string{
+				"xmc_12v_pex_vol":  "12100",
+				"xmc_12v_pex_curr": "2500",
+				"xmc_12v_aux_vol":  "12000",
+				"xmc_12v_aux_curr": "1000",
+				"xmc_3v3_pex_vol":  "3300",
+				"xmc_vccint_vol":   "850",
+				"xmc_vccint_curr":  "20000",
+			},
+			want: map[string]float64{
+				metricCardVoltage + "{sensor=12v_pex}": 12.1,
+				metricCardCurrent + "{sensor=12v_pex}": 2.5,
+				metricCardVoltage + "{sensor=12v_aux}": 12,
+				metricCardCurrent + "{sensor=12v_aux}": 1,
+				metricCardVoltage + "{sensor=3v3_pex}": 3.3,
+				metricCardVoltage + "{sensor=vccint}":  0.85,
+				metricCardCurrent + "{sensor=vccint}":  20,
+				// 12.1*2.5 + 12*1 + 3.3*0, vccint is not a power rail
+				metricCardPower + "{sensor=total}": 42.25,
+			},
+		},
+		{
+			name:  "no power without a main rail",
+			files: map[string]string{"xmc_vccint_vol": "850", "xmc_vccint_curr": "20000"},
+			want: map[string]float64{
+				metricCardVoltage + "{sensor=vccint}": 0.85,
+				metricCardCurrent + "{sensor=vccint}": 20,
+			},
+		},
+		{
+			name: "no xmc folder",
+			want: map[string]float64{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := path.Join(t.TempDir(), "xmc.u.1")
+			if test.files != nil {
+				writeFiles(t, dir, test.files)
+			}
+			checkReadings(t, readXmcSensors(dir), test.want)
+		})
+	}
+}
+
+func TestReadHwmonSensors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  map[string]float64
+	}{
+		{
+			name: "raw units are scaled",
+			files: map[string]string{
+				"hwmon/hwmon3/temp1_input":  "54500",
+				"hwmon/hwmon3/in0_input":    "12050",
+				"hwmon/hwmon3/curr1_input":  "3200",
+				"hwmon/hwmon3/power1_input": "38500000",
+				"hwmon/hwmon3/fan1_input":   "2900",
+			},
+			want: map[string]float64{
+				metricCardTemperature + "{sensor=temp1}": 54.5,
+				metricCardVoltage + "{sensor=in0}":       12.05,
+				metricCardCurrent + "{sensor=curr1}":     3.2,
+				metricCardPower + "{sensor=power1}":      38.5,
+				metricCardFan + "{sensor=fan1}":          2900,
+			},
+		},
+		{
+			name: "labels name the sensors",
+			files: map[string]string{
+				"hwmon/hwmon3/temp1_input":  "61000",
+				"hwmon/hwmon3/temp1_label":  "fpga\n",
+				"hwmon/hwmon3/temp2_input":  "40000",
+				"hwmon/hwmon3/temp2_label":  "\n",
+				"hwmon/hwmon4/power1_input": "1000000",
+				"hwmon/hwmon4/power1_label": "total",
+			},
+			want: map[string]float64{
+				metricCardTemperature + "{sensor=fpga}":  61,
+				metricCardTemperature + "{sensor=temp2}": 40,
+				metricCardPower + "{sensor=total}":       1,
+			},
+		},
+		{
+			name: "other files are skipped",
+			files: map[string]string{
+				"hwmon/hwmon3/temp1_max":   "95000",
+				"hwmon/hwmon3/temp1_input": "invalid",
+				"hwmon/hwmon3/name":        "sdm",
+				"hwmon/other/temp1_input":  "50000",
+			},
+			want: map[string]float64{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, test.files)
+			checkReadings(t, readHwmonSensors(dir), test.want)
+		})
+	}
+}
+
+func TestReadCardSensors(t *testing.T) {
+	useConfig(t, defaultConfig())
+	defer func(sysfs string) { SysfsDevices = sysfs }(SysfsDevices)
+	SysfsDevices = t.TempDir()
+	writeFiles(t, SysfsDevices, map[string]string{
+		// U250 with its xmc folder
+		"0000:3b:00.0/xmc.u.2097152/xmc_fpga_temp": "60",
+		"0000:3b:00.0/xmc.u.2097152/xmc_fan_rpm":   "3000",
+		// V70 with the hwmon devices of its hwmon_sdm folder
+		"0000:3c:00.0/hwmon_sdm.u.4194304/hwmon/hwmon2/temp1_input": "50000",
+		"0000:3c:00.0/hwmon_sdm.u.4194304/hwmon/hwmon2/temp1_label": "fpga",
+		// AMA card with hwmon devices of its own
+		"0000:3d:00.0/hwmon/hwmon5/power1_input": "20000000",
+	})
+	tests := []struct {
+		dbdf string
+		want map[string]float64
+	}{
+		{"0000:3b:00.0", map[string]float64{metricCardTemperature + "{sensor=fpga}": 60, metricCardFan + "{sensor=fan}": 3000}},
+		{"0000:3c:00.0-1", map[string]float64{metricCardTemperature + "{sensor=fpga}": 50}},
+		{"0000:3d:00.0", map[string]float64{metricCardPower + "{sensor=power1}": 20}},
+		{"0000:3e:00.0", map[string]float64{}},
+	}
+	for _, test := range tests {
+		t.Run(test.dbdf, func(t *testing.T) {
+			checkReadings(t, readCardSensors(Device{DBDF: test.dbdf}), test.want)
+		})
+	}
+}
+
+func TestReadSyntheticSensors(t *testing.T) {
+	control := useSynthetic(t, "cards:\n- shell: xilinx_u250_gen3x16_xdma_shell_4_1\n  count: 2\n",
+		"faults:\n- device: 0000:81:00.1\n  fault: overtemp\n  temperature: 98\n", false)
+	if _, err := GetSyntheticDevices(); err != nil {
+		t.Fatal(err)
+	}
+	temperature := func(bdf string) float64 {
+		return readingValues(readCardSensors(Device{DBDF: bdf}))[metricCardTemperature+"{sensor=fpga}"]
+	}
+	if temperature("0000:80:00.1") != 45 || temperature("0000:81:00.1") != 98 {
+		t.Errorf("temperatures %v and %v, expect 45 and 98", temperature("0000:80:00.1"), temperature("0000:81:00.1"))
+	}
+
+	// the card cools down once the fault is over
+	writeFiles(t, path.Dir(control), map[string]string{path.Base(control): "faults: []\n"})
+	if _, err := GetSyntheticDevices(); err != nil {
+		t.Fatal(err)
+	}
+	if temperature("0000:81:00.1") != 45 {
+		t.Errorf("temperature %v after the fault, expect 45", temperature("0000:81:00.1"))
+	}
+}
+
+func TestReadSyntheticSensorsHottestDevice(t *testing.T) {
+	useSynthetic(t, "cards:\n- shell: xilinx_u30_gen3x4_base_2\n  replicas: 2\n",
+		`faults:
+- device: 0000:80:00.1-0
+  fault: overtemp
+  temperature: 90
+- device: 0000:80:00.1-1
+  fault: overtemp
+  temperature: 95
+`, false)
+	devices, err := GetSyntheticDevices()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(devices) != 2 {
+		t.Fatalf("%d devices, expect the 2 replicas of the card", len(devices))
+	}
+	// the replicas read the temperature of the hottest one
+	for _, device := range devices {
+		got := readingValues(readCardSensors(device))[metricCardTemperature+"{sensor=fpga}"]
+		if got != 95 {
+			t.Errorf("%s: temperature %v, expect 95", device.DBDF, got)
+		}
+	}
+}
+
+func TestCollectTelemetry(t *testing.T) {
+	r := useMetrics(t)
+	c := defaultConfig()
+	c.TelemetryInterval = 3600
+	useConfig(t, c)
+	defer func(sysfs string) { SysfsDevices = sysfs }(SysfsDevices)
+	SysfsDevices = t.TempDir()
+	fpgaTemp := "0000:3b:00.1/xmc.u.2097152/xmc_fpga_temp"
+	writeFiles(t, SysfsDevices, map[string]string{fpgaTemp: "60"})
+	resetCache := func() {
+		telemetry.lock.Lock()
+		telemetry.updated = time.Time{}
+		telemetry.lock.Unlock()
+	}
+	resetCache()
+	defer resetCache()
+
+	// the replicas of a device are one card
+	device := Device{DBDF: "0000:3b:00.1-0", SN: "XFL1", vbnv: "xilinx_u250_gen3x16_xdma_shell_4_1", shellVer: "xilinx_u250_gen3x16_xdma_shell_4_1", deviceType: "u250"}
+	replica := device
+	replica.DBDF = "0000:3b:00.1-1"
+	m := &FPGADevicePlugin{scanned: []Device{device, replica}}
+	line := `amd_fpga_card_temperature_celsius{bdf="0000:3b:00.1",sn="XFL1",shell="xilinx_u250_gen3x16_xdma_shell_4_1",resource="amd.com/` +
+		getDSAtype(device, nil) + `",sensor="fpga"} `
+	m.collectTelemetry()
+	if text := metricsText(t, r); strings.Count(text, line) != 1 || !strings.Contains(text, line+"60\n") {
+		t.Fatalf("no single %s60 in\n%s", line, text)
+	}
+
+	// the readings are cached for the interval
+	writeFiles(t, SysfsDevices, map[string]string{fpgaTemp: "70"})
+	m.collectTelemetry()
+	if text := metricsText(t, r); !strings.Contains(text, line+"60\n") {
+		t.Errorf("cached reading not reported:\n%s", text)
+	}
+	resetCache()
+	m.collectTelemetry()
+	if text := metricsText(t, r); !strings.Contains(text, line+"70\n") {
+		t.Errorf("new reading not reported:\n%s", text)
+	}
+
+	// the metrics are removed when the telemetry is turned off
+	c = defaultConfig()
+	c.Telemetry = false
+	useConfig(t, c)
+	m.collectTelemetry()
+	if text := metricsText(t, r); strings.Contains(text, "amd_fpga_card_") {
+		t.Errorf("telemetry off, card metrics reported:\n%s", text)
+	}
+}
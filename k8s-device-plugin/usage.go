@@ -0,0 +1,298 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// metricPodDeviceSeconds is the usage accounting in the metrics
+	metricPodDeviceSeconds = "amd_fpga_pod_device_seconds_total"
+	// usageRetention is how long the usage of a pod is kept once it holds no
+	// device
+	usageRetention = 24 * time.Hour
+)
+
+// usageKey identifies the usage of a resource by a pod
+type usageKey struct {
+	namespace string
+	pod       string
+	resource  string
+}
+
+// PodUsage is the usage of a resource by a pod
+type PodUsage struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Resource  string `json:"resource"`
+	// DeviceSeconds is the time the pod held the devices of the resource,
+	// summed over the devices, Reported the DeviceSeconds as of the last
+	// report
+	DeviceSeconds float64 `json:"deviceSeconds"`
+	Reported      float64 `json:"reported"`
+	// LastSeen is when the pod was last seen holding a device
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// usageState is the content of UsageStateFile
+type usageState struct {
+	LastReport time.Time   `json:"lastReport"`
+	Pods       []*PodUsage `json:"pods"`
+}
+
+// UsageReportEntry is the usage of a resource by a pod in a usage report
+type UsageReportEntry struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Resource  string `json:"resource"`
+	// DeviceSeconds is the usage within the period of the report,
+	// TotalDeviceSeconds since the pod was first seen
+	DeviceSeconds      float64 `json:"deviceSeconds"`
+	TotalDeviceSeconds float64 `json:"totalDeviceSeconds"`
+}
+
+// UsageReport is the usage of the pods which held devices in a period
+type UsageReport struct {
+	Node  string             `json:"node,omitempty"`
+	Start time.Time          `json:"start"`
+	End   time.Time          `json:"end"`
+	Usage []UsageReportEntry `json:"usage"`
+}
+
+// UsageAccounting accumulates the device-seconds per namespace, pod and
+// resource from the listings of the pod map. The devices held at a listing
+// are charged until the next listing, so the accounting is accurate to
+// PodResourcesInterval.
+type UsageAccounting struct {
+	lock sync.Mutex
+	pods map[usageKey]*PodUsage
+	// held are the devices each pod held at the last listing, listed when
+	held   map[usageKey]int
+	listed time.Time
+	// lastReport is the end of the last report, statePath the state file
+	// the totals were loaded from
+	lastReport time.Time
+	statePath  string
+}
+
+var podUsage = &UsageAccounting{
+	pods:       make(map[usageKey]*PodUsage),
+	lastReport: time.Now(),
+}
+
+// load replaces the totals by the ones of the state file, if it exists. The
+// time the plugin was down is not charged, nor the time since the previous
+// listing, as the devices held then are accounted in the replaced totals.
+func (u *UsageAccounting) load() error {
+	u.statePath = cfg().UsageStateFile
+	content, err := ioutil.ReadFile(cfg().UsageStateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := usageState{}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return err
+	}
+	u.pods = make(map[usageKey]*PodUsage)
+	u.held = nil
+	u.listed = time.Time{}
+	for _, usage := range state.Pods {
+		u.pods[usageKey{usage.Namespace, usage.Pod, usage.Resource}] = usage
+	}
+	if !state.LastReport.IsZero() {
+		u.lastReport = state.LastReport
+	}
+	return nil
+}
+
+// save writes the totals to the state file
+func (u *UsageAccounting) save() error {
+	state := usageState{LastReport: u.lastReport, Pods: u.sorted()}
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cfg().UsageStateFile, content, 0644)
+}
+
+// sorted returns the usage sorted by namespace, pod and resource
+func (u *UsageAccounting) sorted() []*PodUsage {
+	pods := []*PodUsage{}
+	for _, usage := range u.pods {
+		pods = append(pods, usage)
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		a, b := pods[i], pods[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Pod != b.Pod {
+			return a.Pod < b.Pod
+		}
+		return a.Resource < b.Resource
+	})
+	return pods
+}
+
+// record charges the devices held since the last listing and takes the
+// devices held now. The usage of the pods gone for usageRetention is dropped
+// once reported. The totals are saved to the state file, if any.
+func (u *UsageAccounting) record(holders map[string][]DeviceHolder, now time.Time) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if cfg().UsageStateFile != "" && cfg().UsageStateFile != u.statePath {
+		if err := u.load(); err != nil {
+			podsLog.Errorf("Can't load the usage from %s, the usage is accounted from now on: %v", cfg().UsageStateFile, err)
+		}
+	}
+	if !u.listed.IsZero() {
+		elapsed := now.Sub(u.listed).Seconds()
+		for key, devices := range u.held {
+			u.pods[key].DeviceSeconds += elapsed * float64(devices)
+			u.pods[key].LastSeen = now
+		}
+	}
+
+	// a device is counted once per pod and resource, whatever the number
+	// of containers holding it
+	held := make(map[usageKey]map[string]bool)
+	for id, deviceHolders := range holders {
+		for _, holder := range deviceHolders {
+			key := usageKey{holder.Namespace, holder.Pod, holder.Resource}
+			if held[key] == nil {
+				held[key] = make(map[string]bool)
+			}
+			held[key][id] = true
+		}
+	}
+	u.held = make(map[usageKey]int)
+	for key, ids := range held {
+		u.held[key] = len(ids)
+		if _, ok := u.pods[key]; !ok {
+			u.pods[key] = &PodUsage{Namespace: key.namespace, Pod: key.pod, Resource: key.resource}
+		}
+		u.pods[key].LastSeen = now
+	}
+	u.listed = now
+
+	for key, usage := range u.pods {
+		reported := cfg().UsageReportFile == "" || usage.Reported == usage.DeviceSeconds
+		if _, ok := u.held[key]; !ok && reported && now.Sub(usage.LastSeen) > usageRetention {
+			delete(u.pods, key)
+		}
+	}
+	if cfg().UsageStateFile != "" {
+		if err := u.save(); err != nil {
+			podsLog.Warnf("Can't save the usage to %s: %v", cfg().UsageStateFile, err)
+		}
+	}
+}
+
+// pause stops charging the devices until the next listing, while the pod
+// resources are not listed
+func (u *UsageAccounting) pause() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.held = nil
+	u.listed = time.Time{}
+}
+
+// report returns the usage since the last report of the pods which held
+// devices
+func (u *UsageAccounting) report(now time.Time) UsageReport {
+	report := UsageReport{
+		Node:  os.Getenv(NodeNameEnv),
+		Start: u.lastReport,
+		End:   now,
+		Usage: []UsageReportEntry{},
+	}
+	for _, usage := range u.sorted() {
+		if usage.DeviceSeconds == usage.Reported {
+			continue
+		}
+		report.Usage = append(report.Usage, UsageReportEntry{
+			Namespace:          usage.Namespace,
+			Pod:                usage.Pod,
+			Resource:           usage.Resource,
+			DeviceSeconds:      usage.DeviceSeconds - usage.Reported,
+			TotalDeviceSeconds: usage.DeviceSeconds,
+		})
+	}
+	return report
+}
+
+// writeReport writes the usage report to UsageReportFile once
+// UsageReportInterval passed since the last report
+func (u *UsageAccounting) writeReport(now time.Time) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if cfg().UsageReportFile == "" || now.Sub(u.lastReport) < time.Duration(cfg().UsageReportInterval)*time.Second {
+		return
+	}
+	content, err := json.MarshalIndent(u.report(now), "", "  ")
+	if err != nil {
+		podsLog.Errorf("Can't write the usage report: %v", err)
+		return
+	}
+	if err := writeFileAtomic(cfg().UsageReportFile, content, 0644); err != nil {
+		podsLog.Errorf("Can't write the usage report %s: %v", cfg().UsageReportFile, err)
+		return
+	}
+	podsLog.Printf("Usage report written to %s", cfg().UsageReportFile)
+	for _, usage := range u.pods {
+		usage.Reported = usage.DeviceSeconds
+	}
+	u.lastReport = now
+	if cfg().UsageStateFile != "" {
+		if err := u.save(); err != nil {
+			podsLog.Warnf("Can't save the usage to %s: %v", cfg().UsageStateFile, err)
+		}
+	}
+}
+
+// collectUsage sets the usage metric of every pod
+func (u *UsageAccounting) collectUsage() {
+	metrics.reset(metricPodDeviceSeconds)
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for _, usage := range u.pods {
+		metrics.set(metricPodDeviceSeconds, usage.DeviceSeconds,
+			"namespace", usage.Namespace, "pod", usage.Pod, "resource", usage.Resource)
+	}
+}
+
+// usageHandler serves the usage since the last report in JSON
+func (u *UsageAccounting) usageHandler(w http.ResponseWriter, r *http.Request) {
+	u.lock.Lock()
+	report := u.report(time.Now())
+	u.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		httpLog.Debugf("Can't write the usage report: %v", err)
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usageStep is a listing, a pause or a report of the usage accounting at a
+// time in seconds, with the expected totals by pod and resource after it
+type usageStep struct {
+	at      int
+	op      string
+	holders map[string][]DeviceHolder
+	// report are the entries expected in the report, nil if no report is
+	// written
+	report []UsageReportEntry
+	totals map[usageKey]float64
+}
+
+func usageHolder(pod string, container string, resource string) DeviceHolder {
+	return DeviceHolder{Namespace: "ns", Pod: pod, Container: container, Resource: resource}
+}
+
+func TestUsageAccounting(t *testing.T) {
+	const (
+		amd    = "amd.com/u250"
+		xilinx = "xilinx.com/u250"
+	)
+	a, b := usageKey{"ns", "a", amd}, usageKey{"ns", "b", amd}
+	aLegacy := usageKey{"ns", "a", xilinx}
+	tests := []struct {
+		name  string
+		steps []usageStep
+	}{
+		{
+			name: "devices are charged until the next listing",
+			steps: []usageStep{
+				{at: 0, op: "list", holders: map[string][]DeviceHolder{"d1": {usageHolder("a", "c", amd)}, "d2": {usageHolder("a", "c", amd)}},
+					totals: map[usageKey]float64{a: 0}},
+				{at: 10, op: "list", holders: map[string][]DeviceHolder{"d1": {usageHolder("a", "c", amd)}},
+					totals: map[usageKey]float64{a: 20}},
+				{at: 15, op: "list", holders: map[string][]DeviceHolder{},
+					totals: map[usageKey]float64{a: 25}},
+				{at: 25, op: "list", holders: map[string][]DeviceHolder{},
+					totals: map[usageKey]float64{a: 25}},
+			},
+		},
+		{
+			name: "a device is charged once per pod and resource",
+			steps: []usageStep{
+				{at: 0, op: "list", holders: map[string][]DeviceHolder{
+					"d1": {usageHolder("a", "c1", amd), usageHolder("a", "c2", amd), usageHolder("a", "c1", xilinx)},
+					"d2": {usageHolder("b", "c1", amd)},
+				}},
+				{at: 30, op: "list", holders: map[string][]DeviceHolder{},
+					totals: map[usageKey]float64{a: 30, aLegacy: 30, b: 30}},
+			},
+		},
+		{
+			name: "no charge while paused",
+			steps: []usageStep{
+				{at: 0, op: "list", holders: map[string][]DeviceHolder{"d1": {usageHolder("a", "c", amd)}}},
+				{at: 10, op: "pause",
+					totals: map[usageKey]float64{a: 0}},
+				{at: 20, op: "list", holders: map[string][]DeviceHolder{"d1": {usageHolder("a", "c", amd)}},
+					totals: map[usageKey]float64{a: 0}},
+				{at: 30, op: "list", holders: map[string][]DeviceHolder{"d1": {usageHolder("a", "c", amd)}},
+					totals: map[usageKey]float64{a: 10}},
+			},
+		},
+		{
+			name: "pods without devices are dropped after the retention",
+			steps: []usageStep{
+				{at: 0, op: "list", holders: map[string][]DeviceHolder{"d1": {usageHolder("a", "c", amd)}}},
+				{at: 10, op: "list", holders: map[string][]DeviceHolder{"d2": {usageHolder("b", "c", amd)}},
+					totals: map[usageKey]float64{a: 10, b: 0}},
+				{at: 10 + int(usageRetention/time.Second), op: "list", holders: map[string][]DeviceHolder{"d2": {usageHolder("b", "c", amd)}},
+					totals: map[usageKey]float64{a: 10, b: 86400}},
+				// kept until its usage is reported
+				{at: 11 + int(usageRetention/time.Second), op: "list", holders: map[string][]DeviceHolder{},
+					totals: map[usageKey]float64{a: 10, b: 86401}},
+				{at: 11 + int(usageRetention/time.Second), op: "report",
+					report: []UsageReportEntry{
+						{Namespace: "ns", Pod: "a", Resource: amd, DeviceSeconds: 10, TotalDeviceSeconds: 10},
+						{Namespace: "ns", Pod: "b", Resource: amd, DeviceSeconds: 86401, TotalDeviceSeconds: 86401},
+					}},
+				{at: 12 + int(usageRetention/time.Second), op: "list", holders: map[string][]DeviceHolder{},
+					totals: map[usageKey]float64{b: 86401}},
+			},
+		},
+		{
+			name: "reports cover the usage since the previous report",
+			steps: []usageStep{
+				{at: 0, op: "list", holders: map[string][]DeviceHolder{"d1": {usageHolder("a", "c", amd)}}},
+				{at: 100, op: "list", holders: map[string][]DeviceHolder{"d1": {usageHolder("a", "c", amd)}, "d2": {usageHolder("b", "c", amd)}}},
+				{at: 100, op: "report",
+					report: []UsageReportEntry{{Namespace: "ns", Pod: "a", Resource: amd, DeviceSeconds: 100, TotalDeviceSeconds: 100}}},
+				{at: 150, op: "list", holders: map[string][]DeviceHolder{"d2": {usageHolder("b", "c", amd)}}},
+				// within the report interval
+				{at: 150, op: "report"},
+				{at: 200, op: "list", holders: map[string][]DeviceHolder{}},
+				{at: 200, op: "report",
+					report: []UsageReportEntry{
+						{Namespace: "ns", Pod: "a", Resource: amd, DeviceSeconds: 50, TotalDeviceSeconds: 150},
+						{Namespace: "ns", Pod: "b", Resource: amd, DeviceSeconds: 100, TotalDeviceSeconds: 100},
+					},
+					totals: map[usageKey]float64{a: 150, b: 100}},
+				{at: 300, op: "report", report: []UsageReportEntry{}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := defaultConfig()
+			config.UsageReportFile = path.Join(t.TempDir(), "usage.json")
+			config.UsageReportInterval = 60
+			useConfig(t, config)
+			start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			usage := &UsageAccounting{pods: make(map[usageKey]*PodUsage), lastReport: start}
+			for i, step := range test.steps {
+				now := start.Add(time.Duration(step.at) * time.Second)
+				switch step.op {
+				case "list":
+					usage.record(step.holders, now)
+				case "pause":
+					usage.pause()
+				case "report":
+					os.Remove(config.UsageReportFile)
+					usage.writeReport(now)
+					content, err := ioutil.ReadFile(config.UsageReportFile)
+					if step.report == nil {
+						if err == nil {
+							t.Errorf("step %d: report written within the interval", i)
+						}
+						break
+					}
+					var report UsageReport
+					if err == nil {
+						err = json.Unmarshal(content, &report)
+					}
+					if err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+					if !report.End.Equal(now) || !reflect.DeepEqual(report.Usage, step.report) {
+						t.Errorf("step %d: report until %v %+v, want until %v %+v", i, report.End, report.Usage, now, step.report)
+					}
+				}
+				if step.totals == nil {
+					continue
+				}
+				totals := make(map[usageKey]float64)
+				for key, pod := range usage.pods {
+					totals[key] = pod.DeviceSeconds
+				}
+				if !reflect.DeepEqual(totals, step.totals) {
+					t.Errorf("step %d: totals %v, want %v", i, totals, step.totals)
+				}
+			}
+		})
+	}
+}
+
+func TestUsageStatePersistence(t *testing.T) {
+	const amd = "amd.com/u250"
+	dir := t.TempDir()
+	config := defaultConfig()
+	config.UsageStateFile = path.Join(dir, "state", "usage.json")
+	useConfig(t, config)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	holders := map[string][]DeviceHolder{"d1": {usageHolder("a", "c", amd)}, "d2": {usageHolder("a", "c", amd)}}
+	usage := &UsageAccounting{pods: make(map[usageKey]*PodUsage), lastReport: start}
+	usage.record(holders, start)
+	usage.record(holders, start.Add(10*time.Second))
+
+	// a restarted plugin starts from the saved totals, the time it was down
+	// is not charged
+	restarted := &UsageAccounting{pods: make(map[usageKey]*PodUsage), lastReport: start.Add(time.Hour)}
+	restarted.record(holders, start.Add(time.Hour))
+	restarted.record(holders, start.Add(time.Hour+5*time.Second))
+	a := usageKey{"ns", "a", amd}
+	if len(restarted.pods) != 1 || restarted.pods[a].DeviceSeconds != 30 {
+		t.Errorf("restarted totals %+v, want 30 for %v", restarted.pods, a)
+	}
+	if !restarted.lastReport.Equal(start) {
+		t.Errorf("last report %v, want the saved %v", restarted.lastReport, start)
+	}
+	content, err := ioutil.ReadFile(config.UsageStateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state usageState
+	if err := json.Unmarshal(content, &state); err != nil || len(state.Pods) != 1 || state.Pods[0].DeviceSeconds != 30 {
+		t.Errorf("state %s, error %v", content, err)
+	}
+
+	// an invalid state file is ignored, the usage is accounted from now on
+	if err := os.WriteFile(config.UsageStateFile, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fresh := &UsageAccounting{pods: make(map[usageKey]*PodUsage), lastReport: start}
+	fresh.record(holders, start)
+	fresh.record(holders, start.Add(time.Second))
+	if fresh.pods[a].DeviceSeconds != 2 {
+		t.Errorf("totals %v after an invalid state file, want 2", fresh.pods[a].DeviceSeconds)
+	}
+	// and replaced by the next save
+	if content, _ := ioutil.ReadFile(config.UsageStateFile); !strings.Contains(string(content), `"deviceSeconds": 2`) {
+		t.Errorf("state not saved again:\n%s", content)
+	}
+}
+
+func TestUsageStateReload(t *testing.T) {
+	const amd = "amd.com/u250"
+	dir := t.TempDir()
+	config := defaultConfig()
+	config.UsageStateFile = path.Join(dir, "before.json")
+	useConfig(t, config)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	holders := map[string][]DeviceHolder{"d1": {usageHolder("a", "c", amd)}, "d2": {usageHolder("a", "c", amd)}}
+	usage := &UsageAccounting{pods: make(map[usageKey]*PodUsage), lastReport: start}
+	usage.record(holders, start)
+	usage.record(holders, start.Add(10*time.Second))
+
+	// the totals of another state file replace the current ones, the
+	// devices held before the reload are charged from the next listing
+	saved := usageState{LastReport: start, Pods: []*PodUsage{
+		{Namespace: "ns", Pod: "b", Resource: amd, DeviceSeconds: 100, LastSeen: start},
+	}}
+	content, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.UsageStateFile = path.Join(dir, "after.json")
+	if err := os.WriteFile(config.UsageStateFile, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	usage.record(holders, start.Add(20*time.Second))
+	usage.record(holders, start.Add(25*time.Second))
+	a, b := usageKey{"ns", "a", amd}, usageKey{"ns", "b", amd}
+	if len(usage.pods) != 2 || usage.pods[a].DeviceSeconds != 10 || usage.pods[b].DeviceSeconds != 100 {
+		t.Errorf("reloaded totals %+v, want 10 for %v and 100 for %v", usage.pods, a, b)
+	}
+}
+
+func TestUsageWithoutFiles(t *testing.T) {
+	const amd = "amd.com/u250"
+	useConfig(t, defaultConfig())
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	usage := &UsageAccounting{pods: make(map[usageKey]*PodUsage), lastReport: start}
+	usage.record(map[string][]DeviceHolder{"d1": {usageHolder("a", "c", amd)}}, start)
+	usage.record(map[string][]DeviceHolder{}, start.Add(10*time.Second))
+	// no report is written, the usage is dropped after the retention
+	// without waiting for a report
+	usage.writeReport(start.Add(365 * 24 * time.Hour))
+	usage.record(map[string][]DeviceHolder{}, start.Add(usageRetention+11*time.Second))
+	if len(usage.pods) != 0 {
+		t.Errorf("usage kept without report file: %+v", usage.pods)
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	const amd = "amd.com/u250"
+	r := useMetrics(t)
+	useConfig(t, defaultConfig())
+	t.Setenv(NodeNameEnv, "fpga-1")
+	start := time.Now().Add(-time.Minute)
+	usage := &UsageAccounting{pods: make(map[usageKey]*PodUsage), lastReport: start}
+	usage.pods[usageKey{"ns", "a", amd}] = &PodUsage{Namespace: "ns", Pod: "a", Resource: amd, DeviceSeconds: 40, Reported: 30}
+	usage.pods[usageKey{"ns", "b", amd}] = &PodUsage{Namespace: "ns", Pod: "b", Resource: amd, DeviceSeconds: 20, Reported: 20}
+
+	w := httptest.NewRecorder()
+	usage.usageHandler(w, httptest.NewRequest("GET", "/usage", nil))
+	var report UsageReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	// pod b has no usage since the last report
+	want := []UsageReportEntry{{Namespace: "ns", Pod: "a", Resource: amd, DeviceSeconds: 10, TotalDeviceSeconds: 40}}
+	if w.Header().Get("Content-Type") != "application/json" || report.Node != "fpga-1" ||
+		!report.Start.Equal(start) || report.End.Before(start) || !reflect.DeepEqual(report.Usage, want) {
+		t.Errorf("report %s", w.Body.String())
+	}
+	// serving the usage is no report
+	if usage.pods[usageKey{"ns", "a", amd}].Reported != 30 || !usage.lastReport.Equal(start) {
+		t.Errorf("usage marked as reported")
+	}
+
+	usage.collectUsage()
+	text := metricsText(t, r)
+	for _, line := range []string{
+		`amd_fpga_pod_device_seconds_total{namespace="ns",pod="a",resource="amd.com/u250"} 40`,
+		`amd_fpga_pod_device_seconds_total{namespace="ns",pod="b",resource="amd.com/u250"} 20`,
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("no %s in\n%s", line, text)
+		}
+	}
+}
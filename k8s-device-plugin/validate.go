@@ -0,0 +1,185 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// DeviceCheck is the outcome of validating the naming of a device
+type DeviceCheck struct {
+	BDF string
+	// Rule is the name customization rule naming the device, or "-"
+	Rule     string
+	Resource string
+	// Unit is the allocation unit, Card or Device
+	Unit string
+	// Replicas is the number of containers sharing the device
+	Replicas int
+	Warnings []string
+	Errors   []string
+}
+
+// checkDevices names every device like the plugin would, and reports the
+// matched rule, the resource name and the problems of each device
+func checkDevices(devices []Device, names *NameCustomize) []*DeviceCheck {
+	checks := []*DeviceCheck{}
+	byBDF := make(map[string]*DeviceCheck)
+	// the shells registered under each resource
+	shells := make(map[string]map[string]bool)
+	for _, device := range devices {
+		// virtual devices share the check of their card
+		bdf := GetPciBDF(device.DBDF)
+		if check, ok := byBDF[bdf]; ok {
+			check.Replicas++
+			continue
+		}
+		check := &DeviceCheck{BDF: bdf, Rule: "-", Unit: "Device", Replicas: 1}
+		byBDF[bdf] = check
+		checks = append(checks, check)
+
+		// named like getDSAtype does, without logging the naming errors
+		// which are reported with the check
+		check.Resource = defaultDSAtype(device)
+		if cfg().DeviceNameCustomize && names != nil && !device.family.namesResource() {
+			name, rule, err := names.getName(device)
+			if err != nil {
+				check.Errors = append(check.Errors, err.Error())
+			} else if rule == nil {
+				check.Warnings = append(check.Warnings, "no rule matches, the default name is used")
+			} else {
+				check.Rule = rule.Name
+				if name != "" {
+					check.Resource = name
+				}
+			}
+		}
+		if err := validateResourceName(check.Resource); err != nil {
+			check.Errors = append(check.Errors, err.Error())
+		}
+		if isCardUnit(device) && strings.EqualFold(cfg().U30AllocUnit, "Card") {
+			check.Unit = "Card"
+		}
+		shell := device.shellVer
+		if device.family.withTimestamp() {
+			shell += "-" + device.timestamp
+		}
+		if shells[check.Resource] == nil {
+			shells[check.Resource] = make(map[string]bool)
+		}
+		shells[check.Resource][shell] = true
+	}
+	for _, check := range checks {
+		if len(shells[check.Resource]) > 1 {
+			others := []string{}
+			for shell := range shells[check.Resource] {
+				others = append(others, shell)
+			}
+			sort.Strings(others)
+			check.Warnings = append(check.Warnings, fmt.Sprintf("name collision, %s is the resource of shells %s",
+				check.Resource, strings.Join(others, ", ")))
+		}
+		if isAggregate(check.Resource) {
+			check.Warnings = append(check.Warnings, fmt.Sprintf("name collision, %s is an aggregate resource", check.Resource))
+		}
+		check.Resource = cfg().ResourceDomain + "/" + check.Resource
+	}
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].BDF < checks[j].BDF
+	})
+	return checks
+}
+
+// printDeviceChecks prints a table of the device checks
+func printDeviceChecks(w io.Writer, checks []*DeviceCheck) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BDF\tRULE\tRESOURCE\tUNIT\tREPLICAS\tPROBLEMS")
+	for _, check := range checks {
+		problems := []string{}
+		for _, err := range check.Errors {
+			problems = append(problems, "error: "+err)
+		}
+		for _, warning := range check.Warnings {
+			problems = append(problems, "warning: "+warning)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", check.BDF, check.Rule, check.Resource, check.Unit,
+			strconv.Itoa(check.Replicas), strings.Join(problems, "; "))
+	}
+	return tw.Flush()
+}
+
+// runValidate loads the config and the name customization, runs discovery
+// against the live or a fixture tree and checks the naming of every device.
+// It fails if there is any error.
+func runValidate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flagConfig := flags.String("config", "", "Config file, YAML or JSON.")
+	flagRoot := flags.String("root", "", "Discover the devices in the sysfs and /dev trees under this directory.")
+	registerConfigFlags(flags)
+	flags.Parse(args)
+
+	fileErrs, err := loadSubcommandConfig(flags, *flagConfig)
+	if err != nil {
+		return err
+	}
+	errs := []string{}
+	for _, err := range fileErrs {
+		errs = append(errs, err.Error())
+	}
+	var names *NameCustomize
+	if cfg().DeviceNameCustomize {
+		content, err := ioutil.ReadFile(cfg().NameCustomizeFile)
+		if err == nil {
+			names, err = parseNameCustomize(content)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", cfg().NameCustomizeFile, err))
+		}
+	}
+	if *flagRoot != "" {
+		setDiscoveryRoot(*flagRoot)
+	}
+	devices, err := GetDevices()
+	if err != nil {
+		return fmt.Errorf("Error to get FPGA devices: %v", err)
+	}
+	checks := checkDevices(devices, names)
+	if err := printDeviceChecks(os.Stdout, checks); err != nil {
+		return err
+	}
+	for _, check := range checks {
+		for _, err := range check.Errors {
+			errs = append(errs, check.BDF+": "+err)
+		}
+	}
+	for _, err := range errs {
+		cliLog.Error(err)
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("validation failed with %d error(s)", len(errs))
+	}
+	return nil
+}
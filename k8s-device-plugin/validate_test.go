@@ -0,0 +1,156 @@
+// Copyright 2018-2022, Xilinx, Inc.
+// Copyright 2023, Advanced Micro Device, Inc.
+// Author: Brian Xu(brianx@xilinx.com)
+// For technical support, please contact k8s_dev@amd.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCheckDevices(t *testing.T) {
+	config := defaultConfig()
+	config.DeviceNameCustomize = true
+	fpga := &AggregateResource{Name: "fpga"}
+	if err := fpga.compile(); err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, config, fpga)
+	names, err := parseNameCustomize([]byte(`{"rules": [
+		{"name": "by-sn", "match": {"sn": "XFL1[AB]"}, "template": "u250"},
+		{"name": "bad", "match": {"sn": "XFL1C"}, "template": "{{.BDF}}"},
+		{"name": "aggregate", "match": {"sn": "XFL1D"}, "template": "fpga"},
+		{"name": "u30", "match": {"sn": "XFL1U30"}, "template": "u30-custom"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := func(bdf string, sn string, shell string) Device {
+		return Device{DBDF: bdf, SN: sn, shellVer: shell, timestamp: "0x1", Nodes: &Pairs{}}
+	}
+	u30 := func(bdf string) Device {
+		dev := device(bdf, "XFL1U30", U30CommonShell)
+		dev.family = getShellFamily("xilinx_u30_gen3x4_base_2")
+		return dev
+	}
+	logged := captureLog(t, log.InfoLevel)
+	checks := checkDevices([]Device{
+		device("0000:3c:00.1", "XFL1B", "xilinx_u250_gen3x16_xdma_shell_4_1"),
+		device("0000:3b:00.1", "XFL1A", "xilinx_u250_gen3x16_xdma_shell_3_1"),
+		device("0000:5e:00.1", "XFL1C", "xilinx_u280"),
+		device("0000:5f:00.1", "XFL1D", "xilinx_u280"),
+		device("0000:60:00.1", "XFL1E", "xilinx_u55c"),
+		u30("0000:82:00.1-0"), u30("0000:82:00.1-1"), u30("0000:82:00.1-2"),
+	}, names)
+
+	want := []struct {
+		bdf, rule, resource, unit string
+		replicas                  int
+		// problems are substrings of the errors and warnings
+		problems []string
+	}{
+		{"0000:3b:00.1", "by-sn", "amd.com/u250", "Device", 1, []string{"name collision, u250 is the resource of shells xilinx_u250_gen3x16_xdma_shell_3_1-0x1, xilinx_u250_gen3x16_xdma_shell_4_1-0x1"}},
+		{"0000:3c:00.1", "by-sn", "amd.com/u250", "Device", 1, []string{"name collision, u250"}},
+		{"0000:5e:00.1", "-", "amd.com/xilinx_u280-0x1", "Device", 1, []string{`rule "bad"`}},
+		{"0000:5f:00.1", "aggregate", "amd.com/fpga", "Device", 1, []string{"fpga is an aggregate resource"}},
+		{"0000:60:00.1", "-", "amd.com/xilinx_u55c-0x1", "Device", 1, []string{"no rule matches"}},
+		// the U30 family names its devices before the customization
+		{"0000:82:00.1", "-", "amd.com/ama_u30", "Card", 3, nil},
+	}
+	if len(checks) != len(want) {
+		t.Fatalf("got %d checks, want %d", len(checks), len(want))
+	}
+	for i, check := range checks {
+		w := want[i]
+		if check.BDF != w.bdf || check.Rule != w.rule || check.Resource != w.resource || check.Unit != w.unit || check.Replicas != w.replicas {
+			t.Errorf("check %d: got %+v, want %+v", i, *check, w)
+		}
+		problems := strings.Join(append(append([]string{}, check.Errors...), check.Warnings...), "\n")
+		for _, problem := range w.problems {
+			if !strings.Contains(problems, problem) {
+				t.Errorf("%s: no %q in %q", check.BDF, problem, problems)
+			}
+		}
+		if len(check.Errors)+len(check.Warnings) != len(w.problems) {
+			t.Errorf("%s: got problems %q, want %q", check.BDF, problems, w.problems)
+		}
+	}
+
+	// the naming errors are reported with the checks only
+	if logged.Len() != 0 {
+		t.Errorf("naming logged:\n%s", logged)
+	}
+
+	var out bytes.Buffer
+	if err := printDeviceChecks(&out, checks[2:3]); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || !strings.Contains(lines[1], "error: rule \"bad\"") {
+		t.Errorf("table:\n%s", out.String())
+	}
+}
+
+func TestCheckDevicesWithoutCustomization(t *testing.T) {
+	useConfig(t, defaultConfig())
+	names, err := parseNameCustomize([]byte(`{"rules": [{"name": "all", "template": "fpga"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rules are ignored unless the name customization is on
+	checks := checkDevices([]Device{{DBDF: "0000:3b:00.1", shellVer: "xilinx_u250", timestamp: "0x1", Nodes: &Pairs{}}}, names)
+	if len(checks) != 1 || checks[0].Rule != "-" || checks[0].Resource != "amd.com/xilinx_u250-0x1" || len(checks[0].Warnings) != 0 {
+		t.Errorf("got %+v", checks[0])
+	}
+	if checks := checkDevices(nil, nil); len(checks) != 0 {
+		t.Errorf("got %d checks without devices", len(checks))
+	}
+}
+
+func TestLoadConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	config := defaultConfig()
+	config.ShellFamilyFile = path.Join(dir, "ShellFamilies.json")
+	config.AggregateResourceFile = path.Join(dir, "AggregateResources.json")
+	config.XclbinPreloadFile = path.Join(dir, "missing.json")
+	for fname, content := range map[string]string{
+		config.ShellFamilyFile:       `{"families": [{"name": "v70"}]}`,
+		config.AggregateResourceFile: `{"aggregates": [{"name": "fpga"}]}`,
+	} {
+		if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a broken file is reported, the other files are still loaded and a
+	// missing file is no error
+	rc, errs := loadConfigFiles(config)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "no match pattern") {
+		t.Errorf("got errors %v", errs)
+	}
+	if len(rc.AggregateResources) != 1 || rc.AggregateResources[0].Name != "fpga" {
+		t.Errorf("aggregates %v", rc.AggregateResources)
+	}
+	if len(rc.ShellFamilies) != len(builtinShellFamilies(config)) || len(rc.XclbinPreloads) != 0 {
+		t.Errorf("families %d, preloads %d", len(rc.ShellFamilies), len(rc.XclbinPreloads))
+	}
+	if rc.Config != config {
+		t.Errorf("files loaded for another config")
+	}
+}